@@ -5,7 +5,7 @@ import (
 	"fmt"
 
 	kapi "k8s.io/kubernetes/pkg/api"
-	kubernetes "k8s.io/kubernetes/pkg/client/clientset_generated/release_1_3"
+	kubernetes "k8s.io/kubernetes/pkg/client/clientset_generated/internalclientset"
 
 	"github.com/jetstack-experimental/kube2consul/pkg/interfaces"
 )
@@ -21,17 +21,11 @@ func New(k interfaces.Kube2Consul) *DetectNode {
 }
 
 func (s *DetectNode) NodeNameByPodIP(podIP string) (nodeName string, err error) {
-	pods, err := s.kube2consul.KubernetesClientset().Core().Pods("").List(kapi.ListOptions{})
+	pod, err := s.kube2consul.PodLister().GetByIP(podIP)
 	if err != nil {
 		return "", err
 	}
-
-	for _, pod := range pods.Items {
-		if pod.Status.PodIP == podIP {
-			return pod.Spec.NodeName, nil
-		}
-	}
-	return "", fmt.Errorf("No pod found with podIP %s", podIP)
+	return pod.Spec.NodeName, nil
 }
 
 func (s *DetectNode) NodeIPByPodIP(podIP string) (nodeIP string, err error) {
@@ -40,13 +34,24 @@ func (s *DetectNode) NodeIPByPodIP(podIP string) (nodeIP string, err error) {
 		return "", err
 	}
 
-	node, err := s.kube2consul.KubernetesClientset().Core().Nodes().Get(nodeName)
+	node, err := s.NodeByName(nodeName)
 	if err != nil {
 		return "", err
 	}
 
-	return node.Status.Addresses[0].Address, nil
+	return NodeAddress(node)
+}
 
+func (s *DetectNode) NodeByName(nodeName string) (*kapi.Node, error) {
+	return s.kube2consul.NodeLister().Get(nodeName)
+}
+
+// NodeAddress returns the address a node is reachable on
+func NodeAddress(node *kapi.Node) (string, error) {
+	if len(node.Status.Addresses) == 0 {
+		return "", fmt.Errorf("Node %s has no addresses", node.Name)
+	}
+	return node.Status.Addresses[0].Address, nil
 }
 
 var (
@@ -0,0 +1,90 @@
+package detect_node
+
+import (
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	kapi "k8s.io/kubernetes/pkg/api"
+	kcache "k8s.io/kubernetes/pkg/client/cache"
+
+	"github.com/jetstack-experimental/kube2consul/pkg/informers"
+	"github.com/jetstack-experimental/kube2consul/pkg/mocks"
+)
+
+func newTestDetectNode(t *testing.T) (*DetectNode, *gomock.Controller) {
+	ctrl := gomock.NewController(t)
+
+	nodes := kcache.NewIndexer(kcache.MetaNamespaceKeyFunc, kcache.Indexers{})
+	nodes.Add(&kapi.Node{
+		ObjectMeta: kapi.ObjectMeta{Name: "node-1"},
+		Status: kapi.NodeStatus{
+			Addresses: []kapi.NodeAddress{
+				kapi.NodeAddress{Type: kapi.NodeInternalIP, Address: "192.168.0.1"},
+			},
+		},
+	})
+
+	pods := kcache.NewIndexer(kcache.MetaNamespaceKeyFunc, informers.PodIndexers)
+	pods.Add(&kapi.Pod{
+		ObjectMeta: kapi.ObjectMeta{Namespace: "default", Name: "web-1"},
+		Spec:       kapi.PodSpec{NodeName: "node-1"},
+		Status:     kapi.PodStatus{PodIP: "1.2.3.4", Phase: kapi.PodRunning},
+	})
+	pods.Add(&kapi.Pod{
+		ObjectMeta: kapi.ObjectMeta{Namespace: "kube-system", Name: "dns-1"},
+		Spec:       kapi.PodSpec{NodeName: "node-2"},
+		Status:     kapi.PodStatus{PodIP: "1.2.3.5", Phase: kapi.PodRunning},
+	})
+	// a terminated pod whose IP has been reused
+	pods.Add(&kapi.Pod{
+		ObjectMeta: kapi.ObjectMeta{Namespace: "default", Name: "job-1"},
+		Spec:       kapi.PodSpec{NodeName: "node-3"},
+		Status:     kapi.PodStatus{PodIP: "1.2.3.4", Phase: kapi.PodSucceeded},
+	})
+
+	mockK2C := mocks.NewMockKube2Consul(ctrl)
+	mockK2C.EXPECT().NodeLister().Return(informers.NewNodeLister(nodes)).AnyTimes()
+	mockK2C.EXPECT().PodLister().Return(informers.NewPodLister(pods)).AnyTimes()
+
+	return New(mockK2C), ctrl
+}
+
+func TestNodeNameByPodIP(t *testing.T) {
+	d, ctrl := newTestDetectNode(t)
+	defer ctrl.Finish()
+
+	for podIP, exp := range map[string]string{
+		"1.2.3.4": "node-1",
+		"1.2.3.5": "node-2",
+	} {
+		act, err := d.NodeNameByPodIP(podIP)
+		if err != nil {
+			t.Errorf("Unexpected error for PodIP %s: %s", podIP, err)
+		}
+		if exp != act {
+			t.Errorf("Node '%s' of PodIP %s is not the expected '%s'", act, podIP, exp)
+		}
+	}
+
+	if _, err := d.NodeNameByPodIP("1.2.3.6"); err == nil {
+		t.Errorf("Expected error for unknown PodIP")
+	}
+}
+
+func TestNodeIPByPodIP(t *testing.T) {
+	d, ctrl := newTestDetectNode(t)
+	defer ctrl.Finish()
+
+	nodeIP, err := d.NodeIPByPodIP("1.2.3.4")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if exp, act := "192.168.0.1", nodeIP; exp != act {
+		t.Errorf("Node IP '%s' is not the expected '%s'", act, exp)
+	}
+
+	// the node of this pod does not exist
+	if _, err := d.NodeIPByPodIP("1.2.3.5"); err == nil {
+		t.Errorf("Expected error for pod on unknown node")
+	}
+}
@@ -0,0 +1,241 @@
+package informers
+
+import (
+	"sync"
+	"time"
+
+	kapi "k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/apis/extensions"
+	kcache "k8s.io/kubernetes/pkg/client/cache"
+	kubernetes "k8s.io/kubernetes/pkg/client/clientset_generated/internalclientset"
+	kframework "k8s.io/kubernetes/pkg/controller/framework"
+	klabels "k8s.io/kubernetes/pkg/labels"
+	kruntime "k8s.io/kubernetes/pkg/runtime"
+	kwatch "k8s.io/kubernetes/pkg/watch"
+
+	"github.com/jetstack-experimental/kube2consul/pkg/interfaces"
+)
+
+// syncPollInterval is the interval informers are checked for a completed
+// initial list
+const syncPollInterval = 100 * time.Millisecond
+
+// SharedInformerFactory creates one informer per watched type, which is
+// shared by all event handlers and listers of that type. Services, endpoints
+// and ingresses are restricted to the namespace and selector, pods to the
+// namespace.
+type SharedInformerFactory struct {
+	client    kubernetes.Interface
+	namespace string
+	selector  klabels.Selector
+	resync    time.Duration
+
+	lock      sync.Mutex
+	informers map[string]kframework.SharedIndexInformer
+	started   map[string]bool
+}
+
+func NewSharedInformerFactory(client kubernetes.Interface, namespace string, selector klabels.Selector, resync time.Duration) *SharedInformerFactory {
+	return &SharedInformerFactory{
+		client:    client,
+		namespace: namespace,
+		selector:  selector,
+		resync:    resync,
+		informers: make(map[string]kframework.SharedIndexInformer),
+		started:   make(map[string]bool),
+	}
+}
+
+// informer returns the informer of a type, creating it on first use
+func (f *SharedInformerFactory) informer(name string, newFunc func() kframework.SharedIndexInformer) kframework.SharedIndexInformer {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	informer, ok := f.informers[name]
+	if !ok {
+		informer = newFunc()
+		f.informers[name] = informer
+	}
+	return informer
+}
+
+func (f *SharedInformerFactory) Services() kframework.SharedIndexInformer {
+	return f.informer("services", func() kframework.SharedIndexInformer {
+		return kframework.NewSharedIndexInformer(
+			&kcache.ListWatch{
+				ListFunc: func(options kapi.ListOptions) (kruntime.Object, error) {
+					options.LabelSelector = f.selector
+					return f.client.Core().Services(f.namespace).List(options)
+				},
+				WatchFunc: func(options kapi.ListOptions) (kwatch.Interface, error) {
+					options.LabelSelector = f.selector
+					return f.client.Core().Services(f.namespace).Watch(options)
+				},
+			},
+			&kapi.Service{},
+			f.resync,
+			kcache.Indexers{},
+		)
+	})
+}
+
+func (f *SharedInformerFactory) Endpoints() kframework.SharedIndexInformer {
+	return f.informer("endpoints", func() kframework.SharedIndexInformer {
+		return kframework.NewSharedIndexInformer(
+			&kcache.ListWatch{
+				ListFunc: func(options kapi.ListOptions) (kruntime.Object, error) {
+					options.LabelSelector = f.selector
+					return f.client.Core().Endpoints(f.namespace).List(options)
+				},
+				WatchFunc: func(options kapi.ListOptions) (kwatch.Interface, error) {
+					options.LabelSelector = f.selector
+					return f.client.Core().Endpoints(f.namespace).Watch(options)
+				},
+			},
+			&kapi.Endpoints{},
+			f.resync,
+			kcache.Indexers{},
+		)
+	})
+}
+
+func (f *SharedInformerFactory) Ingresses() kframework.SharedIndexInformer {
+	return f.informer("ingresses", func() kframework.SharedIndexInformer {
+		return kframework.NewSharedIndexInformer(
+			&kcache.ListWatch{
+				ListFunc: func(options kapi.ListOptions) (kruntime.Object, error) {
+					options.LabelSelector = f.selector
+					return f.client.Extensions().Ingresses(f.namespace).List(options)
+				},
+				WatchFunc: func(options kapi.ListOptions) (kwatch.Interface, error) {
+					options.LabelSelector = f.selector
+					return f.client.Extensions().Ingresses(f.namespace).Watch(options)
+				},
+			},
+			&extensions.Ingress{},
+			f.resync,
+			kcache.Indexers{},
+		)
+	})
+}
+
+func (f *SharedInformerFactory) Pods() kframework.SharedIndexInformer {
+	return f.informer("pods", func() kframework.SharedIndexInformer {
+		return kframework.NewSharedIndexInformer(
+			&kcache.ListWatch{
+				ListFunc: func(options kapi.ListOptions) (kruntime.Object, error) {
+					return f.client.Core().Pods(f.namespace).List(options)
+				},
+				WatchFunc: func(options kapi.ListOptions) (kwatch.Interface, error) {
+					return f.client.Core().Pods(f.namespace).Watch(options)
+				},
+			},
+			&kapi.Pod{},
+			f.resync,
+			PodIndexers,
+		)
+	})
+}
+
+// SelectedPods returns an informer of the pods matching selector in
+// namespace, which is independent of the namespace of the factory
+func (f *SharedInformerFactory) SelectedPods(namespace string, selector klabels.Selector) kframework.SharedIndexInformer {
+	return f.informer("pods/"+namespace+"/"+selector.String(), func() kframework.SharedIndexInformer {
+		return kframework.NewSharedIndexInformer(
+			&kcache.ListWatch{
+				ListFunc: func(options kapi.ListOptions) (kruntime.Object, error) {
+					options.LabelSelector = selector
+					return f.client.Core().Pods(namespace).List(options)
+				},
+				WatchFunc: func(options kapi.ListOptions) (kwatch.Interface, error) {
+					options.LabelSelector = selector
+					return f.client.Core().Pods(namespace).Watch(options)
+				},
+			},
+			&kapi.Pod{},
+			f.resync,
+			kcache.Indexers{},
+		)
+	})
+}
+
+func (f *SharedInformerFactory) Nodes() kframework.SharedIndexInformer {
+	return f.informer("nodes", func() kframework.SharedIndexInformer {
+		return kframework.NewSharedIndexInformer(
+			&kcache.ListWatch{
+				ListFunc: func(options kapi.ListOptions) (kruntime.Object, error) {
+					return f.client.Core().Nodes().List(options)
+				},
+				WatchFunc: func(options kapi.ListOptions) (kwatch.Interface, error) {
+					return f.client.Core().Nodes().Watch(options)
+				},
+			},
+			&kapi.Node{},
+			f.resync,
+			kcache.Indexers{},
+		)
+	})
+}
+
+func (f *SharedInformerFactory) Namespaces() kframework.SharedIndexInformer {
+	return f.informer("namespaces", func() kframework.SharedIndexInformer {
+		return kframework.NewSharedIndexInformer(
+			&kcache.ListWatch{
+				ListFunc: func(options kapi.ListOptions) (kruntime.Object, error) {
+					return f.client.Core().Namespaces().List(options)
+				},
+				WatchFunc: func(options kapi.ListOptions) (kwatch.Interface, error) {
+					return f.client.Core().Namespaces().Watch(options)
+				},
+			},
+			&kapi.Namespace{},
+			f.resync,
+			kcache.Indexers{},
+		)
+	})
+}
+
+func (f *SharedInformerFactory) NodeLister() interfaces.NodeLister {
+	return NewNodeLister(f.Nodes().GetIndexer())
+}
+
+func (f *SharedInformerFactory) PodLister() interfaces.PodLister {
+	return NewPodLister(f.Pods().GetIndexer())
+}
+
+// Start runs all informers created so far, which have not been started yet
+func (f *SharedInformerFactory) Start(stopCh <-chan struct{}) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	for name, informer := range f.informers {
+		if !f.started[name] {
+			go informer.Run(stopCh)
+			f.started[name] = true
+		}
+	}
+}
+
+// WaitForCacheSync blocks until all started informers completed their
+// initial list, it returns false if stopCh is closed before
+func (f *SharedInformerFactory) WaitForCacheSync(stopCh <-chan struct{}) bool {
+	f.lock.Lock()
+	var informers []kframework.SharedIndexInformer
+	for name, informer := range f.informers {
+		if f.started[name] {
+			informers = append(informers, informer)
+		}
+	}
+	f.lock.Unlock()
+
+	for _, informer := range informers {
+		for !informer.HasSynced() {
+			select {
+			case <-stopCh:
+				return false
+			case <-time.After(syncPollInterval):
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,90 @@
+package informers
+
+import (
+	"fmt"
+
+	kapi "k8s.io/kubernetes/pkg/api"
+	kcache "k8s.io/kubernetes/pkg/client/cache"
+
+	"github.com/jetstack-experimental/kube2consul/pkg/interfaces"
+)
+
+// PodIPIndex indexes pods by their IP
+const PodIPIndex = "podIP"
+
+// PodIndexers are the indexers a pod lister requires
+var PodIndexers = kcache.Indexers{
+	PodIPIndex: func(obj interface{}) ([]string, error) {
+		pod, ok := obj.(*kapi.Pod)
+		if !ok || pod.Status.PodIP == "" {
+			return []string{}, nil
+		}
+		return []string{pod.Status.PodIP}, nil
+	},
+}
+
+type nodeLister struct {
+	indexer kcache.Indexer
+}
+
+// NewNodeLister returns a lister of the nodes in indexer
+func NewNodeLister(indexer kcache.Indexer) interfaces.NodeLister {
+	return &nodeLister{indexer: indexer}
+}
+
+func (l *nodeLister) Get(name string) (*kapi.Node, error) {
+	obj, exists, err := l.indexer.GetByKey(name)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, fmt.Errorf("No node found with name %s", name)
+	}
+	return obj.(*kapi.Node), nil
+}
+
+func (l *nodeLister) List() ([]*kapi.Node, error) {
+	var nodes []*kapi.Node
+	for _, obj := range l.indexer.List() {
+		nodes = append(nodes, obj.(*kapi.Node))
+	}
+	return nodes, nil
+}
+
+type podLister struct {
+	indexer kcache.Indexer
+}
+
+// NewPodLister returns a lister of the pods in indexer, which needs to be
+// created with PodIndexers
+func NewPodLister(indexer kcache.Indexer) interfaces.PodLister {
+	return &podLister{indexer: indexer}
+}
+
+// GetByIP returns the pod having podIP. Terminated pods may still report an
+// IP which has been reused, so running pods are preferred.
+func (l *podLister) GetByIP(podIP string) (*kapi.Pod, error) {
+	objs, err := l.indexer.ByIndex(PodIPIndex, podIP)
+	if err != nil {
+		return nil, err
+	}
+	var found *kapi.Pod
+	for _, obj := range objs {
+		pod := obj.(*kapi.Pod)
+		if found == nil || pod.Status.Phase == kapi.PodRunning {
+			found = pod
+		}
+	}
+	if found == nil {
+		return nil, fmt.Errorf("No pod found with podIP %s", podIP)
+	}
+	return found, nil
+}
+
+func (l *podLister) List() ([]*kapi.Pod, error) {
+	var pods []*kapi.Pod
+	for _, obj := range l.indexer.List() {
+		pods = append(pods, obj.(*kapi.Pod))
+	}
+	return pods, nil
+}
@@ -1,14 +1,48 @@
 package interfaces
 
 import (
-	kubernetes "k8s.io/kubernetes/pkg/client/clientset_generated/release_1_3"
+	kapi "k8s.io/kubernetes/pkg/api"
+	kubernetes "k8s.io/kubernetes/pkg/client/clientset_generated/internalclientset"
+	krecord "k8s.io/kubernetes/pkg/client/record"
 	kclient "k8s.io/kubernetes/pkg/client/unversioned"
 )
 
 type Kube2Consul interface {
-	KubernetesClientset() *kubernetes.Clientset
-	KubernetesClient() *kclient.Client
+	KubernetesClientset() kubernetes.Interface
+	KubernetesClient() kclient.Interface
+	NodeLister() NodeLister
+	PodLister() PodLister
+	NodeByName(string) (*kapi.Node, error)
 	NodeIPByPodIP(string) (string, error)
 	NodeNameByPodIP(string) (string, error)
-	UpdateConsul(namespace string, name string, endpoints []Endpoint) error
+	ServiceOptions() *ServiceOptions
+	EventRecorder() krecord.EventRecorder
+	UpdateConsul(namespace string, name string, endpoints []Endpoint, metadata *ServiceMetadata) error
+}
+
+// NodeLister looks up nodes, usually from a local cache
+type NodeLister interface {
+	Get(name string) (*kapi.Node, error)
+	List() ([]*kapi.Node, error)
+}
+
+// PodLister looks up pods, usually from a local cache
+type PodLister interface {
+	GetByIP(podIP string) (*kapi.Pod, error)
+	List() ([]*kapi.Pod, error)
+}
+
+// Registry is a service discovery backend kubernetes services are registered
+// in. It stores endpoints as they are, the caller decides what to change.
+type Registry interface {
+	// Register creates or replaces the registration of an endpoint,
+	// including its maintenance state
+	Register(endpoint Endpoint) error
+	// Deregister removes the registration of an endpoint
+	Deregister(endpoint Endpoint) error
+	// ListOwned returns all registrations in a location having a tag
+	// matching owned
+	ListOwned(location Location, owned func(tag string) bool) ([]Endpoint, error)
+	// UpdateHealth applies the maintenance state of a registered endpoint
+	UpdateHealth(endpoint Endpoint) error
 }
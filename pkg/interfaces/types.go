@@ -1,8 +1,113 @@
 package interfaces
 
+import (
+	"strings"
+)
+
 type Endpoint struct {
-	DnsLabel    string
-	NodeAddress string
-	NodeName    string
-	NodePort    int32
+	ID       string
+	DnsLabel string
+	// OriginalName is the generated name DnsLabel was sanitized from, if it
+	// wasn't a valid consul service name
+	OriginalName string
+	NodeAddress  string
+	NodeName     string
+	NodePort     int32
+	// Address of the service instance, if it differs from the node address
+	Address string
+	Tags    []string
+	Meta    map[string]string
+	// Maintenance is the reason the instance is in maintenance, if it is
+	Maintenance string
+	// Location is where the instance is registered in consul
+	Location Location
+}
+
+// Location selects a consul datacenter, namespace and admin partition. Empty
+// fields select the defaults of the consul agent.
+type Location struct {
+	Datacenter string
+	Namespace  string
+	Partition  string
+}
+
+func (l Location) String() string {
+	var parts []string
+	if l.Datacenter != "" {
+		parts = append(parts, "dc="+l.Datacenter)
+	}
+	if l.Namespace != "" {
+		parts = append(parts, "ns="+l.Namespace)
+	}
+	if l.Partition != "" {
+		parts = append(parts, "partition="+l.Partition)
+	}
+	if len(parts) == 0 {
+		return "default"
+	}
+	return strings.Join(parts, ",")
+}
+
+// ServiceID returns the consul service ID of the endpoint, which defaults to
+// the service name
+func (e Endpoint) ServiceID() string {
+	if e.ID != "" {
+		return e.ID
+	}
+	return e.DnsLabel
+}
+
+const (
+	TagFormatKeyValue = "key-value"
+	TagFormatValue    = "value"
+)
+
+const (
+	NodeMaintenanceOff      = "off"
+	NodeMaintenanceCheck    = "check"
+	NodeMaintenanceWithdraw = "withdraw"
+)
+
+// ServiceOptions configures how kubernetes services are exported. Label and
+// annotation keys are matched exactly or, if ending with '*', by prefix.
+type ServiceOptions struct {
+	LabelTags      []string
+	AnnotationTags []string
+	LabelMeta      []string
+	AnnotationMeta []string
+	TagFormat      string
+	// NodeMaintenance selects how nodes in maintenance are handled
+	NodeMaintenance string
+	// MaintenanceReason is used for services in maintenance without a reason
+	MaintenanceReason string
+}
+
+// ServiceMetadata describes a kubernetes service for consumers outside of
+// kubernetes
+type ServiceMetadata struct {
+	Namespace      string            `json:"namespace"`
+	Name           string            `json:"name"`
+	UID            string            `json:"uid"`
+	Type           string            `json:"type"`
+	ClusterIP      string            `json:"clusterIP,omitempty"`
+	Labels         map[string]string `json:"labels,omitempty"`
+	Annotations    map[string]string `json:"annotations,omitempty"`
+	Ports          []PortMetadata    `json:"ports,omitempty"`
+	Owners         []OwnerMetadata   `json:"owners,omitempty"`
+	ConsulServices []string          `json:"consulServices,omitempty"`
+}
+
+type PortMetadata struct {
+	Name       string `json:"name,omitempty"`
+	Protocol   string `json:"protocol"`
+	Port       int32  `json:"port"`
+	TargetPort string `json:"targetPort,omitempty"`
+	NodePort   int32  `json:"nodePort,omitempty"`
+}
+
+type OwnerMetadata struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Name       string `json:"name"`
+	UID        string `json:"uid"`
 }
@@ -0,0 +1,196 @@
+package kube2consul
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	consulapi "github.com/hashicorp/consul/api"
+
+	"github.com/jetstack-experimental/kube2consul/pkg/interfaces"
+	"github.com/jetstack-experimental/kube2consul/pkg/registry/consul"
+	"github.com/jetstack-experimental/kube2consul/pkg/service"
+)
+
+const (
+	// ManagedNodeMeta is the node meta data key marking catalog nodes
+	// created by kube2consul. Its value is the cluster name, or "true" if
+	// none is configured.
+	ManagedNodeMeta = "kube2consul-managed"
+
+	// SerfHealthCheckID is the ID of the check of nodes run by a consul agent
+	SerfHealthCheckID = consul.SerfHealthCheckID
+)
+
+// managedNodeMeta returns the node meta data marking catalog nodes created
+// by this kube2consul
+func (k *Kube2Consul) managedNodeMeta() map[string]string {
+	value := k.clusterName
+	if value == "" {
+		value = "true"
+	}
+	return map[string]string{ManagedNodeMeta: value}
+}
+
+// nodeLocations returns a location per consul datacenter and partition
+// services are registered in. Nodes are shared by all consul namespaces, so
+// if services are routed to any, nodes are looked up in all of them.
+func (t *consulTarget) nodeLocations() []interfaces.Location {
+	namespaces := false
+	seen := make(map[interfaces.Location]bool)
+	var locations []interfaces.Location
+	for _, location := range t.consulLocations() {
+		if location.Namespace != "" {
+			namespaces = true
+		}
+		location.Namespace = ""
+		if !seen[location] {
+			seen[location] = true
+			locations = append(locations, location)
+		}
+	}
+	if namespaces {
+		for i := range locations {
+			locations[i].Namespace = "*"
+		}
+	}
+	return locations
+}
+
+// watchForEmptyNodes periodically deregisters the catalog nodes created by
+// kube2consul, which are empty and whose kubernetes node is gone
+func (t *consulTarget) watchForEmptyNodes() {
+	select {
+	case <-t.stopCh:
+		return
+	case <-t.cacheSynced:
+	}
+
+	ticker := time.NewTicker(t.nodeCleanupInterval)
+	defer ticker.Stop()
+	for {
+		if err := t.deregisterEmptyNodes(); err != nil {
+			log.WithField("target", t.name).Warnf("Error deregistering empty nodes: %s", err)
+		}
+		select {
+		case <-t.stopCh:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// deregisterEmptyNodes deregisters the catalog nodes created by kube2consul,
+// which are empty and whose kubernetes node is gone
+func (t *consulTarget) deregisterEmptyNodes() error {
+	var errs []string
+	for _, location := range t.nodeLocations() {
+		options := consul.QueryOptions(location)
+		options.NodeMeta = t.managedNodeMeta()
+		nodes, _, err := t.ConsulCatalog().Nodes(options)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("error listing nodes in %s: %s", location, err))
+			continue
+		}
+		for _, node := range nodes {
+			_, exists, err := t.Informers().Nodes().GetIndexer().GetByKey(node.Node)
+			if err != nil || exists {
+				continue
+			}
+			if err := t.deregisterEmptyNode(location, node.Node); err != nil {
+				errs = append(errs, err.Error())
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// deregisterEmptyNode removes a node from the catalog if it has been created
+// by kube2consul and no services are left on it
+func (t *consulTarget) deregisterEmptyNode(location interfaces.Location, nodeName string) error {
+	return t.deregisterManagedNode(location, nodeName, false)
+}
+
+// deregisterManagedNode removes a node from the catalog if it has been
+// created by kube2consul, along with the services left on it if withServices
+// is set. Nodes run by a consul agent are never removed.
+func (t *consulTarget) deregisterManagedNode(location interfaces.Location, nodeName string, withServices bool) error {
+	node, _, err := t.ConsulCatalog().Node(nodeName, consul.QueryOptions(location))
+	if err != nil {
+		return fmt.Errorf("error getting node %s: %s", nodeName, err)
+	}
+	if node == nil || node.Node == nil {
+		return nil
+	}
+	if !withServices {
+		services, err := t.nodeServiceCount(location, node)
+		if err != nil {
+			return err
+		}
+		if services > 0 {
+			return nil
+		}
+	}
+	for key, value := range t.managedNodeMeta() {
+		if node.Node.Meta[key] != value {
+			nodeLog(nodeName, "deregister_node").Debug("Keeping empty node not created by kube2consul")
+			return nil
+		}
+	}
+
+	// an agent may have joined since the node has been looked at last
+	t.agents.Forget(location, nodeName)
+	agent, err := t.agents.IsAgent(location, nodeName)
+	if err != nil {
+		return err
+	}
+	if agent {
+		nodeLog(nodeName, "deregister_node").Debug("Keeping empty node run by a consul agent")
+		return nil
+	}
+
+	location.Namespace = ""
+	return t.deregisterNode(location, nodeName)
+}
+
+// nodeServiceCount returns the number of services registered on a node. Dry
+// runs leave the catalog untouched, so the registrations of kube2consul are
+// counted in the dry run registry instead, as a real run would find them.
+func (t *consulTarget) nodeServiceCount(location interfaces.Location, node *consulapi.CatalogNode) (int, error) {
+	registry, ok := t.Registry().(*dryRunRegistry)
+	if !ok {
+		return len(node.Services), nil
+	}
+
+	count := 0
+	for _, svc := range node.Services {
+		if !ownedService(svc.Tags) {
+			count++
+		}
+	}
+	var locations []interfaces.Location
+	for _, l := range t.consulLocations() {
+		if l.Datacenter == location.Datacenter && l.Partition == location.Partition {
+			locations = append(locations, l)
+		}
+	}
+	endpoints, err := registry.nodeEndpoints(locations, node.Node.Node)
+	if err != nil {
+		return 0, fmt.Errorf("error getting registrations on node %s: %s", node.Node.Node, err)
+	}
+	return count + len(endpoints), nil
+}
+
+// ownedService returns whether a service has been registered by kube2consul
+func ownedService(tags []string) bool {
+	for _, tag := range tags {
+		if _, _, ok := service.ParseOwnerTag(tag); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,102 @@
+package kube2consul
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+// EnvPrefix is the prefix of environment variables overriding flag defaults,
+// e.g. KUBE2CONSUL_CONSUL_ADDRESS for --consul-address
+const EnvPrefix = "KUBE2CONSUL"
+
+// deprecatedFlags maps deprecated flags to the flag they set
+var deprecatedFlags = map[string]string{
+	"consoul-address": "consul-address",
+}
+
+// loadConfig fills all flags not given on the command line from environment
+// variables and then from the config file, so flags take precedence over the
+// environment and the environment over the file.
+func (k *Kube2Consul) loadConfig(cmd *cobra.Command) error {
+	v := viper.New()
+	v.SetEnvPrefix(EnvPrefix)
+	v.SetEnvKeyReplacer(strings.NewReplacer("-", "_"))
+	v.AutomaticEnv()
+
+	// the config flag itself can only be set on the command line or in the
+	// environment
+	if !cmd.Flags().Changed("config") && v.IsSet("config") {
+		k.configFile = v.GetString("config")
+	}
+	if k.configFile != "" {
+		v.SetConfigFile(k.configFile)
+		if err := v.ReadInConfig(); err != nil {
+			return fmt.Errorf("error reading config file %s: %s", k.configFile, err)
+		}
+	}
+
+	// flags set through a deprecated alias count as given on the command line
+	for alias, name := range deprecatedFlags {
+		if f := cmd.Flags().Lookup(name); f != nil && cmd.Flags().Changed(alias) {
+			f.Changed = true
+		}
+	}
+
+	var errs []string
+	cmd.Flags().VisitAll(func(f *pflag.Flag) {
+		if f.Changed || f.Deprecated != "" || f.Name == "config" || !v.IsSet(f.Name) {
+			return
+		}
+		// array flags take one value per element, which may contain commas
+		if list, ok := v.Get(f.Name).([]interface{}); ok && f.Value.Type() == "stringArray" {
+			for _, elem := range list {
+				if err := f.Value.Set(configValue(elem)); err != nil {
+					errs = append(errs, fmt.Sprintf("%s: %s", f.Name, err))
+				}
+			}
+			return
+		}
+		if err := f.Value.Set(configValue(v.Get(f.Name))); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %s", f.Name, err))
+		}
+	})
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid configuration: %s", strings.Join(errs, ", "))
+	}
+	return nil
+}
+
+// configValue converts a value read from the environment or the config file
+// into its flag representation. Maps are converted into key=value pairs,
+// e.g. for consul targets.
+func configValue(value interface{}) string {
+	switch m := value.(type) {
+	case map[string]interface{}:
+		pairs := make([]string, 0, len(m))
+		for key, elem := range m {
+			pairs = append(pairs, fmt.Sprintf("%s=%v", key, elem))
+		}
+		sort.Strings(pairs)
+		return strings.Join(pairs, ",")
+	case map[interface{}]interface{}:
+		pairs := make([]string, 0, len(m))
+		for key, elem := range m {
+			pairs = append(pairs, fmt.Sprintf("%v=%v", key, elem))
+		}
+		sort.Strings(pairs)
+		return strings.Join(pairs, ",")
+	}
+	if list, ok := value.([]interface{}); ok {
+		elems := make([]string, len(list))
+		for i, elem := range list {
+			elems[i] = fmt.Sprintf("%v", elem)
+		}
+		return strings.Join(elems, ",")
+	}
+	return fmt.Sprintf("%v", value)
+}
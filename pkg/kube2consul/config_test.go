@@ -0,0 +1,82 @@
+package kube2consul
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestLoadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kube2consul")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// the type of the file is told by its extension
+	config := filepath.Join(dir, "config.yaml")
+	err = ioutil.WriteFile(config, []byte(`
+consul-address: file:8500
+consul-datacenter: file
+cluster-name: file
+resync-period: 10m
+consul-target:
+- name: eu
+  address: consul.eu:8500
+- address: consul.us:8500
+`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	os.Setenv("KUBE2CONSUL_CONSUL_DATACENTER", "env")
+	os.Setenv("KUBE2CONSUL_CONFIG", config)
+	defer os.Unsetenv("KUBE2CONSUL_CONSUL_DATACENTER")
+	defer os.Unsetenv("KUBE2CONSUL_CONFIG")
+
+	k := New()
+	// options of the root command apply to subcommands as well
+	k.RootCmd.SetArgs([]string{"version", "--consul-address", "flag:8500"})
+	if err := k.RootCmd.Execute(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name string
+		exp  interface{}
+		act  interface{}
+	}{
+		{name: "flag over environment and file", exp: "flag:8500", act: k.consulAddress},
+		{name: "environment over file", exp: "env", act: k.consulDatacenter},
+		{name: "file", exp: "file", act: k.clusterName},
+		{name: "file duration", exp: 10 * time.Minute, act: k.resyncPeriod},
+		{name: "file list of maps", exp: []string{"address=consul.eu:8500,name=eu", "address=consul.us:8500"}, act: k.targetSpecs},
+		{name: "default", exp: ":9500", act: k.metricsAddress},
+	} {
+		if !reflect.DeepEqual(test.exp, test.act) {
+			t.Errorf("%s: value %v is not the expected %v", test.name, test.act, test.exp)
+		}
+	}
+
+	// flags set through a deprecated alias take precedence as well
+	k = New()
+	k.RootCmd.SetArgs([]string{"version", "--consoul-address", "alias:8500"})
+	if err := k.RootCmd.Execute(); err != nil {
+		t.Fatal(err)
+	}
+	if exp, act := "alias:8500", k.consulAddress; exp != act {
+		t.Errorf("deprecated flag: value %v is not the expected %v", act, exp)
+	}
+
+	// a missing config file fails
+	os.Setenv("KUBE2CONSUL_CONFIG", filepath.Join(dir, "missing.yaml"))
+	k = New()
+	k.RootCmd.SetArgs([]string{"version"})
+	k.RootCmd.SilenceErrors = true
+	k.RootCmd.SilenceUsage = true
+	if err := k.RootCmd.Execute(); err == nil {
+		t.Error("Expected error of a missing config file")
+	}
+}
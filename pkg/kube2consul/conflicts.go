@@ -0,0 +1,335 @@
+package kube2consul
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	consulapi "github.com/hashicorp/consul/api"
+	kapi "k8s.io/kubernetes/pkg/api"
+
+	"github.com/jetstack-experimental/kube2consul/pkg/interfaces"
+	"github.com/jetstack-experimental/kube2consul/pkg/metrics"
+	"github.com/jetstack-experimental/kube2consul/pkg/service"
+)
+
+// Policies for consul service names requested by several kubernetes
+// services or ingresses in the same consul location
+const (
+	// ConflictPolicyOldest registers the name only for the oldest owner
+	ConflictPolicyOldest = "oldest"
+	// ConflictPolicyRefuse registers the name for none of the owners
+	ConflictPolicyRefuse = "refuse"
+	// ConflictPolicyMerge registers the instances of all owners under the
+	// name
+	ConflictPolicyMerge = "merge"
+
+	// NameConflictReason is the reason of events about consul service name
+	// conflicts
+	NameConflictReason = "ConsulServiceNameConflict"
+)
+
+// nameOwner holds the registrations requested for an owner tag
+type nameOwner struct {
+	tag       string
+	created   time.Time
+	endpoints []interfaces.Endpoint
+	kvOps     consulapi.TxnOps
+}
+
+// nameConflict is a consul service name in a location requested by several
+// owners
+type nameConflict struct {
+	location interfaces.Location
+	name     string
+	// owner tags, oldest first
+	owners []string
+}
+
+// nameClaims tracks which owners request which consul service names and
+// resolves conflicts between them
+type nameClaims struct {
+	owners map[string]*nameOwner
+	// owner tags by claimKey
+	claims map[string]map[string]bool
+}
+
+func newNameClaims() *nameClaims {
+	return &nameClaims{
+		owners: make(map[string]*nameOwner),
+		claims: make(map[string]map[string]bool),
+	}
+}
+
+// claimKey identifies a consul service name in a location. Consul DNS
+// ignores case, so names only differing in case conflict as well.
+func claimKey(endpoint interfaces.Endpoint) string {
+	return fmt.Sprintf("%s/%s", endpoint.Location, strings.ToLower(endpoint.DnsLabel))
+}
+
+// set replaces the registrations requested by an owner
+func (c *nameClaims) set(owner *nameOwner) {
+	if old, ok := c.owners[owner.tag]; ok {
+		for _, endpoint := range old.endpoints {
+			key := claimKey(endpoint)
+			delete(c.claims[key], owner.tag)
+			if len(c.claims[key]) == 0 {
+				delete(c.claims, key)
+			}
+		}
+		delete(c.owners, owner.tag)
+	}
+	if len(owner.endpoints) == 0 {
+		return
+	}
+
+	c.owners[owner.tag] = owner
+	for _, endpoint := range owner.endpoints {
+		key := claimKey(endpoint)
+		if c.claims[key] == nil {
+			c.claims[key] = make(map[string]bool)
+		}
+		c.claims[key][owner.tag] = true
+	}
+}
+
+// sharing returns the owner tags requesting any of the names of endpoints
+func (c *nameClaims) sharing(endpoints []interfaces.Endpoint) map[string]bool {
+	tags := make(map[string]bool)
+	for _, endpoint := range endpoints {
+		for tag := range c.claims[claimKey(endpoint)] {
+			tags[tag] = true
+		}
+	}
+	return tags
+}
+
+// conflict returns the conflict a registration is part of, if any
+func (c *nameClaims) conflict(endpoint interfaces.Endpoint) *nameConflict {
+	claimants := c.claims[claimKey(endpoint)]
+	if len(claimants) < 2 {
+		return nil
+	}
+	owners := make([]string, 0, len(claimants))
+	for tag := range claimants {
+		owners = append(owners, tag)
+	}
+	sort.Sort(byAge{owners, c.owners})
+	return &nameConflict{
+		location: endpoint.Location,
+		name:     endpoint.DnsLabel,
+		owners:   owners,
+	}
+}
+
+// conflicts returns the conflicts of an owner
+func (c *nameClaims) conflicts(tag string) []nameConflict {
+	owner, ok := c.owners[tag]
+	if !ok {
+		return nil
+	}
+	var conflicts []nameConflict
+	seen := make(map[string]bool)
+	for _, endpoint := range owner.endpoints {
+		key := claimKey(endpoint)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		if conflict := c.conflict(endpoint); conflict != nil {
+			conflicts = append(conflicts, *conflict)
+		}
+	}
+	return conflicts
+}
+
+// resolve returns the registrations of an owner after applying policy to
+// its conflicts. Merged registrations get a service ID unique to their owner,
+// so instances on the same node don't replace each other.
+func (c *nameClaims) resolve(tag string, policy string) []interfaces.Endpoint {
+	owner, ok := c.owners[tag]
+	if !ok {
+		return nil
+	}
+	var endpoints []interfaces.Endpoint
+	for _, endpoint := range owner.endpoints {
+		conflict := c.conflict(endpoint)
+		if conflict == nil {
+			endpoints = append(endpoints, endpoint)
+			continue
+		}
+		switch policy {
+		case ConflictPolicyOldest:
+			if conflict.owners[0] == tag {
+				endpoints = append(endpoints, endpoint)
+			}
+		case ConflictPolicyMerge:
+			if endpoint.ID == "" {
+				namespace, name, _ := service.ParseOwnerTag(tag)
+				endpoint.ID = fmt.Sprintf("%s-%s.%s", endpoint.DnsLabel, strings.Replace(name, "/", "-", -1), namespace)
+			}
+			endpoints = append(endpoints, endpoint)
+		}
+	}
+	return endpoints
+}
+
+// resolveAll returns the registrations of all owners after applying policy
+// to their conflicts, which are logged
+func (c *nameClaims) resolveAll(policy string) []interfaces.Endpoint {
+	tags := make([]string, 0, len(c.owners))
+	for tag := range c.owners {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+
+	var endpoints []interfaces.Endpoint
+	for _, tag := range tags {
+		namespace, name, _ := service.ParseOwnerTag(tag)
+		for _, conflict := range c.conflicts(tag) {
+			serviceLog(namespace, name, "sync").Warnf("Consul service name conflict: %s", conflict.describe(policy, tag))
+		}
+		endpoints = append(endpoints, c.resolve(tag, policy)...)
+	}
+	return endpoints
+}
+
+// describe returns the conflict and what the policy does to the
+// registrations of owner
+func (c *nameConflict) describe(policy string, owner string) string {
+	return fmt.Sprintf("%s, %s by policy %s", c, c.outcome(policy, owner), policy)
+}
+
+// outcome describes what the policy does to the registrations of owner
+func (c *nameConflict) outcome(policy string, owner string) string {
+	switch {
+	case policy == ConflictPolicyMerge:
+		return "merged"
+	case policy == ConflictPolicyOldest && c.owners[0] == owner:
+		return "registered"
+	}
+	return "not registered"
+}
+
+func (c *nameConflict) String() string {
+	owners := make([]string, len(c.owners))
+	for i, tag := range c.owners {
+		owners[i] = ownerName(tag)
+	}
+	name := c.name
+	if c.location != (interfaces.Location{}) {
+		name = fmt.Sprintf("%s (%s)", name, c.location)
+	}
+	return fmt.Sprintf("consul service name %s is requested by %s", name, strings.Join(owners, ", "))
+}
+
+// claimNames replaces the registrations requested by an owner and returns
+// the registrations to apply, after resolving conflicts, for it and for every
+// other owner whose registrations changed because of it. The caller holds
+// claimsLock until it pushed the writes, so writes resolved later are never
+// applied before them.
+func (k *Kube2Consul) claimNames(owner *nameOwner) []*nameOwner {
+	affected := k.claims.sharing(owner.endpoints)
+	if old, ok := k.claims.owners[owner.tag]; ok {
+		for tag := range k.claims.sharing(old.endpoints) {
+			affected[tag] = true
+		}
+	}
+	delete(affected, owner.tag)
+	before := make(map[string][]interfaces.Endpoint, len(affected))
+	for tag := range affected {
+		before[tag] = k.claims.resolve(tag, k.conflictPolicy)
+	}
+
+	k.claims.set(owner)
+
+	updates := []*nameOwner{{tag: owner.tag, endpoints: k.claims.resolve(owner.tag, k.conflictPolicy), kvOps: owner.kvOps}}
+	tags := make([]string, 0, len(affected))
+	for tag := range affected {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+	for _, tag := range tags {
+		endpoints := k.claims.resolve(tag, k.conflictPolicy)
+		if reflect.DeepEqual(before[tag], endpoints) {
+			continue
+		}
+		updates = append(updates, &nameOwner{tag: tag, endpoints: endpoints, kvOps: k.claims.owners[tag].kvOps})
+	}
+
+	k.reportConflicts(append(tags, owner.tag))
+	return updates
+}
+
+// reportConflicts logs and records an event for owners whose conflicts
+// changed since they were last reported
+func (k *Kube2Consul) reportConflicts(tags []string) {
+	for _, tag := range tags {
+		var messages []string
+		for _, conflict := range k.claims.conflicts(tag) {
+			messages = append(messages, conflict.describe(k.conflictPolicy, tag))
+		}
+		message := strings.Join(messages, "; ")
+		if k.reportedConflicts[tag] == message {
+			continue
+		}
+
+		namespace, name, _ := service.ParseOwnerTag(tag)
+		if message == "" {
+			delete(k.reportedConflicts, tag)
+			serviceLog(namespace, name, "update").Info("Consul service name conflicts resolved")
+			continue
+		}
+		k.reportedConflicts[tag] = message
+		serviceLog(namespace, name, "update").Warnf("Consul service name conflict: %s", message)
+		k.EventRecorder().Eventf(ownerReference(tag), kapi.EventTypeWarning, NameConflictReason, "Consul service name conflict: %s", message)
+	}
+	metrics.ConsulNameConflicts.Set(float64(len(k.reportedConflicts)))
+}
+
+// ownerName describes the kubernetes object of an owner tag
+func ownerName(tag string) string {
+	namespace, name, _ := service.ParseOwnerTag(tag)
+	if service.IsIngressOwnerTag(tag) {
+		return fmt.Sprintf("ingress %s/%s", namespace, strings.TrimPrefix(name, "ingress/"))
+	}
+	return fmt.Sprintf("service %s/%s", namespace, name)
+}
+
+// ownerReference returns a reference to the kubernetes object of an owner
+// tag, to record events about it
+func ownerReference(tag string) *kapi.ObjectReference {
+	namespace, name, _ := service.ParseOwnerTag(tag)
+	if service.IsIngressOwnerTag(tag) {
+		return &kapi.ObjectReference{
+			Kind:       "Ingress",
+			APIVersion: "extensions/v1beta1",
+			Namespace:  namespace,
+			Name:       strings.TrimPrefix(name, "ingress/"),
+		}
+	}
+	return &kapi.ObjectReference{
+		Kind:       "Service",
+		APIVersion: "v1",
+		Namespace:  namespace,
+		Name:       name,
+	}
+}
+
+// byAge sorts owner tags by the creation of their owners, then by tag
+type byAge struct {
+	tags   []string
+	owners map[string]*nameOwner
+}
+
+func (a byAge) Len() int      { return len(a.tags) }
+func (a byAge) Swap(i, j int) { a.tags[i], a.tags[j] = a.tags[j], a.tags[i] }
+func (a byAge) Less(i, j int) bool {
+	ci, cj := a.owners[a.tags[i]].created, a.owners[a.tags[j]].created
+	if !ci.Equal(cj) {
+		return ci.Before(cj)
+	}
+	return a.tags[i] < a.tags[j]
+}
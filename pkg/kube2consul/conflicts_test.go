@@ -0,0 +1,159 @@
+package kube2consul
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	krecord "k8s.io/kubernetes/pkg/client/record"
+
+	"github.com/jetstack-experimental/kube2consul/pkg/interfaces"
+	"github.com/jetstack-experimental/kube2consul/pkg/service"
+)
+
+var (
+	created = time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	// a-b/c and a/b-c both become a-b-c
+	olderOwner = service.OwnerTag("a-b", "c")
+	newerOwner = service.OwnerTag("a", "b-c")
+	// requests a-b-c in another location
+	routedOwner  = service.OwnerTag("team", "x")
+	teamLocation = interfaces.Location{Namespace: "team"}
+)
+
+func testClaims() *nameClaims {
+	claims := newNameClaims()
+	claims.set(&nameOwner{
+		tag:       newerOwner,
+		created:   created,
+		endpoints: []interfaces.Endpoint{{DnsLabel: "a-b-c", NodeName: "node-1"}},
+	})
+	// names differing in case conflict as well
+	claims.set(&nameOwner{
+		tag:       olderOwner,
+		created:   created.Add(-time.Hour),
+		endpoints: []interfaces.Endpoint{{DnsLabel: "A-B-C", NodeName: "node-2"}},
+	})
+	claims.set(&nameOwner{
+		tag:       routedOwner,
+		created:   created.Add(time.Hour),
+		endpoints: []interfaces.Endpoint{{DnsLabel: "a-b-c", NodeName: "node-1", Location: teamLocation}},
+	})
+	return claims
+}
+
+// resolved returns the name and ID of endpoints
+func resolved(endpoints []interfaces.Endpoint) []string {
+	var ids []string
+	for _, endpoint := range endpoints {
+		ids = append(ids, fmt.Sprintf("%s/%s", endpoint.DnsLabel, endpoint.ID))
+	}
+	return ids
+}
+
+func TestNameClaimsConflict(t *testing.T) {
+	claims := testClaims()
+
+	conflict := claims.conflict(interfaces.Endpoint{DnsLabel: "a-b-c"})
+	if conflict == nil {
+		t.Fatal("Expected a conflict")
+	}
+	if exp, act := []string{olderOwner, newerOwner}, conflict.owners; !reflect.DeepEqual(exp, act) {
+		t.Errorf("Owners %v are not the expected %v", act, exp)
+	}
+	if conflict := claims.conflict(interfaces.Endpoint{DnsLabel: "a-b-c", Location: teamLocation}); conflict != nil {
+		t.Errorf("Unexpected conflict in another location: %s", conflict)
+	}
+	if exp, act := 1, len(claims.conflicts(newerOwner)); exp != act {
+		t.Errorf("Found %d conflicts of %s, expected %d", act, newerOwner, exp)
+	}
+
+	// owners of the same age are sorted by tag
+	claims.set(&nameOwner{
+		tag:       olderOwner,
+		created:   created,
+		endpoints: []interfaces.Endpoint{{DnsLabel: "a-b-c", NodeName: "node-2"}},
+	})
+	if exp, act := []string{olderOwner, newerOwner}, claims.conflict(interfaces.Endpoint{DnsLabel: "a-b-c"}).owners; !reflect.DeepEqual(exp, act) {
+		t.Errorf("Owners %v are not the expected %v", act, exp)
+	}
+
+	// the conflict is gone with the registrations of an owner
+	claims.set(&nameOwner{tag: olderOwner})
+	if conflict := claims.conflict(interfaces.Endpoint{DnsLabel: "a-b-c"}); conflict != nil {
+		t.Errorf("Unexpected conflict after removing %s: %s", olderOwner, conflict)
+	}
+}
+
+func TestNameClaimsResolve(t *testing.T) {
+	for _, test := range []struct {
+		policy string
+		exp    map[string][]string
+	}{
+		{
+			policy: ConflictPolicyOldest,
+			exp: map[string][]string{
+				olderOwner:  {"A-B-C/"},
+				newerOwner:  nil,
+				routedOwner: {"a-b-c/"},
+			},
+		},
+		{
+			policy: ConflictPolicyRefuse,
+			exp: map[string][]string{
+				olderOwner:  nil,
+				newerOwner:  nil,
+				routedOwner: {"a-b-c/"},
+			},
+		},
+		{
+			policy: ConflictPolicyMerge,
+			exp: map[string][]string{
+				olderOwner:  {"A-B-C/A-B-C-c.a-b"},
+				newerOwner:  {"a-b-c/a-b-c-b-c.a"},
+				routedOwner: {"a-b-c/"},
+			},
+		},
+	} {
+		claims := testClaims()
+		for tag, exp := range test.exp {
+			if act := resolved(claims.resolve(tag, test.policy)); !reflect.DeepEqual(exp, act) {
+				t.Errorf("Policy %s: registrations %v of %s are not the expected %v", test.policy, act, tag, exp)
+			}
+		}
+	}
+}
+
+func TestClaimNames(t *testing.T) {
+	k := New()
+	k.eventRecorder = krecord.NewFakeRecorder(10)
+
+	claim := func(tag string, created time.Time) []*nameOwner {
+		return k.claimNames(&nameOwner{
+			tag:       tag,
+			created:   created,
+			endpoints: []interfaces.Endpoint{{DnsLabel: "a-b-c", NodeName: "node-1"}},
+		})
+	}
+	updates := func(owners []*nameOwner) map[string][]string {
+		updates := make(map[string][]string)
+		for _, owner := range owners {
+			updates[owner.tag] = resolved(owner.endpoints)
+		}
+		return updates
+	}
+
+	if exp, act := map[string][]string{newerOwner: {"a-b-c/"}}, updates(claim(newerOwner, created)); !reflect.DeepEqual(exp, act) {
+		t.Errorf("Updates %v are not the expected %v", act, exp)
+	}
+	// the registrations of the newer owner are withdrawn
+	exp := map[string][]string{olderOwner: {"a-b-c/"}, newerOwner: nil}
+	if act := updates(claim(olderOwner, created.Add(-time.Hour))); !reflect.DeepEqual(exp, act) {
+		t.Errorf("Updates %v are not the expected %v", act, exp)
+	}
+	// owners not affected are left alone
+	if exp, act := map[string][]string{olderOwner: {"a-b-c/"}}, updates(claim(olderOwner, created.Add(-time.Hour))); !reflect.DeepEqual(exp, act) {
+		t.Errorf("Updates %v are not the expected %v", act, exp)
+	}
+}
@@ -2,53 +2,381 @@ package kube2consul
 
 import (
 	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 	consulapi "github.com/hashicorp/consul/api"
+	kapi "k8s.io/kubernetes/pkg/api"
 
 	"github.com/jetstack-experimental/kube2consul/pkg/interfaces"
+	"github.com/jetstack-experimental/kube2consul/pkg/metrics"
+	"github.com/jetstack-experimental/kube2consul/pkg/registry/consul"
+	"github.com/jetstack-experimental/kube2consul/pkg/service"
 )
 
-func (k *Kube2Consul) ConsulClient() *consulapi.Client {
-	if k.consulClient == nil {
-		config := consulapi.DefaultConfig()
-		config.Address = k.consulAddress
-		client, err := consulapi.NewClient(config)
+// syncResult summarizes the changes made to the consul catalog
+type syncResult struct {
+	Registered   int
+	Deregistered int
+	Unchanged    int
+	Errors       []error
+}
+
+func (r *syncResult) String() string {
+	return fmt.Sprintf(
+		"registered: %d, deregistered: %d, unchanged: %d, errors: %d",
+		r.Registered,
+		r.Deregistered,
+		r.Unchanged,
+		len(r.Errors),
+	)
+}
+
+func (k *Kube2Consul) UpdateConsul(namespace string, name string, endpoints []interfaces.Endpoint, metadata *interfaces.ServiceMetadata) error {
+	var kvOps consulapi.TxnOps
+	if k.kvPrefix != "" {
+		kvOps = k.metadataOps(namespace, name, metadata)
+	}
+	if err := k.updateOwned(service.OwnerTag(namespace, name), k.serviceCreated(namespace, name), endpoints, kvOps); err != nil {
+		return fmt.Errorf("error updating %s/%s: %s", namespace, name, err)
+	}
+	return nil
+}
+
+// serviceCreated returns the creation time of a kubernetes service from the
+// informer cache
+func (k *Kube2Consul) serviceCreated(namespace string, name string) time.Time {
+	obj, exists, err := k.Informers().Services().GetIndexer().GetByKey(fmt.Sprintf("%s/%s", namespace, name))
+	if err != nil || !exists {
+		return time.Time{}
+	}
+	return obj.(*kapi.Service).CreationTimestamp.Time
+}
+
+// updateOwned replaces all registrations carrying the owner tag with
+// endpoints in all consul targets, after resolving consul service name
+// conflicts with other owners, which may update their registrations as well.
+// KV operations are applied in the same transactions.
+func (k *Kube2Consul) updateOwned(tag string, created time.Time, endpoints []interfaces.Endpoint, kvOps consulapi.TxnOps) error {
+	endpoints = withLocation(endpoints, k.ownerLocation(tag))
+
+	k.claimsLock.Lock()
+	defer k.claimsLock.Unlock()
+
+	var errs []string
+	for _, owner := range k.claimNames(&nameOwner{tag: tag, created: created, endpoints: endpoints, kvOps: kvOps}) {
+		if err := k.writeOwned(owner.tag, owner.endpoints, owner.kvOps); err != nil {
+			if owner.tag != tag {
+				err = fmt.Errorf("%s: %s", ownerName(owner.tag), err)
+			}
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// writeOwned replaces all registrations carrying the owner tag with
+// endpoints in all consul targets
+func (k *Kube2Consul) writeOwned(tag string, endpoints []interfaces.Endpoint, kvOps consulapi.TxnOps) error {
+	k.setDesired(tag, endpoints)
+	return k.write("owner/"+tag, func(t *consulTarget) error {
+		return t.updateOwned(tag, endpoints, kvOps)
+	})
+}
+
+// updateOwned replaces the registrations carrying the owner tag in the
+// target
+func (t *consulTarget) updateOwned(tag string, endpoints []interfaces.Endpoint, kvOps consulapi.TxnOps) error {
+	existing, err := t.ownedEndpoints(func(owner string) bool {
+		return owner == tag
+	})
+	if err != nil {
+		return fmt.Errorf("error getting registrations: %s", err)
+	}
+
+	// registrations and KV operations are only applied in the same
+	// transaction if consul is written to within a single datacenter and
+	// they fit into one
+	var result *syncResult
+	p := t.plan(endpoints, existing)
+	if registry, ok := t.Registry().(*consul.Registry); ok && len(kvOps) > 0 && p.local() {
+		ops, err := txnOps(registry, p, kvOps)
 		if err != nil {
-			panic(err.Error())
+			return err
+		}
+		if len(ops) <= maxTxnOps {
+			result = t.applyTxn(p, ops)
+		} else {
+			log.WithFields(log.Fields{"owner": tag, "target": t.name}).Warnf("Changes need %d operations, more than the %d of a consul transaction, writing registrations and metadata separately", len(ops), maxTxnOps)
+		}
+	}
+	if result == nil {
+		result = t.apply(p)
+		if len(kvOps) > 0 {
+			if err := t.txn(kvOps); err != nil {
+				result.Errors = append(result.Errors, err)
+			}
 		}
-		k.consulClient = client
 	}
-	return k.consulClient
+	if len(result.Errors) > 0 {
+		return fmt.Errorf("%v", result.Errors)
+	}
+	return nil
 }
 
-func (k *Kube2Consul) ConsulCatalog() *consulapi.Catalog {
-	if k.consulClient == nil {
-		k.consulCatalog = k.ConsulClient().Catalog()
+// ownedEndpoints returns all registrations in any of the consul locations
+// having at least one tag matching owned. If a cluster name is configured,
+// entries of other clusters are ignored.
+func (t *consulTarget) ownedEndpoints(owned func(tag string) bool) ([]interfaces.Endpoint, error) {
+	var endpoints []interfaces.Endpoint
+	for _, location := range t.consulLocations() {
+		list, err := t.locationOwnedEndpoints(location, owned)
+		if err != nil {
+			return nil, err
+		}
+		endpoints = append(endpoints, list...)
 	}
-	return k.consulCatalog
+	return endpoints, nil
 }
 
-func (k *Kube2Consul) UpdateConsul(namespace string, name string, endpoints []interfaces.Endpoint) error {
+// locationOwnedEndpoints returns the registrations in a single consul
+// location having at least one tag matching owned, like ownedEndpoints
+func (t *consulTarget) locationOwnedEndpoints(location interfaces.Location, owned func(tag string) bool) ([]interfaces.Endpoint, error) {
+	if t.clusterName != "" {
+		clusterTag := service.ClusterTag(t.clusterName)
+		match := owned
+		owned = func(tag string) bool {
+			return tag != clusterTag && match(tag)
+		}
+	}
 
-	tag := fmt.Sprintf("kube2consul-%s/%s", namespace, name)
-	// TODO Get existing services and remove them
+	endpoints, err := t.Registry().ListOwned(location, owned)
+	if err != nil {
+		if location != (interfaces.Location{}) {
+			err = fmt.Errorf("%s: %s", location, err)
+		}
+		return nil, err
+	}
 
+	var inCluster []interfaces.Endpoint
 	for _, endpoint := range endpoints {
-		service := &consulapi.AgentService{
-			Service: endpoint.DnsLabel,
-			Tags:    []string{tag},
-			Port:    int(endpoint.NodePort),
+		if t.inCluster(endpoint.Tags) {
+			inCluster = append(inCluster, endpoint)
+		}
+	}
+	return inCluster, nil
+}
+
+// syncPlan lists the changes needed to get from the existing to the desired
+// registrations
+type syncPlan struct {
+	register   []interfaces.Endpoint
+	deregister []interfaces.Endpoint
+	// endpoints which left maintenance and need their check removed
+	clearMaintenance []interfaces.Endpoint
+	unchanged        int
+}
+
+// local tells if all changes of the plan are made in the datacenter of the
+// agent, as transactions can't span datacenters
+func (p *syncPlan) local() bool {
+	for _, list := range [][]interfaces.Endpoint{p.register, p.deregister, p.clearMaintenance} {
+		for _, endpoint := range list {
+			if endpoint.Location.Datacenter != "" {
+				return false
+			}
 		}
-		reg := &consulapi.CatalogRegistration{
-			Node:    endpoint.NodeName,
-			Address: endpoint.NodeAddress,
-			Service: service,
+	}
+	return true
+}
+
+// plan registers all desired endpoints that are missing or differ from the
+// existing ones and deregisters existing endpoints that are not desired
+func (k *Kube2Consul) plan(desired []interfaces.Endpoint, existing []interfaces.Endpoint) *syncPlan {
+	p := &syncPlan{}
+
+	if k.clusterName != "" {
+		clusterTag := service.ClusterTag(k.clusterName)
+		tagged := make([]interfaces.Endpoint, len(desired))
+		for i, endpoint := range desired {
+			endpoint.Tags = append(append([]string{}, endpoint.Tags...), clusterTag)
+			tagged[i] = endpoint
 		}
-		_, err := k.ConsulCatalog().Register(reg, &consulapi.WriteOptions{})
-		if err != nil {
-			log.Warnf("Error registering %+v: %s", reg, err)
+		desired = tagged
+	}
+
+	current := make(map[string]interfaces.Endpoint)
+	for _, endpoint := range existing {
+		current[endpointKey(endpoint)] = endpoint
+	}
+
+	for _, endpoint := range desired {
+		key := endpointKey(endpoint)
+		old, ok := current[key]
+		delete(current, key)
+		if ok && endpointEqual(old, endpoint) {
+			p.unchanged++
+			continue
+		}
+		p.register = append(p.register, endpoint)
+		if ok && old.Maintenance != "" && endpoint.Maintenance == "" {
+			p.clearMaintenance = append(p.clearMaintenance, endpoint)
 		}
 	}
+
+	for _, endpoint := range current {
+		p.deregister = append(p.deregister, endpoint)
+	}
+
+	return p
+}
+
+// reconcile applies the changes between existing and desired registrations
+func (t *consulTarget) reconcile(desired []interfaces.Endpoint, existing []interfaces.Endpoint) *syncResult {
+	return t.apply(t.plan(desired, existing))
+}
+
+// apply executes a plan with one catalog request per registration
+func (t *consulTarget) apply(p *syncPlan) *syncResult {
+	result := &syncResult{Unchanged: p.unchanged}
+
+	for _, endpoint := range p.register {
+		if err := t.register(endpoint); err != nil {
+			result.Errors = append(result.Errors, err)
+			continue
+		}
+		result.Registered++
+	}
+
+	for _, endpoint := range p.clearMaintenance {
+		if err := t.updateHealth(endpoint); err != nil {
+			result.Errors = append(result.Errors, err)
+		}
+	}
+
+	for _, endpoint := range p.deregister {
+		if err := t.deregister(endpoint); err != nil {
+			result.Errors = append(result.Errors, err)
+			continue
+		}
+		result.Deregistered++
+	}
+
+	return result
+}
+
+func (t *consulTarget) register(endpoint interfaces.Endpoint) error {
+	return t.registryOperation("register", endpoint, t.Registry().Register)
+}
+
+func (t *consulTarget) deregister(endpoint interfaces.Endpoint) error {
+	return t.registryOperation("deregister", endpoint, t.Registry().Deregister)
+}
+
+// updateHealth applies the maintenance state of an endpoint
+func (t *consulTarget) updateHealth(endpoint interfaces.Endpoint) error {
+	return t.registryOperation("update_health", endpoint, t.Registry().UpdateHealth)
+}
+
+// registryOperation logs and counts an operation on the registry. In dry
+// runs the registry is an in-memory copy, so changes are only logged.
+func (t *consulTarget) registryOperation(operation string, endpoint interfaces.Endpoint, op func(interfaces.Endpoint) error) error {
+	result := metrics.ResultSuccess
+	entry := endpointLog(endpoint, operation).WithField("target", t.name)
+	if t.dryRun {
+		entry.Info("Would apply registry operation")
+		result = metrics.ResultDryRun
+	} else {
+		entry.Debug("Applying registry operation")
+	}
+
+	if err := op(endpoint); err != nil {
+		metrics.ConsulOperations.WithLabelValues(t.name, operation, metrics.ResultError).Inc()
+		return err
+	}
+	metrics.ConsulOperations.WithLabelValues(t.name, operation, result).Inc()
 	return nil
 }
+
+// serviceLog returns a logger with the context of a kubernetes service
+func serviceLog(namespace string, name string, operation string) *log.Entry {
+	return log.WithFields(log.Fields{
+		"namespace": namespace,
+		"name":      name,
+		"operation": operation,
+	})
+}
+
+// endpointLog returns a logger with the context of a single registration
+func endpointLog(endpoint interfaces.Endpoint, operation string) *log.Entry {
+	fields := log.Fields{
+		"consul_service": endpoint.DnsLabel,
+		"service_id":     endpoint.ServiceID(),
+		"node":           endpoint.NodeName,
+		"operation":      operation,
+	}
+	if endpoint.Location != (interfaces.Location{}) {
+		fields["location"] = endpoint.Location.String()
+	}
+	for _, tag := range endpoint.Tags {
+		if namespace, name, ok := service.ParseOwnerTag(tag); ok {
+			fields["namespace"] = namespace
+			fields["name"] = name
+			break
+		}
+	}
+	return log.WithFields(fields)
+}
+
+func endpointKey(endpoint interfaces.Endpoint) string {
+	return fmt.Sprintf("%s/%s/%s", endpoint.Location, endpoint.NodeName, endpoint.ServiceID())
+}
+
+func endpointEqual(a, b interfaces.Endpoint) bool {
+	return a.DnsLabel == b.DnsLabel &&
+		a.NodeAddress == b.NodeAddress &&
+		a.NodePort == b.NodePort &&
+		a.Address == b.Address &&
+		a.Maintenance == b.Maintenance &&
+		reflect.DeepEqual(sortedTags(a.Tags), sortedTags(b.Tags)) &&
+		metaEqual(a.Meta, b.Meta)
+}
+
+func metaEqual(a, b map[string]string) bool {
+	if len(a) == 0 && len(b) == 0 {
+		return true
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+func sortedTags(tags []string) []string {
+	sorted := append([]string{}, tags...)
+	sort.Strings(sorted)
+	return sorted
+}
+
+// inCluster checks if tags belong to an entry of the configured cluster
+func (k *Kube2Consul) inCluster(tags []string) bool {
+	if k.clusterName == "" {
+		return true
+	}
+	clusterTag := service.ClusterTag(k.clusterName)
+	return hasTag(tags, func(tag string) bool {
+		return tag == clusterTag
+	})
+}
+
+func hasTag(tags []string, match func(tag string) bool) bool {
+	for _, tag := range tags {
+		if match(tag) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,348 @@
+package kube2consul
+
+import (
+	"context"
+	"reflect"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	consulapi "github.com/hashicorp/consul/api"
+
+	"github.com/jetstack-experimental/kube2consul/pkg/interfaces"
+	"github.com/jetstack-experimental/kube2consul/pkg/metrics"
+	"github.com/jetstack-experimental/kube2consul/pkg/registry/consul"
+	"github.com/jetstack-experimental/kube2consul/pkg/service"
+)
+
+const (
+	// driftWaitTime is the maximum duration of a blocking catalog query
+	driftWaitTime = 5 * time.Minute
+	// driftMinBackoff and driftMaxBackoff limit the delay between failed
+	// catalog queries
+	driftMinBackoff = time.Second
+	driftMaxBackoff = time.Minute
+	// driftLocationsInterval is how often locations to watch are looked for
+	driftLocationsInterval = 30 * time.Second
+)
+
+// setDesired remembers the registrations of an owner tag, so changes made to
+// them in consul can be detected and reverted
+func (k *Kube2Consul) setDesired(tag string, endpoints []interfaces.Endpoint) {
+	k.desiredLock.Lock()
+	defer k.desiredLock.Unlock()
+	if len(endpoints) == 0 {
+		delete(k.desired, tag)
+		return
+	}
+	k.desired[tag] = endpoints
+}
+
+// watchForDrift watches every location registrations may be in for changes
+// to the registrations made by kube2consul in the target, once the desired
+// registrations are known. Locations routed to later on are picked up
+// periodically.
+func (t *consulTarget) watchForDrift() {
+	select {
+	case <-t.stopCh:
+		return
+	case <-t.cacheSynced:
+	}
+
+	watched := make(map[interfaces.Location]bool)
+	ticker := time.NewTicker(driftLocationsInterval)
+	defer ticker.Stop()
+	for {
+		for _, location := range t.consulLocations() {
+			if !watched[location] {
+				watched[location] = true
+				go t.watchLocationForDrift(location)
+			}
+		}
+		select {
+		case <-t.stopCh:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// watchLocationForDrift watches the service listing of a location. The
+// owners of services added, removed or retagged are checked for drift.
+// Changes to the instances of services move the index of the listing only,
+// as they can't be told apart all owners are checked then, as they are on the
+// first listing and once the index has been reset. Checks are watched
+// separately.
+func (t *consulTarget) watchLocationForDrift(location interfaces.Location) {
+	go t.watchChecksForDrift(location)
+
+	var listed, services map[string][]string
+	query := func(options *consulapi.QueryOptions) (*consulapi.QueryMeta, error) {
+		var meta *consulapi.QueryMeta
+		var err error
+		services, meta, err = t.ConsulCatalog().Services(options)
+		return meta, err
+	}
+	t.blockingWatch(t.ctx, location, query, func(full bool) {
+		owned := isOwnerTag
+		if !full && !reflect.DeepEqual(listed, services) {
+			owners := t.changedOwners(listed, services)
+			owned = func(tag string) bool {
+				return owners[tag]
+			}
+			if len(owners) == 0 {
+				owned = nil
+			}
+		}
+		listed = services
+
+		if owned != nil {
+			t.detectDrift(location, owned)
+		}
+	})
+}
+
+// watchChecksForDrift watches the checks of a location, e.g. maintenance
+// checks, and checks the owners of the services whose checks changed for
+// drift. The first result only serves as the base, as do results after the
+// index has been reset, the listing of the location being checked then.
+func (t *consulTarget) watchChecksForDrift(location interfaces.Location) {
+	var listed map[string]*consulapi.HealthCheck
+	var checks consulapi.HealthChecks
+	query := func(options *consulapi.QueryOptions) (*consulapi.QueryMeta, error) {
+		var meta *consulapi.QueryMeta
+		var err error
+		checks, meta, err = t.ConsulClient().Health().State(consulapi.HealthAny, options)
+		return meta, err
+	}
+	t.blockingWatch(t.ctx, location, query, func(full bool) {
+		current := make(map[string]*consulapi.HealthCheck)
+		for _, check := range checks {
+			if check.ServiceID != "" {
+				current[check.Node+"/"+check.ServiceID+"/"+check.CheckID] = check
+			}
+		}
+		old := listed
+		listed = current
+		if full {
+			return
+		}
+
+		owners := make(map[string]bool)
+		for key, check := range old {
+			if !sameCheck(check, current[key]) {
+				t.addOwners(owners, check.ServiceTags)
+			}
+		}
+		for key, check := range current {
+			if !sameCheck(check, old[key]) {
+				t.addOwners(owners, check.ServiceTags)
+			}
+		}
+		if len(owners) > 0 {
+			t.detectDrift(location, func(tag string) bool {
+				return owners[tag]
+			})
+		}
+	})
+}
+
+// sameCheck compares the state of two checks, ignoring their output, which
+// changes with every run of checks made by agents
+func sameCheck(a, b *consulapi.HealthCheck) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Status == b.Status && a.Notes == b.Notes && reflect.DeepEqual(a.ServiceTags, b.ServiceTags)
+}
+
+// blockingWatch runs a blocking query in a location until ctx is done,
+// calling changed whenever the index moved. full is set for the first result
+// and once the index has been reset, e.g. after a consul restore, when the
+// changes since the last result can't be told. Failed queries are retried
+// with increasing delays.
+func (t *consulTarget) blockingWatch(ctx context.Context, location interfaces.Location, query func(*consulapi.QueryOptions) (*consulapi.QueryMeta, error), changed func(full bool)) {
+	logger := log.WithField("target", t.name)
+	if location != (interfaces.Location{}) {
+		logger = logger.WithField("location", location.String())
+	}
+
+	var index uint64
+	backoff := driftMinBackoff
+	for {
+		options := consul.QueryOptions(location)
+		options.WaitIndex = index
+		options.WaitTime = driftWaitTime
+		meta, err := query(options.WithContext(ctx))
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
+		if err != nil {
+			logger.Warnf("Error watching consul catalog, retrying in %s: %s", backoff, err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(backoff):
+			}
+			if backoff *= 2; backoff > driftMaxBackoff {
+				backoff = driftMaxBackoff
+			}
+			continue
+		}
+		backoff = driftMinBackoff
+
+		if meta.LastIndex == index {
+			continue
+		}
+		// the index went backwards, e.g. after a consul restore
+		if meta.LastIndex < index {
+			index = 0
+			continue
+		}
+		full := index == 0
+		index = meta.LastIndex
+		changed(full)
+	}
+}
+
+// changedOwners returns the owners of the services whose tags differ between
+// two listings of the catalog
+func (k *Kube2Consul) changedOwners(old, current map[string][]string) map[string]bool {
+	owners := make(map[string]bool)
+	for name, tags := range old {
+		if !reflect.DeepEqual(tags, current[name]) {
+			k.addOwners(owners, tags)
+		}
+	}
+	for name, tags := range current {
+		if !reflect.DeepEqual(tags, old[name]) {
+			k.addOwners(owners, tags)
+		}
+	}
+	return owners
+}
+
+// addOwners adds the owner tags of a registration of this cluster to owners
+func (k *Kube2Consul) addOwners(owners map[string]bool, tags []string) {
+	if !k.inCluster(tags) {
+		return
+	}
+	for _, tag := range tags {
+		if isOwnerTag(tag) {
+			owners[tag] = true
+		}
+	}
+}
+
+// detectDrift compares the registrations of the owners matched by owned in a
+// location with those last registered, which are none for unknown owners,
+// logs and counts the differences and re-syncs the affected owners. It
+// returns the number of re-synced owners. Changes being applied concurrently
+// may be reported as well, re-syncing them is harmless.
+func (t *consulTarget) detectDrift(location interfaces.Location, owned func(tag string) bool) int {
+	existing, err := t.locationOwnedEndpoints(location, owned)
+	if err != nil {
+		log.WithField("target", t.name).Warnf("Error getting registrations to check for drift: %s", err)
+		return 0
+	}
+
+	byTag := make(map[string][]interfaces.Endpoint)
+	for _, endpoint := range existing {
+		for _, tag := range endpoint.Tags {
+			if owned(tag) {
+				byTag[tag] = append(byTag[tag], endpoint)
+			}
+		}
+	}
+
+	t.desiredLock.Lock()
+	desired := make(map[string][]interfaces.Endpoint)
+	known := make(map[string]bool)
+	for tag, endpoints := range t.desired {
+		known[tag] = true
+		if owned(tag) {
+			desired[tag] = inLocation(endpoints, location)
+		}
+	}
+	t.desiredLock.Unlock()
+
+	// registrations of unknown owners in scope are unexpected as well, e.g.
+	// of services deleted while kube2consul was down
+	inScope := t.syncOwnerFilter(known)
+	tags := make(map[string]bool)
+	for tag := range desired {
+		tags[tag] = true
+	}
+	for tag := range byTag {
+		if inScope(tag) {
+			tags[tag] = true
+		}
+	}
+
+	drifted := 0
+	for tag := range tags {
+		p := t.plan(desired[tag], byTag[tag])
+		if len(p.register) == 0 && len(p.deregister) == 0 {
+			continue
+		}
+		drifted++
+
+		current := make(map[string]bool)
+		for _, endpoint := range byTag[tag] {
+			current[endpointKey(endpoint)] = true
+		}
+		for _, endpoint := range p.register {
+			kind := "missing"
+			if current[endpointKey(endpoint)] {
+				kind = "changed"
+			}
+			endpointLog(endpoint, "drift").WithField("target", t.name).Warnf("Registration %s in consul", kind)
+			metrics.ConsulDrift.WithLabelValues(t.name, kind).Inc()
+		}
+		for _, endpoint := range p.deregister {
+			endpointLog(endpoint, "drift").WithField("target", t.name).Warn("Registration unexpected in consul")
+			metrics.ConsulDrift.WithLabelValues(t.name, "unexpected").Inc()
+		}
+
+		if err := t.resyncOwner(tag); err != nil {
+			log.WithField("owner", tag).Warnf("Error restoring registrations: %s", err)
+		}
+	}
+	return drifted
+}
+
+// inLocation returns the endpoints placed in location
+func inLocation(endpoints []interfaces.Endpoint, location interfaces.Location) []interfaces.Endpoint {
+	var located []interfaces.Endpoint
+	for _, endpoint := range endpoints {
+		if endpoint.Location == location {
+			located = append(located, endpoint)
+		}
+	}
+	return located
+}
+
+// resyncOwner updates the kubernetes service owning tag, or, for other
+// owners like ingresses, restores the registrations last made
+func (k *Kube2Consul) resyncOwner(tag string) error {
+	namespace, name, _ := service.ParseOwnerTag(tag)
+
+	if svc := k.lookupService(namespace, name); svc != nil {
+		return svc.Update()
+	}
+
+	// the registrations may have been replaced since drift was detected
+	k.claimsLock.Lock()
+	defer k.claimsLock.Unlock()
+	k.desiredLock.Lock()
+	endpoints := k.desired[tag]
+	k.desiredLock.Unlock()
+	return k.writeOwned(tag, endpoints, nil)
+}
+
+// isOwnerTag matches the owner tags of services and ingresses
+func isOwnerTag(tag string) bool {
+	_, _, ok := service.ParseOwnerTag(tag)
+	return ok
+}
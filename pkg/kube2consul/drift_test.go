@@ -0,0 +1,224 @@
+package kube2consul
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	consulapi "github.com/hashicorp/consul/api"
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/jetstack-experimental/kube2consul/pkg/metrics"
+	"github.com/jetstack-experimental/kube2consul/pkg/service"
+	"github.com/jetstack-experimental/kube2consul/pkg/testing/fakeconsul"
+)
+
+// driftCount returns the count of drift of a kind in the default target
+func driftCount(t *testing.T, kind string) float64 {
+	var m dto.Metric
+	if err := metrics.ConsulDrift.WithLabelValues(DefaultTargetName, kind).Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetCounter().GetValue()
+}
+
+// newDriftWatch returns a started kube2consul watching for drift, with the
+// services default/web and default/api, which has a pod on node-1 only,
+// registered and watched
+func newDriftWatch(t *testing.T, routes ...string) (*fakeKube2Consul, *fakeconsul.Server) {
+	f, consul := newE2E()
+	f.watchConsul = true
+	for _, spec := range routes {
+		route, err := parseRoute(spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.routes = append(f.routes, route)
+	}
+
+	api := nodePortService("default", "api", time.Now())
+	api.Spec.Ports[0].NodePort = 30081
+	if _, err := f.clientset.Core().Services("default").Create(api); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.clientset.Core().Endpoints("default").Create(endpoints("default", "api", "172.16.0.1")); err != nil {
+		t.Fatal(err)
+	}
+
+	f.start(t)
+	waitFor(t, "registration of default/web and default/api", serviceCount(consul, 3))
+	waitFor(t, "blocking queries", watching(consul, "/v1/catalog/services", "/v1/health/state/any"))
+	return f, consul
+}
+
+// watching returns a condition of blocking queries received for all paths
+func watching(server *fakeconsul.Server, paths ...string) func() bool {
+	return func() bool {
+		blocking := make(map[string]bool)
+		for _, req := range server.Requests() {
+			if req.Method == "GET" && strings.Contains(req.Query, "index=") {
+				blocking[req.Path] = true
+			}
+		}
+		for _, path := range paths {
+			if !blocking[path] {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// listed returns the number of reads of a path, which aren't blocking
+func listed(server *fakeconsul.Server, path string) int {
+	count := 0
+	for _, req := range server.Requests() {
+		if req.Method == "GET" && req.Path == path && !strings.Contains(req.Query, "index=") {
+			count++
+		}
+	}
+	return count
+}
+
+// changePort registers a service of server with another port, like a change
+// made by hand, and returns a condition of the port being restored
+func changePort(t *testing.T, server *fakeconsul.Server, key string) func() bool {
+	svc, ok := server.Services()[key]
+	if !ok {
+		t.Fatalf("Service %s not registered", key)
+	}
+	port := svc.Port
+	svc.Port = 1234
+	server.RegisterService(strings.SplitN(key, "/", 2)[0], svc)
+	return func() bool {
+		svc, ok := server.Services()[key]
+		return ok && svc.Port == port
+	}
+}
+
+// checkedOnly fails the test unless the registrations of service have been
+// listed and those of other not
+func checkedOnly(t *testing.T, server *fakeconsul.Server, service string, other string) {
+	if act := listed(server, "/v1/health/service/"+service); act == 0 {
+		t.Errorf("Registrations of %s not listed", service)
+	}
+	if act := listed(server, "/v1/health/service/"+other); act != 0 {
+		t.Errorf("Registrations of %s listed %d times without changes", other, act)
+	}
+}
+
+func TestE2EDriftWatch(t *testing.T) {
+	f, consul := newDriftWatch(t)
+	defer consul.Close()
+	defer f.stop()
+
+	// changed instances can't be told apart by the listing, so all owners
+	// are checked
+	changed := driftCount(t, "changed")
+	waitFor(t, "restored registration", changePort(t, consul, "node-2/default-web"))
+	if exp, act := changed+1, driftCount(t, "changed"); exp != act {
+		t.Errorf("Counted %v changed registrations, expected %v", act, exp)
+	}
+
+	// only the owner of a retagged service is checked
+	changed = driftCount(t, "changed")
+	consul.Reset()
+	svc := consul.Services()["node-2/default-web"]
+	svc.Tags = append(svc.Tags, "retagged")
+	consul.RegisterService("node-2", svc)
+	waitFor(t, "restored registration", func() bool {
+		return !hasTag(consul.Services()["node-2/default-web"].Tags, func(tag string) bool { return tag == "retagged" })
+	})
+	if exp, act := changed+1, driftCount(t, "changed"); exp != act {
+		t.Errorf("Counted %v changed registrations, expected %v", act, exp)
+	}
+	checkedOnly(t, consul, "default-web", "default-api")
+
+	// as is the owner of a service whose checks changed
+	consul.Reset()
+	consul.RegisterCheck(consulapi.HealthCheck{
+		Node:      "node-1",
+		CheckID:   "api-alive",
+		ServiceID: "default-api",
+		Status:    consulapi.HealthCritical,
+	})
+	waitFor(t, "check of default/api", func() bool {
+		return listed(consul, "/v1/health/service/default-api") > 0
+	})
+	checkedOnly(t, consul, "default-api", "default-web")
+
+	// removed services are checked by the listing, and by the watch of
+	// checks for the one of default/api
+	missing := driftCount(t, "missing")
+	_, err := f.consulTargets()[0].ConsulCatalog().Deregister(&consulapi.CatalogDeregistration{
+		Node:      "node-1",
+		ServiceID: "default-api",
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "restored registration", serviceCount(consul, 3))
+	if act := driftCount(t, "missing"); act <= missing {
+		t.Errorf("Counted %v missing registrations, expected more than %v", act, missing)
+	}
+
+	// registrations of unknown owners are removed
+	unexpected := driftCount(t, "unexpected")
+	consul.RegisterService("node-1", consulapi.AgentService{
+		ID:      "default-gone",
+		Service: "default-gone",
+		Tags:    []string{service.OwnerTag("default", "gone")},
+	})
+	waitFor(t, "removed registration", serviceCount(consul, 3))
+	if exp, act := unexpected+1, driftCount(t, "unexpected"); exp != act {
+		t.Errorf("Counted %v unexpected registrations, expected %v", act, exp)
+	}
+}
+
+func TestE2EDriftWatchRouted(t *testing.T) {
+	f, consul := newDriftWatch(t, "namespaces=def*,namespace=team")
+	defer consul.Close()
+	defer f.stop()
+
+	if _, ok := consul.Services()["node-2/team/default-web"]; !ok {
+		t.Fatalf("Service default-web not registered in namespace team: %v", consul.Services())
+	}
+	waitFor(t, "restored registration", changePort(t, consul, "node-2/team/default-web"))
+}
+
+func TestE2EDriftWatchIndexReset(t *testing.T) {
+	f, consul := newDriftWatch(t)
+	defer consul.Close()
+	defer f.stop()
+
+	// all owners are checked after a restore
+	consul.Reset()
+	consul.SetIndex(1)
+	waitFor(t, "check of all owners", func() bool {
+		return listed(consul, "/v1/health/service/default-web") > 0 && listed(consul, "/v1/health/service/default-api") > 0
+	})
+
+	// and watched from the new index on
+	waitFor(t, "restored registration", changePort(t, consul, "node-1/default-api"))
+}
+
+func TestE2EDriftWatchBackoff(t *testing.T) {
+	f, consul := newDriftWatch(t)
+	defer consul.Close()
+	defer f.stop()
+
+	// a service not owned by kube2consul changes the listing only
+	consul.Reset()
+	consul.Fail("/v1/catalog/services", 2)
+	start := time.Now()
+	consul.RegisterService("node-1", consulapi.AgentService{ID: "db", Service: "db", Port: 5432})
+	waitFor(t, "retries", func() bool {
+		return consul.RequestCount("GET", "/v1/catalog/services") == 3
+	})
+	if elapsed, exp := time.Since(start), driftMinBackoff+2*driftMinBackoff; elapsed < exp {
+		t.Errorf("Retried after %s, expected a backoff of %s", elapsed, exp)
+	}
+
+	// changes are detected again once queries succeed
+	waitFor(t, "restored registration", changePort(t, consul, "node-1/default-web"))
+}
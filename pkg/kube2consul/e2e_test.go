@@ -0,0 +1,738 @@
+package kube2consul
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	consulapi "github.com/hashicorp/consul/api"
+	kapi "k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/api/unversioned"
+	"k8s.io/kubernetes/pkg/client/clientset_generated/internalclientset/fake"
+	krecord "k8s.io/kubernetes/pkg/client/record"
+	klabels "k8s.io/kubernetes/pkg/labels"
+
+	"github.com/jetstack-experimental/kube2consul/pkg/interfaces"
+	"github.com/jetstack-experimental/kube2consul/pkg/metrics"
+	"github.com/jetstack-experimental/kube2consul/pkg/service"
+	"github.com/jetstack-experimental/kube2consul/pkg/testing/fakeconsul"
+	"github.com/jetstack-experimental/kube2consul/pkg/testing/fakekube"
+)
+
+// fakeKube2Consul runs against the fake consul, with kubernetes objects
+// served by the fake clientset
+type fakeKube2Consul struct {
+	*Kube2Consul
+	clientset *fake.Clientset
+}
+
+// newE2E returns kube2consul with a clientset serving two nodes and the
+// NodePort service default/web with a pod on each. Options are set before
+// calling start.
+func newE2E() (*fakeKube2Consul, *fakeconsul.Server) {
+	consul := fakeconsul.New()
+
+	k := New()
+	k.consulAddress = consul.Address()
+	// drift is checked explicitly unless a test watches for it
+	k.watchConsul = false
+
+	clientset := fakekube.NewClientset(
+		&kapi.Namespace{
+			ObjectMeta: kapi.ObjectMeta{Name: "default"},
+		},
+		&kapi.Node{
+			ObjectMeta: kapi.ObjectMeta{Name: "node-1"},
+			Status: kapi.NodeStatus{
+				Addresses: []kapi.NodeAddress{{Type: kapi.NodeInternalIP, Address: "10.0.0.1"}},
+			},
+		},
+		&kapi.Node{
+			ObjectMeta: kapi.ObjectMeta{Name: "node-2"},
+			Status: kapi.NodeStatus{
+				Addresses: []kapi.NodeAddress{{Type: kapi.NodeInternalIP, Address: "10.0.0.2"}},
+			},
+		},
+		&kapi.Pod{
+			ObjectMeta: kapi.ObjectMeta{Namespace: "default", Name: "web-1"},
+			Spec:       kapi.PodSpec{NodeName: "node-1"},
+			Status:     kapi.PodStatus{PodIP: "172.16.0.1"},
+		},
+		&kapi.Pod{
+			ObjectMeta: kapi.ObjectMeta{Namespace: "default", Name: "web-2"},
+			Spec:       kapi.PodSpec{NodeName: "node-2"},
+			Status:     kapi.PodStatus{PodIP: "172.16.0.2"},
+		},
+		nodePortService("default", "web", time.Now()),
+		endpoints("default", "web", "172.16.0.1", "172.16.0.2"),
+	)
+	k.kubernetesClientset = clientset
+
+	return &fakeKube2Consul{Kube2Consul: k, clientset: clientset}, consul
+}
+
+func nodePortService(namespace, name string, created time.Time) *kapi.Service {
+	return &kapi.Service{
+		ObjectMeta: kapi.ObjectMeta{
+			Namespace:         namespace,
+			Name:              name,
+			UID:               "1234",
+			CreationTimestamp: unversioned.NewTime(created),
+		},
+		Spec: kapi.ServiceSpec{
+			Type: kapi.ServiceTypeNodePort,
+			Ports: []kapi.ServicePort{
+				{Name: "http", Port: 80, NodePort: 30080, Protocol: kapi.ProtocolTCP},
+			},
+		},
+	}
+}
+
+func endpoints(namespace, name string, ips ...string) *kapi.Endpoints {
+	e := &kapi.Endpoints{
+		ObjectMeta: kapi.ObjectMeta{Namespace: namespace, Name: name},
+		Subsets: []kapi.EndpointSubset{{
+			Ports: []kapi.EndpointPort{{Name: "http", Port: 8080}},
+		}},
+	}
+	for _, ip := range ips {
+		e.Subsets[0].Addresses = append(e.Subsets[0].Addresses, kapi.EndpointAddress{IP: ip})
+	}
+	return e
+}
+
+// start runs kube2consul like the root command, until stopped
+func (f *fakeKube2Consul) start(t *testing.T) {
+	if err := f.Kube2Consul.start(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// updateService gets a service, passes it to change and updates it
+func (f *fakeKube2Consul) updateService(t *testing.T, namespace, name string, change func(*kapi.Service)) {
+	svc, err := f.clientset.Core().Services(namespace).Get(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	change(svc)
+	if _, err := f.clientset.Core().Services(namespace).Update(svc); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// waitFor polls condition until it holds and fails the test if it doesn't
+// within 5 seconds
+func waitFor(t *testing.T, what string, condition func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// serviceCount returns a condition of n services registered in server
+func serviceCount(server *fakeconsul.Server, n int) func() bool {
+	return func() bool {
+		return len(server.Services()) == n
+	}
+}
+
+func TestE2EServiceLifecycle(t *testing.T) {
+	f, consul := newE2E()
+	defer consul.Close()
+	defer f.stop()
+	f.start(t)
+
+	// add
+	waitFor(t, "registration of default/web", serviceCount(consul, 2))
+	services := consul.Services()
+	for _, node := range []string{"node-1", "node-2"} {
+		svc, ok := services[node+"/default-web"]
+		if !ok {
+			t.Fatalf("Service default-web not registered on %s", node)
+		}
+		if exp, act := 30080, svc.Port; exp != act {
+			t.Errorf("Port %d is not the expected %d", act, exp)
+		}
+		if !hasTag(svc.Tags, func(tag string) bool { return tag == service.OwnerTag("default", "web") }) {
+			t.Errorf("Owner tag missing in %v", svc.Tags)
+		}
+	}
+	if exp, act := "10.0.0.2", consul.Nodes()["node-2"].Address; exp != act {
+		t.Errorf("Node address '%s' is not the expected '%s'", act, exp)
+	}
+	if exp, act := 2, consul.RequestCount("PUT", "/v1/catalog/register"); exp != act {
+		t.Errorf("Sent %d register requests, expected %d", act, exp)
+	}
+
+	// an update without changes to the registrations is not registered
+	// again, events are handled in order, so only the port change is
+	consul.Reset()
+	f.updateService(t, "default", "web", func(svc *kapi.Service) {
+		svc.Labels = map[string]string{"unrelated": "true"}
+	})
+	f.updateService(t, "default", "web", func(svc *kapi.Service) {
+		svc.Spec.Ports[0].NodePort = 30081
+	})
+	waitFor(t, "node port update", func() bool {
+		services := consul.Services()
+		return services["node-1/default-web"].Port == 30081 && services["node-2/default-web"].Port == 30081
+	})
+	if exp, act := 2, consul.RequestCount("PUT", "/v1/catalog/register"); exp != act {
+		t.Errorf("Sent %d register requests, expected %d", act, exp)
+	}
+
+	// scale down
+	if _, err := f.clientset.Core().Endpoints("default").Update(endpoints("default", "web", "172.16.0.1")); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "deregistration from node-2", serviceCount(consul, 1))
+	if _, ok := consul.Services()["node-1/default-web"]; !ok {
+		t.Errorf("Service default-web not left on node-1: %v", consul.Services())
+	}
+
+	// delete
+	if err := f.clientset.Core().Services("default").Delete("web", nil); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "deregistration of default/web", serviceCount(consul, 0))
+
+	// endpoints removed after their service don't bring it back
+	if err := f.clientset.Core().Endpoints("default").Delete("web", nil); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if svc := f.lookupService("default", "web"); svc != nil {
+		t.Error("Service default/web recreated after its endpoints were removed")
+	}
+}
+
+func TestE2EServiceMaintenance(t *testing.T) {
+	f, consul := newE2E()
+	defer consul.Close()
+	defer f.stop()
+	f.start(t)
+	waitFor(t, "registration of default/web", serviceCount(consul, 2))
+
+	f.updateService(t, "default", "web", func(svc *kapi.Service) {
+		svc.Annotations = map[string]string{service.MaintenanceAnnotation: "migration"}
+	})
+	waitFor(t, "maintenance check", func() bool {
+		_, ok := consul.Checks()["node-1/_service_maintenance:default-web"]
+		return ok
+	})
+	check := consul.Checks()["node-1/_service_maintenance:default-web"]
+	if exp, act := "critical", check.Status; exp != act {
+		t.Errorf("Check status '%s' is not the expected '%s'", act, exp)
+	}
+	if exp, act := "migration", check.Notes; exp != act {
+		t.Errorf("Check notes '%s' are not the expected '%s'", act, exp)
+	}
+
+	f.updateService(t, "default", "web", func(svc *kapi.Service) {
+		svc.Annotations = nil
+	})
+	waitFor(t, "removal of the maintenance checks", func() bool {
+		return len(consul.Checks()) == 0
+	})
+}
+
+func TestE2EServiceMetadata(t *testing.T) {
+	f, consul := newE2E()
+	defer consul.Close()
+	defer f.stop()
+	f.kvPrefix = "kube2consul"
+	f.start(t)
+
+	waitFor(t, "metadata of default/web", func() bool {
+		_, ok := consul.KV()["kube2consul/default/web"]
+		return ok
+	})
+	if act := consul.RequestCount("PUT", "/v1/txn"); act == 0 {
+		t.Errorf("Registrations not sent as transaction")
+	}
+	if exp, act := 2, len(consul.Services()); exp != act {
+		t.Errorf("Registered %d services, expected %d", act, exp)
+	}
+
+	var metadata interfaces.ServiceMetadata
+	if err := json.Unmarshal(consul.KV()["kube2consul/default/web"], &metadata); err != nil {
+		t.Fatal(err)
+	}
+	if exp, act := "1234", metadata.UID; exp != act {
+		t.Errorf("UID '%s' is not the expected '%s'", act, exp)
+	}
+
+	if err := f.clientset.Core().Services("default").Delete("web", nil); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "removal of the metadata", func() bool {
+		_, ok := consul.KV()["kube2consul/default/web"]
+		return !ok
+	})
+}
+
+func TestE2EDrift(t *testing.T) {
+	f, consul := newE2E()
+	defer consul.Close()
+	defer f.stop()
+	f.start(t)
+	waitFor(t, "registration of default/web", serviceCount(consul, 2))
+
+	target := f.consulTargets()[0]
+	if act := target.detectDrift(interfaces.Location{}, isOwnerTag); act != 0 {
+		t.Fatalf("Detected drift of %d owners without changes", act)
+	}
+
+	// deregister one instance and change the port of the other by hand
+	_, err := target.ConsulCatalog().Deregister(&consulapi.CatalogDeregistration{
+		Node:      "node-1",
+		ServiceID: "default-web",
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	changed := consul.Services()["node-2/default-web"]
+	changed.Port = 1234
+	_, err = target.ConsulCatalog().Register(&consulapi.CatalogRegistration{
+		Node:    "node-2",
+		Address: "10.0.0.2",
+		Service: &changed,
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if exp, act := 1, target.detectDrift(interfaces.Location{}, isOwnerTag); exp != act {
+		t.Errorf("Detected drift of %d owners, expected %d", act, exp)
+	}
+	waitFor(t, "restored registrations", func() bool {
+		services := consul.Services()
+		return len(services) == 2 && services["node-2/default-web"].Port == 30080
+	})
+}
+
+func TestE2EMultipleTargets(t *testing.T) {
+	f, consul := newE2E()
+	defer consul.Close()
+	defer f.stop()
+	dc2 := fakeconsul.New()
+	defer dc2.Close()
+	f.targetSpecs = []string{
+		"name=dc2,address=" + dc2.Address(),
+		// nothing listens on port 1
+		"name=down,address=127.0.0.1:1",
+	}
+	f.start(t)
+
+	// writes don't wait for the failed target
+	waitFor(t, "registrations in all reachable targets", func() bool {
+		return len(consul.Services()) == 2 && len(dc2.Services()) == 2 && !metrics.Health()["down"].Healthy
+	})
+	f.updateService(t, "default", "web", func(svc *kapi.Service) {
+		svc.Spec.Ports[0].NodePort = 30081
+	})
+	waitFor(t, "update in all reachable targets", func() bool {
+		return dc2.Services()["node-1/default-web"].Port == 30081 && consul.Services()["node-1/default-web"].Port == 30081
+	})
+
+	if health := metrics.Health()["dc2"]; !health.Healthy {
+		t.Errorf("Target dc2 is unhealthy: %s", health.Error)
+	}
+}
+
+func TestE2ENamespaceRouting(t *testing.T) {
+	f, consul := newE2E()
+	defer consul.Close()
+	defer f.stop()
+
+	route, err := parseRoute("namespaces=def*,namespace=team")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.routes = []consulRoute{route}
+	f.routeAnnotations = true
+	f.start(t)
+
+	// registers in the consul namespace of a location, once
+	inNamespace := func(ns string) func() bool {
+		return func() bool {
+			services := consul.Services()
+			_, ok1 := services["node-1/"+ns+"default-web"]
+			_, ok2 := services["node-2/"+ns+"default-web"]
+			return len(services) == 2 && ok1 && ok2
+		}
+	}
+	waitFor(t, "registrations in namespace team", inNamespace("team/"))
+	routed := false
+	for _, req := range consul.Requests() {
+		if req.Path == "/v1/catalog/register" && strings.Contains(req.Query, "ns=team") {
+			routed = true
+		}
+	}
+	if !routed {
+		t.Errorf("No registration requested in namespace team")
+	}
+
+	// annotations of the kubernetes namespace take precedence
+	setAnnotations := func(annotations map[string]string) {
+		ns, err := f.clientset.Core().Namespaces().Get("default")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ns.Annotations = annotations
+		if _, err := f.clientset.Core().Namespaces().Update(ns); err != nil {
+			t.Fatal(err)
+		}
+	}
+	setAnnotations(map[string]string{ConsulNamespaceAnnotation: "other"})
+	waitFor(t, "registrations moved to namespace other", inNamespace("other/"))
+
+	// and the route applies again once they are removed
+	setAnnotations(nil)
+	waitFor(t, "registrations moved back to namespace team", inNamespace("team/"))
+}
+
+func TestE2ENameConflict(t *testing.T) {
+	f, consul := newE2E()
+	defer consul.Close()
+	defer f.stop()
+
+	recorder := krecord.NewFakeRecorder(10)
+	f.eventRecorder = recorder
+	f.start(t)
+	waitFor(t, "registration of default/web", serviceCount(consul, 2))
+
+	// a-b/c and a/b-c both become a-b-c
+	older, newer := service.OwnerTag("a-b", "c"), service.OwnerTag("a", "b-c")
+	owner := func() string {
+		svc, ok := consul.Services()["node-1/a-b-c"]
+		if !ok {
+			return ""
+		}
+		return svc.Tags[0]
+	}
+	create := func(namespace, name string, created time.Time) {
+		if _, err := f.clientset.Core().Endpoints(namespace).Create(endpoints(namespace, name, "172.16.0.1")); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.clientset.Core().Services(namespace).Create(nodePortService(namespace, name, created)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the oldest service wins, even if created last
+	create("a", "b-c", time.Now())
+	waitFor(t, "registration of a/b-c", func() bool { return owner() == newer })
+	create("a-b", "c", time.Now().Add(-time.Hour))
+	waitFor(t, "registration of a-b/c", func() bool { return owner() == older })
+	waitFor(t, "conflict events", func() bool { return len(recorder.Events) == 2 })
+	for len(recorder.Events) > 0 {
+		if event := <-recorder.Events; !strings.Contains(event, NameConflictReason) {
+			t.Errorf("Unexpected event '%s'", event)
+		}
+	}
+	if exp, act := 3, len(consul.Services()); exp != act {
+		t.Errorf("Registered %d services, expected %d: %v", act, exp, consul.Services())
+	}
+
+	// the name is handed over once the oldest service is gone
+	if err := f.clientset.Core().Services("a-b").Delete("c", nil); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "hand over to a/b-c", func() bool { return owner() == newer })
+}
+
+func TestE2ENameConflictMerge(t *testing.T) {
+	f, consul := newE2E()
+	defer consul.Close()
+	defer f.stop()
+	f.conflictPolicy = ConflictPolicyMerge
+	f.start(t)
+
+	for _, ns := range []string{"a", "a-b"} {
+		name := strings.TrimPrefix("a-b-c", ns+"-")
+		if _, err := f.clientset.Core().Endpoints(ns).Create(endpoints(ns, name, "172.16.0.1")); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.clientset.Core().Services(ns).Create(nodePortService(ns, name, time.Now())); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// both get the namespace appended
+	waitFor(t, "merged registrations", func() bool {
+		services := consul.Services()
+		_, ok1 := services["node-1/a-b-c-c.a-b"]
+		_, ok2 := services["node-1/a-b-c-b-c.a"]
+		_, ok3 := services["node-1/a-b-c"]
+		return ok1 && ok2 && !ok3
+	})
+}
+
+func TestE2EEmptyNodes(t *testing.T) {
+	f, consul := newE2E()
+	defer consul.Close()
+	defer f.stop()
+	f.start(t)
+	waitFor(t, "registration of default/web", serviceCount(consul, 2))
+	if exp, act := "true", consul.Nodes()["node-1"].Meta[ManagedNodeMeta]; exp != act {
+		t.Errorf("Node meta %s is '%s', expected '%s'", ManagedNodeMeta, act, exp)
+	}
+
+	managed := map[string]string{ManagedNodeMeta: "true"}
+	consul.RegisterNode(consulapi.Node{Node: "gone", Address: "10.0.0.3", Meta: managed})
+	consul.RegisterNode(consulapi.Node{Node: "agent", Address: "10.0.0.4", Meta: managed})
+	consul.RegisterCheck(consulapi.HealthCheck{Node: "agent", CheckID: SerfHealthCheckID, Status: consulapi.HealthPassing})
+	consul.RegisterNode(consulapi.Node{Node: "other", Address: "10.0.0.5"})
+
+	// nodes of existing kubernetes nodes are kept, even if empty
+	if err := f.clientset.Core().Services("default").Delete("web", nil); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "deregistration of default/web", serviceCount(consul, 0))
+	target := f.consulTargets()[0]
+	if err := target.deregisterEmptyNodes(); err != nil {
+		t.Fatal(err)
+	}
+	var nodes []string
+	for name := range consul.Nodes() {
+		nodes = append(nodes, name)
+	}
+	sort.Strings(nodes)
+	if exp, act := []string{"agent", "node-1", "node-2", "other"}, nodes; !reflect.DeepEqual(exp, act) {
+		t.Errorf("Nodes %v are not the expected %v", act, exp)
+	}
+
+	if err := f.clientset.Core().Nodes().Delete("node-2", nil); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "removal of node-2 from the informer cache", func() bool {
+		_, exists, _ := f.Informers().Nodes().GetIndexer().GetByKey("node-2")
+		return !exists
+	})
+	if err := target.deregisterEmptyNodes(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := consul.Nodes()["node-2"]; ok {
+		t.Errorf("Empty node node-2 not deregistered after the kubernetes node is gone")
+	}
+	for _, name := range []string{"node-1", "agent", "other"} {
+		if _, ok := consul.Nodes()[name]; !ok {
+			t.Errorf("Node %s deregistered", name)
+		}
+	}
+}
+
+func TestE2ENodeMaintenanceWithdraw(t *testing.T) {
+	f, consul := newE2E()
+	defer consul.Close()
+	defer f.stop()
+	f.serviceOptions.NodeMaintenance = interfaces.NodeMaintenanceWithdraw
+	f.start(t)
+	waitFor(t, "registration of default/web", serviceCount(consul, 2))
+
+	cordon := func(unschedulable bool) {
+		node, err := f.clientset.Core().Nodes().Get("node-2")
+		if err != nil {
+			t.Fatal(err)
+		}
+		node.Spec.Unschedulable = unschedulable
+		if _, err := f.clientset.Core().Nodes().Update(node); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// services are re-registered in the background after node changes
+	cordon(true)
+	waitFor(t, "withdrawal from node-2", serviceCount(consul, 1))
+	if _, ok := consul.Services()["node-1/default-web"]; !ok {
+		t.Errorf("Registration on node-1 withdrawn: %v", consul.Services())
+	}
+	cordon(false)
+	waitFor(t, "registration on node-2", serviceCount(consul, 2))
+}
+
+func TestE2ESyncedNodeDeleted(t *testing.T) {
+	f, consul := newE2E()
+	defer consul.Close()
+	defer f.stop()
+	f.syncNodes = true
+	f.nodeCleanupInterval = 0
+	f.start(t)
+	waitFor(t, "registration of default/web", serviceCount(consul, 2))
+
+	// nodes created by the node sync are deregistered with services left
+	if err := f.clientset.Core().Nodes().Delete("node-2", nil); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "deregistration of node-2", func() bool {
+		_, ok := consul.Nodes()["node-2"]
+		return !ok
+	})
+	if _, ok := consul.Nodes()["node-1"]; !ok {
+		t.Errorf("Node node-1 deregistered")
+	}
+}
+
+func TestE2EAgentNodes(t *testing.T) {
+	f, consul := newE2E()
+	defer consul.Close()
+	defer f.stop()
+	agentMeta := map[string]string{"consul-version": "1.0.0"}
+	consul.RegisterNode(consulapi.Node{Node: "node-1", Address: "10.0.0.1", Meta: agentMeta})
+	consul.RegisterCheck(consulapi.HealthCheck{Node: "node-1", CheckID: SerfHealthCheckID, Status: consulapi.HealthPassing})
+	f.start(t)
+	waitFor(t, "registration of default/web", serviceCount(consul, 2))
+
+	// the meta data of agents is kept, other nodes are marked
+	if exp, act := agentMeta, consul.Nodes()["node-1"].Meta; !reflect.DeepEqual(exp, act) {
+		t.Errorf("Meta data %v of the agent node is not the expected %v", act, exp)
+	}
+	if exp, act := "true", consul.Nodes()["node-2"].Meta[ManagedNodeMeta]; exp != act {
+		t.Errorf("Node meta %s is '%s', expected '%s'", ManagedNodeMeta, act, exp)
+	}
+}
+
+func TestE2EClientLimits(t *testing.T) {
+	f, consul := newE2E()
+	defer consul.Close()
+	defer f.stop()
+
+	// requests wait for the rate limit
+	f.consulQPS = 10
+	f.consulBurst = 1
+	target, err := newConsulTarget(f.Kube2Consul, "throttled", &consulapi.Config{Address: consul.Address()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	for i := 0; i < 2; i++ {
+		if _, _, err := target.ConsulCatalog().Services(nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("Requests took %s, expected them to be throttled", elapsed)
+	}
+
+	// blocking queries don't take up the rate limit
+	start = time.Now()
+	for i := 0; i < 2; i++ {
+		options := &consulapi.QueryOptions{WaitIndex: 1, WaitTime: time.Millisecond}
+		if _, _, err := target.ConsulCatalog().Services(options); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Errorf("Blocking queries took %s, expected them not to be throttled", elapsed)
+	}
+
+	// requests to an unresponsive consul time out
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-release:
+		}
+	}))
+	defer slow.Close()
+	defer close(release)
+	f.consulQPS = 0
+	f.consulTimeout = 50 * time.Millisecond
+	target, err = newConsulTarget(f.Kube2Consul, "slow", &consulapi.Config{Address: slow.Listener.Addr().String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	start = time.Now()
+	if _, _, err := target.ConsulCatalog().Services(nil); err == nil {
+		t.Error("Expected request to time out")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Request timed out after %s", elapsed)
+	}
+
+	// blocking queries get their wait time added
+	timeout := consulRequestTimeout(f.consulTimeout)
+	req := httptest.NewRequest("GET", "/v1/catalog/services?index=5&wait=1m", nil)
+	if exp, act := 50*time.Millisecond+time.Minute+time.Minute/16, timeout(req); exp != act {
+		t.Errorf("Timeout of blocking query is %s, expected %s", act, exp)
+	}
+
+	// shutdown cancels pending requests
+	f.consulTimeout = 0
+	target, err = newConsulTarget(f.Kube2Consul, "slow", &consulapi.Config{Address: slow.Listener.Addr().String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	errCh := make(chan error)
+	go func() {
+		_, _, err := target.ConsulCatalog().Services(nil)
+		errCh <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	f.stop()
+	select {
+	case err := <-errCh:
+		if err == nil {
+			t.Error("Expected request to be cancelled")
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("Request not cancelled on shutdown")
+	}
+}
+
+func TestE2EIngressControllerPods(t *testing.T) {
+	f, consul := newE2E()
+	defer consul.Close()
+	defer f.stop()
+	f.ingress = true
+	f.ingressControllerNamespace = "kube-system"
+	f.ingressControllerPods = klabels.SelectorFromSet(klabels.Set{"app": "ingress"})
+	controllerPod := func(name string, nodeName string) *kapi.Pod {
+		return &kapi.Pod{
+			ObjectMeta: kapi.ObjectMeta{Namespace: "kube-system", Name: name, Labels: map[string]string{"app": "ingress"}},
+			Spec:       kapi.PodSpec{NodeName: nodeName},
+		}
+	}
+	if _, err := f.clientset.Core().Pods("kube-system").Create(controllerPod("ingress-1", "node-1")); err != nil {
+		t.Fatal(err)
+	}
+	ing := testIngress()
+	ing.Spec.TLS = nil
+	ing.Spec.Rules = ing.Spec.Rules[:1]
+	if _, err := f.clientset.Extensions().Ingresses("default").Create(ing); err != nil {
+		t.Fatal(err)
+	}
+	f.start(t)
+
+	// ingresses follow the nodes of the controller pods
+	ingressNodes := func(nodes ...string) func() bool {
+		return func() bool {
+			var act []string
+			for key := range consul.Services() {
+				if parts := strings.SplitN(key, "/", 2); strings.HasPrefix(parts[1], "www-example-com") {
+					act = append(act, parts[0])
+				}
+			}
+			sort.Strings(act)
+			return reflect.DeepEqual(nodes, act)
+		}
+	}
+	waitFor(t, "registration on node-1", ingressNodes("node-1"))
+	if _, err := f.clientset.Core().Pods("kube-system").Create(controllerPod("ingress-2", "node-2")); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "registration on node-2", ingressNodes("node-1", "node-2"))
+	if err := f.clientset.Core().Pods("kube-system").Delete("ingress-1", nil); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "deregistration from node-1", ingressNodes("node-2"))
+}
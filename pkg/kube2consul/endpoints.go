@@ -3,46 +3,47 @@ package kube2consul
 import (
 	"reflect"
 
-	log "github.com/Sirupsen/logrus"
 	kapi "k8s.io/kubernetes/pkg/api"
 	kcache "k8s.io/kubernetes/pkg/client/cache"
 	kframework "k8s.io/kubernetes/pkg/controller/framework"
-	kselector "k8s.io/kubernetes/pkg/fields"
+
+	"github.com/jetstack-experimental/kube2consul/pkg/service"
 )
 
-func (k *Kube2Consul) watchForEndpointss() kcache.Store {
-	endpointsStore, endpointsController := kframework.NewInformer(
-		kcache.NewListWatchFromClient(k.KubernetesClient(), "endpoints", kapi.NamespaceAll, kselector.Everything()),
-		&kapi.Endpoints{},
-		k.resyncPeriod,
-		kframework.ResourceEventHandlerFuncs{
-			AddFunc:    k.newEndpoints,
-			DeleteFunc: k.removeEndpoints,
-			UpdateFunc: k.updateEndpoints,
-		},
-	)
-	go endpointsController.Run(k.stopCh)
-	return endpointsStore
+func (k *Kube2Consul) watchForEndpoints() {
+	k.Informers().Endpoints().AddEventHandler(k.afterSync(kframework.ResourceEventHandlerFuncs{
+		AddFunc:    k.newEndpoints,
+		DeleteFunc: k.removeEndpoints,
+		UpdateFunc: k.updateEndpoints,
+	}))
 }
 
 func (k *Kube2Consul) newEndpoints(obj interface{}) {
 	if s, ok := obj.(*kapi.Endpoints); ok {
-		log.Debugf("add endpoints %s/%s", s.Namespace, s.Name)
+		serviceLog(s.Namespace, s.Name, "add").Debug("add endpoints")
 		k.registerEndpoints(s)
 	}
 }
 
 func (k *Kube2Consul) removeEndpoints(obj interface{}) {
+	if d, ok := obj.(kcache.DeletedFinalStateUnknown); ok {
+		obj = d.Obj
+	}
 	if s, ok := obj.(*kapi.Endpoints); ok {
-		log.Debugf("remove endpoints %s/%s", s.Namespace, s.Name)
-		k.registerEndpoints(nil)
+		serviceLog(s.Namespace, s.Name, "delete").Debug("remove endpoints")
+		// endpoints are usually removed along with their service
+		if svc := k.lookupService(s.Namespace, s.Name); svc != nil {
+			k.updateServiceEndpoints(svc, &kapi.Endpoints{ObjectMeta: s.ObjectMeta})
+		}
 	}
 }
 
 func (k *Kube2Consul) updateEndpoints(oldObj, obj interface{}) {
 	if s, ok := obj.(*kapi.Endpoints); ok && !reflect.DeepEqual(oldObj, obj) {
-		log.Debugf("update endpoints %s/%s", s.Namespace, s.Name)
-		k.registerEndpoints(s)
+		serviceLog(s.Namespace, s.Name, "update").Debug("update endpoints")
+		if svc := k.lookupService(s.Namespace, s.Name); svc != nil {
+			k.updateServiceEndpoints(svc, s)
+		}
 	}
 }
 
@@ -51,6 +52,14 @@ func (k *Kube2Consul) registerEndpoints(kendpoints *kapi.Endpoints) {
 		kendpoints.Namespace,
 		kendpoints.Name,
 	)
+	k.updateServiceEndpoints(svc, kendpoints)
+}
+
+// updateServiceEndpoints updates the registrations of a service after its
+// endpoints changed
+func (k *Kube2Consul) updateServiceEndpoints(svc *service.Service, kendpoints *kapi.Endpoints) {
 	svc.UpdateEndpoints(kendpoints)
-	svc.Update()
+	if err := svc.Update(); err != nil {
+		serviceLog(kendpoints.Namespace, kendpoints.Name, "update").Warnf("Error updating service: %s", err)
+	}
 }
@@ -0,0 +1,299 @@
+package kube2consul
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+
+	kapi "k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/apis/extensions"
+	kcache "k8s.io/kubernetes/pkg/client/cache"
+	kframework "k8s.io/kubernetes/pkg/controller/framework"
+
+	"github.com/jetstack-experimental/kube2consul/pkg/detect_node"
+	"github.com/jetstack-experimental/kube2consul/pkg/interfaces"
+	"github.com/jetstack-experimental/kube2consul/pkg/service"
+)
+
+// ingressName is passed to the ingress name template
+type ingressName struct {
+	Host      string
+	Namespace string
+	Name      string
+}
+
+func (k *Kube2Consul) watchForIngresses() {
+	k.Informers().Ingresses().AddEventHandler(k.afterSync(kframework.ResourceEventHandlerFuncs{
+		AddFunc:    k.newIngress,
+		DeleteFunc: k.removeIngress,
+		UpdateFunc: k.updateIngress,
+	}))
+	// ingresses are served from the nodes of the controller pods
+	if k.ingressControllerPods != nil {
+		k.Informers().SelectedPods(k.ingressControllerNamespace, k.ingressControllerPods).AddEventHandler(k.afterSync(kframework.ResourceEventHandlerFuncs{
+			AddFunc:    k.newIngressControllerPod,
+			DeleteFunc: k.removeIngressControllerPod,
+			UpdateFunc: k.updateIngressControllerPod,
+		}))
+	}
+}
+
+func (k *Kube2Consul) newIngressControllerPod(obj interface{}) {
+	if p, ok := obj.(*kapi.Pod); ok {
+		serviceLog(p.Namespace, p.Name, "add").Debug("add ingress controller pod")
+		k.registerIngresses()
+	}
+}
+
+func (k *Kube2Consul) removeIngressControllerPod(obj interface{}) {
+	if d, ok := obj.(kcache.DeletedFinalStateUnknown); ok {
+		obj = d.Obj
+	}
+	if p, ok := obj.(*kapi.Pod); ok {
+		serviceLog(p.Namespace, p.Name, "delete").Debug("remove ingress controller pod")
+		k.registerIngresses()
+	}
+}
+
+func (k *Kube2Consul) updateIngressControllerPod(oldObj, obj interface{}) {
+	oldPod, ok := oldObj.(*kapi.Pod)
+	if !ok {
+		return
+	}
+	// only the node of a pod is registered, ingresses are resynced on their
+	// own
+	if p, ok := obj.(*kapi.Pod); ok && p.Spec.NodeName != oldPod.Spec.NodeName {
+		serviceLog(p.Namespace, p.Name, "update").Debug("update ingress controller pod")
+		k.registerIngresses()
+	}
+}
+
+// registerIngresses re-registers all ingresses, e.g. after the ingress
+// controller pods changed
+func (k *Kube2Consul) registerIngresses() {
+	for _, obj := range k.Informers().Ingresses().GetStore().List() {
+		k.registerIngress(obj.(*extensions.Ingress))
+	}
+}
+
+func (k *Kube2Consul) newIngress(obj interface{}) {
+	if i, ok := obj.(*extensions.Ingress); ok {
+		serviceLog(i.Namespace, i.Name, "add").Debug("add ingress")
+		k.registerIngress(i)
+	}
+}
+
+func (k *Kube2Consul) removeIngress(obj interface{}) {
+	if d, ok := obj.(kcache.DeletedFinalStateUnknown); ok {
+		obj = d.Obj
+	}
+	if i, ok := obj.(*extensions.Ingress); ok {
+		serviceLog(i.Namespace, i.Name, "delete").Debug("remove ingress")
+		if err := k.updateOwned(service.IngressOwnerTag(i.Namespace, i.Name), i.CreationTimestamp.Time, nil, nil); err != nil {
+			serviceLog(i.Namespace, i.Name, "delete").Warnf("Error removing ingress: %s", err)
+		}
+	}
+}
+
+// updateIngress also handles resyncs, which pick up changed nodes of the
+// ingress controller pods
+func (k *Kube2Consul) updateIngress(oldObj, obj interface{}) {
+	if i, ok := obj.(*extensions.Ingress); ok {
+		serviceLog(i.Namespace, i.Name, "update").Debug("update ingress")
+		k.registerIngress(i)
+	}
+}
+
+func (k *Kube2Consul) registerIngress(ing *extensions.Ingress) {
+	endpoints, err := k.ingressEndpoints(k, k.cachedIngressControllerPods(), ing)
+	if err != nil {
+		serviceLog(ing.Namespace, ing.Name, "update").Warnf("Error listing ingress endpoints: %s", err)
+		return
+	}
+	reported := make(map[string]bool)
+	for _, endpoint := range endpoints {
+		if endpoint.OriginalName == "" || reported[endpoint.OriginalName] {
+			continue
+		}
+		reported[endpoint.OriginalName] = true
+		reason := service.ValidateName(endpoint.OriginalName)
+		serviceLog(ing.Namespace, ing.Name, "update").WithField("consul_service", endpoint.DnsLabel).Warnf("Invalid %s, registering as '%s'", reason, endpoint.DnsLabel)
+		k.EventRecorder().Eventf(ing, kapi.EventTypeWarning, service.InvalidNameReason, "Invalid %s, registering as '%s'", reason, endpoint.DnsLabel)
+	}
+	if err := k.updateOwned(service.IngressOwnerTag(ing.Namespace, ing.Name), ing.CreationTimestamp.Time, endpoints, nil); err != nil {
+		serviceLog(ing.Namespace, ing.Name, "update").Warnf("Error updating ingress: %s", err)
+	}
+}
+
+// ingressEndpoints returns one consul service per ingress host, registered
+// on port 80 and, if the host is covered by a TLS section, on port 443 of
+// every node the ingress is served from
+func (k *Kube2Consul) ingressEndpoints(k2c interfaces.Kube2Consul, controllerPods []*kapi.Pod, ing *extensions.Ingress) ([]interfaces.Endpoint, error) {
+	nodes, err := k.ingressNodes(k2c, controllerPods, ing)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsHosts := make(map[string]bool)
+	for _, tls := range ing.Spec.TLS {
+		for _, host := range tls.Hosts {
+			tlsHosts[host] = true
+		}
+	}
+
+	paths := make(map[string][]string)
+	for _, rule := range ing.Spec.Rules {
+		if rule.Host == "" {
+			continue
+		}
+		if _, ok := paths[rule.Host]; !ok {
+			paths[rule.Host] = []string{}
+		}
+		if rule.HTTP == nil {
+			continue
+		}
+		for _, path := range rule.HTTP.Paths {
+			p := path.Path
+			if p == "" {
+				p = "/"
+			}
+			paths[rule.Host] = append(paths[rule.Host], p)
+		}
+	}
+
+	hosts := make([]string, 0, len(paths))
+	for host := range paths {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+
+	var endpoints []interfaces.Endpoint
+	for _, host := range hosts {
+		original, err := k.ingressServiceName(ing, host)
+		if err != nil {
+			return nil, err
+		}
+		name := service.SanitizeName(original)
+		if name == original {
+			original = ""
+		}
+
+		tags := []string{service.IngressOwnerTag(ing.Namespace, ing.Name)}
+		for _, p := range paths[host] {
+			tags = append(tags, fmt.Sprintf("path=%s", p))
+		}
+
+		ports := map[int32]string{80: "http"}
+		if tlsHosts[host] {
+			ports[443] = "https"
+		}
+
+		for port, scheme := range ports {
+			for _, node := range nodes {
+				// load balancer addresses share the ingress node
+				id := fmt.Sprintf("%s-%s-%s-%d", name, ing.Namespace, ing.Name, port)
+				if node.Address != "" {
+					id = fmt.Sprintf("%s-%s", id, node.Address)
+				}
+				endpoints = append(endpoints, interfaces.Endpoint{
+					ID:           id,
+					DnsLabel:     name,
+					OriginalName: original,
+					NodeName:     node.NodeName,
+					NodeAddress:  node.NodeAddress,
+					Address:      node.Address,
+					NodePort:     port,
+					Tags:         append(append([]string{}, tags...), scheme),
+				})
+			}
+		}
+	}
+	return endpoints, nil
+}
+
+// ingressNodes returns the addresses an ingress is served on: the load
+// balancer addresses published in its status, registered on the ingress
+// node, or else the nodes running the ingress controller pods
+func (k *Kube2Consul) ingressNodes(k2c interfaces.Kube2Consul, controllerPods []*kapi.Pod, ing *extensions.Ingress) ([]interfaces.Endpoint, error) {
+	var nodes []interfaces.Endpoint
+	for _, lb := range ing.Status.LoadBalancer.Ingress {
+		address := lb.IP
+		if address == "" {
+			address = lb.Hostname
+		}
+		if address == "" {
+			continue
+		}
+		nodes = append(nodes, interfaces.Endpoint{
+			NodeName:    k.ingressNode,
+			NodeAddress: k.ingressNodeAddress,
+			Address:     address,
+		})
+	}
+	if len(nodes) > 0 {
+		return nodes, nil
+	}
+
+	seen := make(map[string]bool)
+	for _, pod := range controllerPods {
+		if pod.Spec.NodeName == "" || seen[pod.Spec.NodeName] {
+			continue
+		}
+		seen[pod.Spec.NodeName] = true
+
+		node, err := k2c.NodeByName(pod.Spec.NodeName)
+		if err != nil {
+			return nil, err
+		}
+		address, err := detect_node.NodeAddress(node)
+		if err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, interfaces.Endpoint{
+			NodeName:    node.Name,
+			NodeAddress: address,
+		})
+	}
+	sort.Sort(byNodeName(nodes))
+	return nodes, nil
+}
+
+// cachedIngressControllerPods returns the ingress controller pods from the
+// informer cache
+func (k *Kube2Consul) cachedIngressControllerPods() []*kapi.Pod {
+	if k.ingressControllerPods == nil {
+		return nil
+	}
+	var pods []*kapi.Pod
+	for _, obj := range k.Informers().SelectedPods(k.ingressControllerNamespace, k.ingressControllerPods).GetStore().List() {
+		pods = append(pods, obj.(*kapi.Pod))
+	}
+	return pods
+}
+
+// ingressServiceName returns the consul service name of an ingress host,
+// either derived from the host or from the ingress name template. It still
+// needs to be sanitized.
+func (k *Kube2Consul) ingressServiceName(ing *extensions.Ingress, host string) (string, error) {
+	name := strings.Replace(strings.Replace(host, "*", "wildcard", -1), ".", "-", -1)
+	if k.ingressTemplate != nil {
+		var buf bytes.Buffer
+		err := k.ingressTemplate.Execute(&buf, ingressName{
+			Host:      host,
+			Namespace: ing.Namespace,
+			Name:      ing.Name,
+		})
+		if err != nil {
+			return "", fmt.Errorf("error executing ingress name template: %s", err)
+		}
+		name = buf.String()
+	}
+	return name, nil
+}
+
+type byNodeName []interfaces.Endpoint
+
+func (e byNodeName) Len() int           { return len(e) }
+func (e byNodeName) Swap(i, j int)      { e[i], e[j] = e[j], e[i] }
+func (e byNodeName) Less(i, j int) bool { return e[i].NodeName < e[j].NodeName }
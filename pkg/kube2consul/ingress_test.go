@@ -0,0 +1,139 @@
+package kube2consul
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	kapi "k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/apis/extensions"
+
+	"github.com/jetstack-experimental/kube2consul/pkg/interfaces"
+)
+
+func testIngress() *extensions.Ingress {
+	return &extensions.Ingress{
+		ObjectMeta: kapi.ObjectMeta{Namespace: "default", Name: "web"},
+		Spec: extensions.IngressSpec{
+			TLS: []extensions.IngressTLS{{Hosts: []string{"secure.example.com"}}},
+			Rules: []extensions.IngressRule{
+				{Host: "www.example.com"},
+				{Host: "secure.example.com"},
+			},
+		},
+	}
+}
+
+// registered returns the ID, node, address and port of endpoints
+func registered(endpoints []interfaces.Endpoint) []string {
+	var list []string
+	for _, endpoint := range endpoints {
+		address := endpoint.Address
+		if address == "" {
+			address = endpoint.NodeAddress
+		}
+		list = append(list, fmt.Sprintf("%s %s %s:%d", endpoint.ServiceID(), endpoint.NodeName, address, endpoint.NodePort))
+	}
+	return list
+}
+
+func TestIngressEndpointsLoadBalancer(t *testing.T) {
+	k := New()
+	k.ingressNode = "ingress"
+	k.ingressNodeAddress = "127.0.0.1"
+
+	ing := testIngress()
+	ing.Spec.Rules = ing.Spec.Rules[:1]
+	ing.Status.LoadBalancer.Ingress = []kapi.LoadBalancerIngress{{IP: "1.2.3.4"}, {Hostname: "lb.example.com"}}
+	endpoints, err := k.ingressEndpoints(k, nil, ing)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// all addresses are registered on the ingress node
+	exp := []string{
+		"www-example-com-default-web-80-1.2.3.4 ingress 1.2.3.4:80",
+		"www-example-com-default-web-80-lb.example.com ingress lb.example.com:80",
+	}
+	if act := registered(endpoints); !reflect.DeepEqual(exp, act) {
+		t.Errorf("Registrations %v are not the expected %v", act, exp)
+	}
+	for _, endpoint := range endpoints {
+		if exp, act := "127.0.0.1", endpoint.NodeAddress; exp != act {
+			t.Errorf("Node address '%s' is not the expected '%s'", act, exp)
+		}
+	}
+}
+
+func TestIngressEndpointsControllerPods(t *testing.T) {
+	k := New()
+
+	nodes := []kapi.Node{
+		{
+			ObjectMeta: kapi.ObjectMeta{Name: "node-1"},
+			Status:     kapi.NodeStatus{Addresses: []kapi.NodeAddress{{Type: kapi.NodeInternalIP, Address: "10.0.0.1"}}},
+		},
+		{
+			ObjectMeta: kapi.ObjectMeta{Name: "node-2"},
+			Status:     kapi.NodeStatus{Addresses: []kapi.NodeAddress{{Type: kapi.NodeInternalIP, Address: "10.0.0.2"}}},
+		},
+	}
+	pods := []*kapi.Pod{
+		{Spec: kapi.PodSpec{NodeName: "node-2"}},
+		{Spec: kapi.PodSpec{NodeName: "node-1"}},
+		{Spec: kapi.PodSpec{NodeName: "node-2"}},
+		// not scheduled yet
+		{},
+	}
+	endpoints, err := k.ingressEndpoints(newSnapshot(k, nil, nodes), pods, testIngress())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// each node once, secure.example.com on port 443 as well
+	exp := map[string]bool{
+		"www-example-com-default-web-80 node-1 10.0.0.1:80":      true,
+		"www-example-com-default-web-80 node-2 10.0.0.2:80":      true,
+		"secure-example-com-default-web-80 node-1 10.0.0.1:80":   true,
+		"secure-example-com-default-web-80 node-2 10.0.0.2:80":   true,
+		"secure-example-com-default-web-443 node-1 10.0.0.1:443": true,
+		"secure-example-com-default-web-443 node-2 10.0.0.2:443": true,
+	}
+	act := make(map[string]bool)
+	for _, endpoint := range registered(endpoints) {
+		act[endpoint] = true
+	}
+	if !reflect.DeepEqual(exp, act) {
+		t.Errorf("Registrations %v are not the expected %v", act, exp)
+	}
+
+	// pods on unknown nodes fail the ingress
+	pods = append(pods, &kapi.Pod{Spec: kapi.PodSpec{NodeName: "node-3"}})
+	if _, err := k.ingressEndpoints(newSnapshot(k, nil, nodes), pods, testIngress()); err == nil {
+		t.Error("Expected error of unknown node")
+	}
+}
+
+func TestIngressNameTemplate(t *testing.T) {
+	k := New()
+	k.RootCmd.SetArgs([]string{"version", "--ingress-name-template", "{{.Namespace}}-{{.Name}}-{{.Host}}"})
+	if err := k.RootCmd.Execute(); err != nil {
+		t.Fatal(err)
+	}
+	name, err := k.ingressServiceName(testIngress(), "www.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp, act := "default-web-www.example.com", name; exp != act {
+		t.Errorf("Name '%s' is not the expected '%s'", act, exp)
+	}
+
+	// invalid templates are rejected by the flag validation
+	k = New()
+	k.RootCmd.SetArgs([]string{"version", "--ingress-name-template", "{{.Host"})
+	k.RootCmd.SilenceErrors = true
+	k.RootCmd.SilenceUsage = true
+	if err := k.RootCmd.Execute(); err == nil {
+		t.Error("Expected error of invalid template")
+	}
+}
@@ -1,24 +1,35 @@
 package kube2consul
 
 import (
+	"bufio"
+	"context"
 	"fmt"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"runtime"
 	"sync"
+	"syscall"
+	"text/template"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
 	consulapi "github.com/hashicorp/consul/api"
 	"github.com/spf13/cobra"
 	kapi "k8s.io/kubernetes/pkg/api"
-	kubernetes "k8s.io/kubernetes/pkg/client/clientset_generated/release_1_3"
+	kubernetes "k8s.io/kubernetes/pkg/client/clientset_generated/internalclientset"
+	krecord "k8s.io/kubernetes/pkg/client/record"
 	krest "k8s.io/kubernetes/pkg/client/restclient"
 	kclient "k8s.io/kubernetes/pkg/client/unversioned"
 	kclientcmd "k8s.io/kubernetes/pkg/client/unversioned/clientcmd"
+	kframework "k8s.io/kubernetes/pkg/controller/framework"
+	klabels "k8s.io/kubernetes/pkg/labels"
 
 	"github.com/jetstack-experimental/kube2consul/pkg/detect_node"
+	"github.com/jetstack-experimental/kube2consul/pkg/informers"
 	"github.com/jetstack-experimental/kube2consul/pkg/interfaces"
+	"github.com/jetstack-experimental/kube2consul/pkg/logging"
+	"github.com/jetstack-experimental/kube2consul/pkg/metrics"
 	"github.com/jetstack-experimental/kube2consul/pkg/service"
 )
 
@@ -27,21 +38,106 @@ var AppName string = "kube2consul"
 
 type Kube2Consul struct {
 	RootCmd             *cobra.Command
-	kubernetesClient    *kclient.Client
-	kubernetesClientset *kubernetes.Clientset
+	kubernetesClient    kclient.Interface
+	kubernetesClientset kubernetes.Interface
 	kubernetesConfig    *krest.Config
+	eventRecorder       krecord.EventRecorder
+	eventRecorderLock   sync.Mutex
 	Kubeconfig          string
-	consulClient        *consulapi.Client
-	consulCatalog       *consulapi.Catalog
 	consulAddress       string
+	consulToken         string
+	consulDatacenter    string
+	consulTLS           consulapi.TLSConfig
+	consulQPS           float64
+	consulBurst         int
+	consulTimeout       time.Duration
+	kubernetesQPS       float32
+	kubernetesBurst     int
+	kubernetesTimeout   time.Duration
+	configFile          string
+	logLevel            string
+	logFormat           string
+	logSampleLimit      int
 	detectNode          *detect_node.DetectNode
 	resyncPeriod        time.Duration
 
+	namespace      string
+	selector       string
+	clusterName    string
+	kvPrefix       string
+	serviceOptions interfaces.ServiceOptions
+
+	ingress                    bool
+	ingressNameTemplate        string
+	ingressControllerSelector  string
+	ingressControllerNamespace string
+	ingressNode                string
+	ingressNodeAddress         string
+	// parsed from the flags above, nil if not given
+	ingressTemplate       *template.Template
+	ingressControllerPods klabels.Selector
+
+	syncNodes bool
+	// interval of deregistering empty nodes created by kube2consul
+	nodeCleanupInterval time.Duration
+	nodeMetaLabels      []string
+	nodes               map[string]*consulapi.CatalogRegistration
+	maintenance         map[string]string
+	nodesLock           sync.Mutex
+
+	// namespaces whose services are waiting to be re-registered
+	pendingUpdates     map[string]bool
+	pendingUpdatesLock sync.Mutex
+	updatesSignal      chan struct{}
+
+	registryName string
+	targetSpecs  []string
+	targets      []*consulTarget
+	targetsLock  sync.Mutex
+	// writes are queued per target once running
+	queueWrites bool
+
+	routeSpecs       []string
+	routes           []consulRoute
+	routeAnnotations bool
+	// consul locations services have been routed to
+	locations     map[interfaces.Location]bool
+	locationsLock sync.Mutex
+
+	dryRun         bool
+	metricsAddress string
+	listOutput     string
+	purgeService   string
+	purgeYes       bool
+	// answers to confirmation prompts, shared by all prompts so buffered
+	// answers aren't lost
+	stdin *bufio.Reader
+
 	services     map[string]*service.Service
 	servicesLock sync.Mutex
 
+	conflictPolicy string
+	// consul service names requested by services and ingresses
+	claims     *nameClaims
+	claimsLock sync.Mutex
+	// conflicts last reported by owner tag
+	reportedConflicts map[string]string
+
+	watchConsul bool
+	// last registrations passed to updateOwned by owner tag
+	desired     map[string][]interfaces.Endpoint
+	desiredLock sync.Mutex
+
+	informers     *informers.SharedInformerFactory
+	informersLock sync.Mutex
+	// closed once the informer caches are synced
+	cacheSynced chan struct{}
+
 	// stop channel for shutting down
-	stopCh chan struct{}
+	stopCh   chan struct{}
+	stopOnce sync.Once
+	// cancelled on shutdown, aborting pending API calls
+	ctx context.Context
 
 	// wait group
 	waitGroup sync.WaitGroup
@@ -51,11 +147,28 @@ var _ interfaces.Kube2Consul = &Kube2Consul{}
 
 func New() *Kube2Consul {
 	k := &Kube2Consul{
-		resyncPeriod: 5 * time.Minute,
-		stopCh:       make(chan struct{}),
-		waitGroup:    sync.WaitGroup{},
-		services:     make(map[string]*service.Service),
+		stopCh:      make(chan struct{}),
+		cacheSynced: make(chan struct{}),
+		waitGroup:   sync.WaitGroup{},
+		services:    make(map[string]*service.Service),
+		desired:     make(map[string][]interfaces.Endpoint),
+		nodes:       make(map[string]*consulapi.CatalogRegistration),
+		maintenance: make(map[string]string),
+		locations:   make(map[interfaces.Location]bool),
+
+		stdin:          bufio.NewReader(os.Stdin),
+		pendingUpdates: make(map[string]bool),
+		updatesSignal:  make(chan struct{}, 1),
+
+		claims:            newNameClaims(),
+		reportedConflicts: make(map[string]string),
 	}
+	var cancel context.CancelFunc
+	k.ctx, cancel = context.WithCancel(context.Background())
+	go func() {
+		<-k.stopCh
+		cancel()
+	}()
 	k.init()
 	return k
 }
@@ -71,6 +184,22 @@ func (k *Kube2Consul) userHomeDir() string {
 	return os.Getenv("HOME")
 }
 
+func (k *Kube2Consul) ServiceOptions() *interfaces.ServiceOptions {
+	return &k.serviceOptions
+}
+
+func (k *Kube2Consul) NodeLister() interfaces.NodeLister {
+	return k.Informers().NodeLister()
+}
+
+func (k *Kube2Consul) PodLister() interfaces.PodLister {
+	return k.Informers().PodLister()
+}
+
+func (k *Kube2Consul) NodeByName(nodeName string) (*kapi.Node, error) {
+	return k.detectNode.NodeByName(nodeName)
+}
+
 func (k *Kube2Consul) NodeIPByPodIP(podIP string) (nodeIP string, err error) {
 	return k.detectNode.NodeIPByPodIP(podIP)
 }
@@ -82,7 +211,6 @@ func (k *Kube2Consul) NodeNameByPodIP(podIP string) (nodeName string, err error)
 func (k *Kube2Consul) init() {
 
 	log.SetOutput(os.Stderr)
-	log.SetLevel(log.DebugLevel)
 
 	k.RootCmd = &cobra.Command{
 		Use:   "kube2consul",
@@ -90,7 +218,79 @@ func (k *Kube2Consul) init() {
 		Run: func(cmd *cobra.Command, args []string) {
 			k.cmdRun()
 		},
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			if err := k.loadConfig(cmd); err != nil {
+				return err
+			}
+			if err := logging.Setup(k.logLevel, k.logFormat); err != nil {
+				return err
+			}
+			logging.SetSampleLimit(k.logSampleLimit)
+			switch k.serviceOptions.TagFormat {
+			case interfaces.TagFormatKeyValue, interfaces.TagFormatValue:
+			default:
+				return fmt.Errorf("unknown tag format '%s'", k.serviceOptions.TagFormat)
+			}
+			switch k.registryName {
+			case RegistryConsul, RegistryMemory:
+			default:
+				return fmt.Errorf("unknown registry '%s'", k.registryName)
+			}
+			if k.registryName != RegistryConsul && (k.kvPrefix != "" || k.syncNodes || k.serviceOptions.NodeMaintenance == interfaces.NodeMaintenanceCheck) {
+				return fmt.Errorf("--kv-prefix, --sync-nodes and --node-maintenance=check require the consul registry")
+			}
+			switch k.serviceOptions.NodeMaintenance {
+			case interfaces.NodeMaintenanceOff, interfaces.NodeMaintenanceCheck, interfaces.NodeMaintenanceWithdraw:
+			default:
+				return fmt.Errorf("unknown node maintenance mode '%s'", k.serviceOptions.NodeMaintenance)
+			}
+			switch k.conflictPolicy {
+			case ConflictPolicyOldest, ConflictPolicyRefuse, ConflictPolicyMerge:
+			default:
+				return fmt.Errorf("unknown name conflict policy '%s'", k.conflictPolicy)
+			}
+			if k.ingressNameTemplate != "" {
+				tmpl, err := template.New("ingress").Parse(k.ingressNameTemplate)
+				if err != nil {
+					return fmt.Errorf("invalid ingress name template: %s", err)
+				}
+				k.ingressTemplate = tmpl
+			}
+			if k.ingressControllerSelector != "" {
+				selector, err := klabels.Parse(k.ingressControllerSelector)
+				if err != nil {
+					return fmt.Errorf("invalid ingress controller selector '%s': %s", k.ingressControllerSelector, err)
+				}
+				k.ingressControllerPods = selector
+			}
+			if k.consulQPS > 0 && k.consulBurst < 1 {
+				return fmt.Errorf("--consul-burst must be at least 1 if --consul-qps is set")
+			}
+			if k.kubernetesQPS > 0 && k.kubernetesBurst < 1 {
+				return fmt.Errorf("--kube-api-burst must be at least 1 if --kube-api-qps is set")
+			}
+			targets, err := k.newConsulTargets()
+			if err != nil {
+				return err
+			}
+			k.targets = targets
+			for _, spec := range k.routeSpecs {
+				route, err := parseRoute(spec)
+				if err != nil {
+					return err
+				}
+				k.routes = append(k.routes, route)
+			}
+			return nil
+		},
 	}
+	k.RootCmd.PersistentFlags().StringVar(
+		&k.configFile,
+		"config",
+		"",
+		"path to a YAML or JSON config file",
+	)
+
 	k.RootCmd.PersistentFlags().StringVarP(
 		&k.Kubeconfig,
 		"kubeconfig",
@@ -101,10 +301,332 @@ func (k *Kube2Consul) init() {
 
 	k.RootCmd.PersistentFlags().StringVarP(
 		&k.consulAddress,
-		"consoul-address",
+		"consul-address",
 		"c",
 		"localhost:8500",
-		"consoul server address",
+		"consul server address",
+	)
+
+	k.RootCmd.PersistentFlags().StringVar(
+		&k.consulAddress,
+		"consoul-address",
+		"localhost:8500",
+		"consul server address",
+	)
+	k.RootCmd.PersistentFlags().MarkDeprecated("consoul-address", "use --consul-address instead")
+
+	k.RootCmd.PersistentFlags().StringVar(
+		&k.consulToken,
+		"consul-token",
+		"",
+		"ACL token used for requests to consul",
+	)
+
+	k.RootCmd.PersistentFlags().StringVar(
+		&k.consulDatacenter,
+		"consul-datacenter",
+		"",
+		"consul datacenter to register services in, defaults to the datacenter of the agent",
+	)
+
+	k.RootCmd.PersistentFlags().StringVar(
+		&k.consulTLS.CAFile,
+		"consul-ca-file",
+		"",
+		"CA certificate to verify the consul server with",
+	)
+
+	k.RootCmd.PersistentFlags().StringVar(
+		&k.consulTLS.CertFile,
+		"consul-cert-file",
+		"",
+		"client certificate for TLS connections to consul",
+	)
+
+	k.RootCmd.PersistentFlags().StringVar(
+		&k.consulTLS.KeyFile,
+		"consul-key-file",
+		"",
+		"client key for TLS connections to consul",
+	)
+
+	k.RootCmd.PersistentFlags().BoolVar(
+		&k.consulTLS.InsecureSkipVerify,
+		"consul-tls-skip-verify",
+		false,
+		"do not verify the certificate of the consul server",
+	)
+
+	k.RootCmd.PersistentFlags().Float64Var(
+		&k.consulQPS,
+		"consul-qps",
+		100,
+		"maximum requests per second to each consul target, 0 disables the limit",
+	)
+
+	k.RootCmd.PersistentFlags().IntVar(
+		&k.consulBurst,
+		"consul-burst",
+		200,
+		"maximum burst of requests to each consul target",
+	)
+
+	k.RootCmd.PersistentFlags().DurationVar(
+		&k.consulTimeout,
+		"consul-timeout",
+		30*time.Second,
+		"timeout of requests to consul, blocking queries get their wait time added, 0 disables it",
+	)
+
+	k.RootCmd.PersistentFlags().Float32Var(
+		&k.kubernetesQPS,
+		"kube-api-qps",
+		5,
+		"maximum requests per second to the kubernetes API, 0 disables the limit",
+	)
+
+	k.RootCmd.PersistentFlags().IntVar(
+		&k.kubernetesBurst,
+		"kube-api-burst",
+		10,
+		"maximum burst of requests to the kubernetes API",
+	)
+
+	k.RootCmd.PersistentFlags().DurationVar(
+		&k.kubernetesTimeout,
+		"kube-api-timeout",
+		30*time.Second,
+		"timeout of requests to the kubernetes API except watches, 0 disables it",
+	)
+
+	k.RootCmd.PersistentFlags().StringArrayVar(
+		&k.targetSpecs,
+		"consul-target",
+		[]string{},
+		"additional consul target to register services in, as comma separated key=value pairs of name, address, datacenter, token-file, ca-file, cert-file, key-file and tls-skip-verify, can be repeated",
+	)
+
+	k.RootCmd.PersistentFlags().StringArrayVar(
+		&k.routeSpecs,
+		"consul-route",
+		[]string{},
+		"route services of kubernetes namespaces to a consul location, as comma separated key=value pairs of namespaces (ending with '*' to match by prefix), datacenter, namespace and partition, can be repeated",
+	)
+
+	k.RootCmd.PersistentFlags().BoolVar(
+		&k.routeAnnotations,
+		"consul-route-annotations",
+		false,
+		"route services by the "+ConsulDatacenterAnnotation+", "+ConsulNamespaceAnnotation+" and "+ConsulPartitionAnnotation+" annotations of their kubernetes namespace",
+	)
+
+	k.RootCmd.PersistentFlags().StringVar(
+		&k.logLevel,
+		"log-level",
+		"info",
+		"log level: debug, info, warning or error",
+	)
+
+	k.RootCmd.PersistentFlags().StringVar(
+		&k.logFormat,
+		"log-format",
+		logging.FormatText,
+		"log format: text or json",
+	)
+
+	k.RootCmd.PersistentFlags().IntVar(
+		&k.logSampleLimit,
+		"log-sample-limit",
+		0,
+		"maximum number of identical warnings logged per minute, 0 logs all",
+	)
+
+	k.RootCmd.PersistentFlags().StringVarP(
+		&k.namespace,
+		"namespace",
+		"n",
+		kapi.NamespaceAll,
+		"only export services in this namespace",
+	)
+
+	k.RootCmd.PersistentFlags().StringVarP(
+		&k.selector,
+		"selector",
+		"l",
+		"",
+		"only export services matching this label selector",
+	)
+
+	k.RootCmd.PersistentFlags().StringVar(
+		&k.clusterName,
+		"cluster-name",
+		"",
+		"name of the kubernetes cluster, used to tell apart registrations of multiple clusters",
+	)
+
+	k.RootCmd.PersistentFlags().StringVar(
+		&k.registryName,
+		"registry",
+		RegistryConsul,
+		"registry backend services are registered in: consul or memory",
+	)
+
+	k.RootCmd.PersistentFlags().BoolVar(
+		&k.dryRun,
+		"dry-run",
+		false,
+		"only log and count the changes that would be made to consul",
+	)
+
+	k.RootCmd.PersistentFlags().DurationVar(
+		&k.resyncPeriod,
+		"resync-period",
+		5*time.Minute,
+		"interval of full resyncs of the kubernetes watches",
+	)
+
+	k.RootCmd.Flags().BoolVar(
+		&k.watchConsul,
+		"watch-consul",
+		true,
+		"watch consul for changes to registrations made by kube2consul and restore them",
+	)
+
+	k.RootCmd.Flags().StringVar(
+		&k.metricsAddress,
+		"metrics-address",
+		":9500",
+		"address to expose prometheus metrics on, empty to disable",
+	)
+
+	k.RootCmd.PersistentFlags().StringVar(
+		&k.kvPrefix,
+		"kv-prefix",
+		"",
+		"export service metadata as JSON documents below this consul KV prefix, empty to disable",
+	)
+
+	k.RootCmd.PersistentFlags().StringSliceVar(
+		&k.serviceOptions.LabelTags,
+		"label-tags",
+		[]string{},
+		"service labels to add as consul tags, entries ending with '*' match by prefix",
+	)
+
+	k.RootCmd.PersistentFlags().StringSliceVar(
+		&k.serviceOptions.AnnotationTags,
+		"annotation-tags",
+		[]string{},
+		"service annotations to add as consul tags, entries ending with '*' match by prefix",
+	)
+
+	k.RootCmd.PersistentFlags().StringVar(
+		&k.serviceOptions.TagFormat,
+		"tag-format",
+		interfaces.TagFormatKeyValue,
+		"format of tags created from labels and annotations: key-value or value",
+	)
+
+	k.RootCmd.PersistentFlags().StringSliceVar(
+		&k.serviceOptions.LabelMeta,
+		"label-meta",
+		[]string{},
+		"service labels to add as consul service meta data, entries ending with '*' match by prefix",
+	)
+
+	k.RootCmd.PersistentFlags().StringSliceVar(
+		&k.serviceOptions.AnnotationMeta,
+		"annotation-meta",
+		[]string{},
+		"service annotations to add as consul service meta data, entries ending with '*' match by prefix",
+	)
+
+	k.RootCmd.PersistentFlags().BoolVar(
+		&k.ingress,
+		"ingress",
+		false,
+		"register the hosts of ingress resources as consul services",
+	)
+
+	k.RootCmd.PersistentFlags().StringVar(
+		&k.ingressNameTemplate,
+		"ingress-name-template",
+		"",
+		"template of the consul service name of ingress hosts, e.g. '{{.Namespace}}-{{.Name}}', defaults to the host",
+	)
+
+	k.RootCmd.PersistentFlags().StringVar(
+		&k.ingressControllerSelector,
+		"ingress-controller-selector",
+		"",
+		"label selector of the ingress controller pods, used if an ingress has no load balancer address",
+	)
+
+	k.RootCmd.PersistentFlags().StringVar(
+		&k.ingressControllerNamespace,
+		"ingress-controller-namespace",
+		kapi.NamespaceAll,
+		"namespace of the ingress controller pods",
+	)
+
+	k.RootCmd.PersistentFlags().StringVar(
+		&k.ingressNode,
+		"ingress-node",
+		"kubernetes-ingress",
+		"consul node to register hosts of ingresses with a load balancer address on, the services carry that address",
+	)
+
+	k.RootCmd.PersistentFlags().StringVar(
+		&k.ingressNodeAddress,
+		"ingress-node-address",
+		"127.0.0.1",
+		"address of the consul node given by --ingress-node",
+	)
+
+	k.RootCmd.PersistentFlags().BoolVar(
+		&k.syncNodes,
+		"sync-nodes",
+		false,
+		"register all kubernetes nodes in consul with node meta data and a readiness check",
+	)
+
+	k.RootCmd.PersistentFlags().DurationVar(
+		&k.nodeCleanupInterval,
+		"node-cleanup-interval",
+		5*time.Minute,
+		"interval of deregistering empty consul nodes created by kube2consul whose kubernetes node is gone, 0 disables it",
+	)
+
+	k.RootCmd.PersistentFlags().StringSliceVar(
+		&k.nodeMetaLabels,
+		"node-meta-labels",
+		[]string{
+			"failure-domain.beta.kubernetes.io/zone",
+			"failure-domain.beta.kubernetes.io/region",
+			"beta.kubernetes.io/instance-type",
+		},
+		"node labels to add as consul node meta data, entries ending with '*' match by prefix",
+	)
+
+	k.RootCmd.PersistentFlags().StringVar(
+		&k.serviceOptions.NodeMaintenance,
+		"node-maintenance",
+		interfaces.NodeMaintenanceOff,
+		"handling of cordoned nodes and nodes annotated with "+service.MaintenanceAnnotation+": off, check or withdraw",
+	)
+
+	k.RootCmd.PersistentFlags().StringVar(
+		&k.conflictPolicy,
+		"name-conflict-policy",
+		ConflictPolicyOldest,
+		"handling of consul service names requested by several services or ingresses: oldest, refuse or merge",
+	)
+
+	k.RootCmd.PersistentFlags().StringVar(
+		&k.serviceOptions.MaintenanceReason,
+		"maintenance-reason",
+		service.DefaultMaintenanceReason,
+		"reason of services annotated with "+service.MaintenanceAnnotation+" without a reason",
 	)
 
 	versionCmd := &cobra.Command{
@@ -116,56 +638,176 @@ func (k *Kube2Consul) init() {
 	}
 
 	listCmd := &cobra.Command{
-		Use:   "list",
-		Short: "List servicecs that whould have been registered in consul",
-		Run: func(cmd *cobra.Command, args []string) {
-			k.cmdList()
+		Use:          "list",
+		Short:        "List servicecs that whould have been registered in consul",
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return k.cmdList()
+		},
+	}
+	listCmd.Flags().StringVarP(
+		&k.listOutput,
+		"output",
+		"o",
+		outputTable,
+		"output format: table, wide, json or yaml",
+	)
+
+	syncCmd := &cobra.Command{
+		Use:          "sync",
+		Short:        "Register all services in consul once, remove stale registrations and exit",
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return k.cmdSync()
 		},
 	}
 
 	k.RootCmd.AddCommand(versionCmd)
 	k.RootCmd.AddCommand(listCmd)
 
+	purgeCmd := &cobra.Command{
+		Use:          "purge",
+		Short:        "Remove all registrations made by kube2consul from consul",
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return k.cmdPurge()
+		},
+	}
+	purgeCmd.Flags().StringVar(
+		&k.purgeService,
+		"service",
+		"",
+		"only remove registrations of this service, requires --namespace",
+	)
+	purgeCmd.Flags().BoolVarP(
+		&k.purgeYes,
+		"yes",
+		"y",
+		false,
+		"do not ask for confirmation",
+	)
+
+	k.RootCmd.AddCommand(syncCmd)
+	k.RootCmd.AddCommand(purgeCmd)
+
 	k.detectNode = detect_node.New(k)
 
 }
 
-func (k *Kube2Consul) cmdList() {
-	svcs, err := k.KubernetesClient().Services(kapi.NamespaceAll).List(kapi.ListOptions{})
-
+func (k *Kube2Consul) labelSelector() (klabels.Selector, error) {
+	selector, err := klabels.Parse(k.selector)
 	if err != nil {
-		log.Warnf("Error getting services: %s", err)
+		return nil, fmt.Errorf("invalid selector '%s': %s", k.selector, err)
 	}
+	return selector, nil
+}
 
-	for _, svc := range svcs.Items {
-		if kapi.ServiceType(svc.Spec.Type) == kapi.ServiceTypeNodePort {
-			endpoints, err := k.KubernetesClient().Endpoints(svc.Namespace).Get(svc.Name)
-			if err != nil {
-				log.Warnf(
-					"Error getting endpoints for %s/%s: %s",
-					svc.Namespace,
-					svc.Name,
-					err,
-				)
-				continue
-			}
+func (k *Kube2Consul) cmdRun() {
+	if k.dryRun {
+		log.Warn("Running in dry-run mode, no changes will be made to consul")
+	}
+	if k.metricsAddress != "" {
+		if _, err := metrics.Serve(k.metricsAddress); err != nil {
+			log.Fatalf("Error serving metrics: %s", err)
+		}
+	}
+	if err := k.start(); err != nil {
+		log.Fatal(err)
+	}
 
-			s := service.New(k, svc.Namespace, svc.Name)
-			s.UpdateService(&svc)
-			s.UpdateEndpoints(endpoints)
-			list := s.List()
-			for _, elem := range list {
-				fmt.Printf("%+v\n", elem)
-			}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	log.Infof("Received %s, shutting down", <-signals)
+	k.stop()
+}
+
+// start registers the event handlers, starts writing to the consul targets
+// and blocks until the informer caches are synced
+func (k *Kube2Consul) start() error {
+	if _, err := k.labelSelector(); err != nil {
+		return err
+	}
+	k.watchForServices()
+	k.watchForEndpoints()
+	if k.ingress {
+		k.watchForIngresses()
+	}
+	if k.syncNodes || k.serviceOptions.NodeMaintenance != interfaces.NodeMaintenanceOff {
+		k.watchForNodes()
+	}
+	if k.routeAnnotations {
+		k.watchForNamespaces()
+	}
+	go k.runServiceUpdates()
+	k.startConsulTargets()
+	return k.startInformers()
+}
+
+// stop shuts down the watches and cancels pending API calls
+func (k *Kube2Consul) stop() {
+	k.stopOnce.Do(func() {
+		close(k.stopCh)
+	})
+}
+
+// Informers returns the shared informers of all watched types
+func (k *Kube2Consul) Informers() *informers.SharedInformerFactory {
+	k.informersLock.Lock()
+	defer k.informersLock.Unlock()
 
+	if k.informers == nil {
+		selector, err := k.labelSelector()
+		if err != nil {
+			panic(err.Error())
 		}
+		k.informers = informers.NewSharedInformerFactory(
+			k.KubernetesClientset(),
+			k.namespace,
+			selector,
+			k.resyncPeriod,
+		)
 	}
+	return k.informers
 }
 
-func (k *Kube2Consul) cmdRun() {
-	k.watchForServices()
-	k.watchForEndpointss()
-	select {}
+// startInformers starts the informers including those backing the pod and
+// node listers and blocks until their caches are synced. Event handlers
+// registered through afterSync are held back until then, so they never see
+// a partial cache.
+func (k *Kube2Consul) startInformers() error {
+	k.Informers().Pods()
+	k.Informers().Nodes()
+	if k.routeAnnotations {
+		k.Informers().Namespaces()
+	}
+	k.Informers().Start(k.stopCh)
+
+	log.Debug("Waiting for informer caches to sync")
+	if !k.Informers().WaitForCacheSync(k.stopCh) {
+		return fmt.Errorf("stopped before informer caches synced")
+	}
+	log.Debug("Informer caches synced")
+	close(k.cacheSynced)
+	return nil
+}
+
+// afterSync delays the handling of events until the informer caches are
+// synced
+func (k *Kube2Consul) afterSync(h kframework.ResourceEventHandlerFuncs) kframework.ResourceEventHandlerFuncs {
+	return kframework.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			<-k.cacheSynced
+			h.OnAdd(obj)
+		},
+		UpdateFunc: func(oldObj, obj interface{}) {
+			<-k.cacheSynced
+			h.OnUpdate(oldObj, obj)
+		},
+		DeleteFunc: func(obj interface{}) {
+			<-k.cacheSynced
+			h.OnDelete(obj)
+		},
+	}
 }
 
 func (k *Kube2Consul) KubernetesConfig() *krest.Config {
@@ -181,12 +823,16 @@ func (k *Kube2Consul) KubernetesConfig() *krest.Config {
 				panic(err.Error())
 			}
 		}
+		config.QPS = k.kubernetesQPS
+		config.Burst = k.kubernetesBurst
+		config.RateLimiter = k.kubernetesRateLimiter()
+		config.WrapTransport = k.kubernetesTransport
 		k.kubernetesConfig = config
 	}
 	return k.kubernetesConfig
 }
 
-func (k *Kube2Consul) KubernetesClient() *kclient.Client {
+func (k *Kube2Consul) KubernetesClient() kclient.Interface {
 	if k.kubernetesClient == nil {
 		client, err := kclient.New(k.KubernetesConfig())
 		if err != nil {
@@ -197,7 +843,7 @@ func (k *Kube2Consul) KubernetesClient() *kclient.Client {
 	return k.kubernetesClient
 }
 
-func (k *Kube2Consul) KubernetesClientset() *kubernetes.Clientset {
+func (k *Kube2Consul) KubernetesClientset() kubernetes.Interface {
 	if k.kubernetesClientset == nil {
 		clientset, err := kubernetes.NewForConfig(k.KubernetesConfig())
 		if err != nil {
@@ -208,6 +854,36 @@ func (k *Kube2Consul) KubernetesClientset() *kubernetes.Clientset {
 	return k.kubernetesClientset
 }
 
+// EventRecorder returns a recorder for events about kubernetes objects
+func (k *Kube2Consul) EventRecorder() krecord.EventRecorder {
+	k.eventRecorderLock.Lock()
+	defer k.eventRecorderLock.Unlock()
+
+	if k.eventRecorder == nil {
+		broadcaster := krecord.NewBroadcaster()
+		broadcaster.StartRecordingToSink(&eventSink{client: k.KubernetesClientset()})
+		k.eventRecorder = broadcaster.NewRecorder(kapi.EventSource{Component: AppName})
+	}
+	return k.eventRecorder
+}
+
+// eventSink writes events through the clientset
+type eventSink struct {
+	client kubernetes.Interface
+}
+
+func (s *eventSink) Create(event *kapi.Event) (*kapi.Event, error) {
+	return s.client.Core().Events(event.Namespace).Create(event)
+}
+
+func (s *eventSink) Update(event *kapi.Event) (*kapi.Event, error) {
+	return s.client.Core().Events(event.Namespace).Update(event)
+}
+
+func (s *eventSink) Patch(event *kapi.Event, data []byte) (*kapi.Event, error) {
+	return s.client.Core().Events(event.Namespace).Patch(event.Name, kapi.StrategicMergePatchType, data)
+}
+
 func (k *Kube2Consul) getOrCreateService(namespace string, name string) *service.Service {
 	key := fmt.Sprintf("%s/%s", namespace, name)
 
@@ -224,3 +900,28 @@ func (k *Kube2Consul) getOrCreateService(namespace string, name string) *service
 	k.services[key] = svc
 	return svc
 }
+
+// lookupService returns the service known by namespace and name, or nil, so
+// events following the deletion of a service don't recreate it
+func (k *Kube2Consul) lookupService(namespace string, name string) *service.Service {
+	k.servicesLock.Lock()
+	defer k.servicesLock.Unlock()
+	return k.services[fmt.Sprintf("%s/%s", namespace, name)]
+}
+
+func (k *Kube2Consul) deleteService(namespace string, name string) *service.Service {
+	key := fmt.Sprintf("%s/%s", namespace, name)
+
+	k.servicesLock.Lock()
+	defer k.servicesLock.Unlock()
+	svc, ok := k.services[key]
+	if !ok {
+		svc = service.New(
+			k,
+			namespace,
+			name,
+		)
+	}
+	delete(k.services, key)
+	return svc
+}
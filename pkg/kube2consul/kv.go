@@ -0,0 +1,219 @@
+package kube2consul
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	consulapi "github.com/hashicorp/consul/api"
+
+	"github.com/jetstack-experimental/kube2consul/pkg/interfaces"
+	"github.com/jetstack-experimental/kube2consul/pkg/metrics"
+	"github.com/jetstack-experimental/kube2consul/pkg/registry/consul"
+)
+
+// maxTxnOps is the maximum number of operations consul accepts in a single
+// transaction
+const maxTxnOps = 64
+
+// metadataPrefix returns the KV prefix of all metadata documents in scope of
+// namespace, which may be kapi.NamespaceAll
+func (k *Kube2Consul) metadataPrefix(namespace string) string {
+	parts := []string{strings.Trim(k.kvPrefix, "/")}
+	if k.clusterName != "" {
+		parts = append(parts, k.clusterName)
+	}
+	if namespace != "" {
+		parts = append(parts, namespace)
+	}
+	return path.Join(parts...) + "/"
+}
+
+func (k *Kube2Consul) metadataKey(namespace string, name string) string {
+	return k.metadataPrefix(namespace) + name
+}
+
+// metadataOps returns the KV operations writing the metadata document of a
+// service, or deleting it if metadata is nil
+func (k *Kube2Consul) metadataOps(namespace string, name string, metadata *interfaces.ServiceMetadata) consulapi.TxnOps {
+	key := k.metadataKey(namespace, name)
+	if metadata == nil {
+		return consulapi.TxnOps{{
+			KV: &consulapi.KVTxnOp{Verb: consulapi.KVDelete, Key: key},
+		}}
+	}
+
+	value, err := json.Marshal(metadata)
+	if err != nil {
+		serviceLog(namespace, name, "kv_set").Warnf("Error encoding metadata: %s", err)
+		return nil
+	}
+	return consulapi.TxnOps{{
+		KV: &consulapi.KVTxnOp{Verb: consulapi.KVSet, Key: key, Value: value},
+	}}
+}
+
+// txnOps returns the operations executing a plan in a consul registry
+// together with additional KV operations in a transaction
+func txnOps(registry *consul.Registry, p *syncPlan, kvOps consulapi.TxnOps) (consulapi.TxnOps, error) {
+	ops := append(consulapi.TxnOps{}, kvOps...)
+	for _, endpoint := range p.register {
+		registerOps, err := registry.RegisterOps(endpoint)
+		if err != nil {
+			return nil, err
+		}
+		ops = append(ops, registerOps...)
+	}
+	for _, endpoint := range p.clearMaintenance {
+		healthOps, err := registry.UpdateHealthOps(endpoint)
+		if err != nil {
+			return nil, err
+		}
+		ops = append(ops, healthOps...)
+	}
+	for _, endpoint := range p.deregister {
+		ops = append(ops, registry.DeregisterOps(endpoint)...)
+	}
+	return ops, nil
+}
+
+// applyTxn applies the operations of a plan in a single transaction, which
+// consul limits to maxTxnOps operations
+func (t *consulTarget) applyTxn(p *syncPlan, ops consulapi.TxnOps) *syncResult {
+	result := &syncResult{Unchanged: p.unchanged}
+	if len(ops) > maxTxnOps {
+		result.Errors = append(result.Errors, fmt.Errorf("transaction of %d operations exceeds the limit of %d", len(ops), maxTxnOps))
+		return result
+	}
+
+	if err := t.txn(ops); err != nil {
+		result.Errors = append(result.Errors, err)
+		return result
+	}
+	for _, op := range ops {
+		if op.Service == nil {
+			continue
+		}
+		if op.Service.Verb == consulapi.ServiceDelete {
+			result.Deregistered++
+		} else {
+			result.Registered++
+		}
+	}
+	return result
+}
+
+func (t *consulTarget) txn(ops consulapi.TxnOps) error {
+	if t.dryRun {
+		for _, op := range ops {
+			txnLog(op).WithField("target", t.name).Info("Would apply transaction operation")
+			metrics.ConsulOperations.WithLabelValues(t.name, txnOperation(op), metrics.ResultDryRun).Inc()
+		}
+		return nil
+	}
+
+	for _, op := range ops {
+		txnLog(op).WithField("target", t.name).Debug("Applying transaction operation")
+	}
+
+	ok, resp, _, err := t.ConsulClient().Txn().Txn(ops, nil)
+	if err == nil && !ok {
+		var errs []string
+		for _, txnErr := range resp.Errors {
+			errs = append(errs, fmt.Sprintf("operation %d: %s", txnErr.OpIndex, txnErr.What))
+		}
+		err = fmt.Errorf("transaction rolled back: %s", strings.Join(errs, ", "))
+	}
+
+	result := metrics.ResultSuccess
+	if err != nil {
+		result = metrics.ResultError
+	}
+	for _, op := range ops {
+		metrics.ConsulOperations.WithLabelValues(t.name, txnOperation(op), result).Inc()
+	}
+	return err
+}
+
+// syncMetadata writes all metadata documents, keyed by their KV key, and
+// removes the documents of services that no longer exist within the scope of
+// a sync
+func (t *consulTarget) syncMetadata(docs map[string]*interfaces.ServiceMetadata, removeStale bool) []error {
+	var errs []error
+	var ops consulapi.TxnOps
+
+	for _, metadata := range docs {
+		ops = append(ops, t.metadataOps(metadata.Namespace, metadata.Name, metadata)...)
+	}
+
+	if removeStale {
+		keys, _, err := t.ConsulClient().KV().Keys(t.metadataPrefix(t.namespace), "", nil)
+		if err != nil {
+			return []error{fmt.Errorf("error listing metadata keys: %s", err)}
+		}
+		for _, key := range keys {
+			if _, ok := docs[key]; !ok {
+				ops = append(ops, &consulapi.TxnOp{
+					KV: &consulapi.KVTxnOp{Verb: consulapi.KVDelete, Key: key},
+				})
+			}
+		}
+	}
+
+	// documents are independent of each other, so they may be written in
+	// several transactions
+	for len(ops) > 0 {
+		n := len(ops)
+		if n > maxTxnOps {
+			n = maxTxnOps
+		}
+		if err := t.txn(ops[:n]); err != nil {
+			errs = append(errs, err)
+		}
+		ops = ops[n:]
+	}
+	return errs
+}
+
+func txnOperation(op *consulapi.TxnOp) string {
+	switch {
+	case op.KV != nil && op.KV.Verb == consulapi.KVDelete:
+		return "kv_delete"
+	case op.KV != nil:
+		return "kv_set"
+	case op.Node != nil:
+		return "register_node"
+	case op.Check != nil && op.Check.Verb == consulapi.CheckDelete:
+		return "deregister_check"
+	case op.Check != nil:
+		return "register_check"
+	case op.Service != nil && op.Service.Verb == consulapi.ServiceDelete:
+		return "deregister"
+	case op.Service != nil:
+		return "register"
+	}
+	return "unknown"
+}
+
+func txnLog(op *consulapi.TxnOp) *log.Entry {
+	entry := log.WithField("operation", txnOperation(op))
+	switch {
+	case op.KV != nil:
+		entry = entry.WithField("key", op.KV.Key)
+	case op.Node != nil:
+		entry = entry.WithField("node", op.Node.Node.Node)
+	case op.Check != nil:
+		entry = entry.WithFields(log.Fields{
+			"node":     op.Check.Check.Node,
+			"check_id": op.Check.Check.CheckID,
+		})
+	case op.Service != nil:
+		entry = entry.WithFields(log.Fields{
+			"node":           op.Service.Node,
+			"consul_service": op.Service.Service.ID,
+		})
+	}
+	return entry
+}
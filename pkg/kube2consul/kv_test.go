@@ -0,0 +1,121 @@
+package kube2consul
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"testing"
+
+	consulapi "github.com/hashicorp/consul/api"
+
+	"github.com/jetstack-experimental/kube2consul/pkg/interfaces"
+	"github.com/jetstack-experimental/kube2consul/pkg/service"
+	"github.com/jetstack-experimental/kube2consul/pkg/testing/fakeconsul"
+)
+
+func TestUpdateOwnedTxn(t *testing.T) {
+	for _, test := range []struct {
+		nodes int
+		// whether registrations are sent in the transaction of the metadata
+		atomic bool
+	}{
+		{nodes: 2, atomic: true},
+		// two operations per node
+		{nodes: maxTxnOps / 2, atomic: false},
+	} {
+		consul := fakeconsul.New()
+		defer consul.Close()
+
+		k := New()
+		k.consulAddress = consul.Address()
+		k.kvPrefix = "kube2consul"
+
+		tag := service.OwnerTag("default", "web")
+		var endpoints []interfaces.Endpoint
+		for i := 0; i < test.nodes; i++ {
+			endpoints = append(endpoints, interfaces.Endpoint{
+				DnsLabel:    "default-web",
+				NodeName:    fmt.Sprintf("node-%d", i),
+				NodeAddress: fmt.Sprintf("10.0.0.%d", i),
+				NodePort:    30080,
+				Tags:        []string{tag},
+			})
+		}
+		kvOps := k.metadataOps("default", "web", &interfaces.ServiceMetadata{Namespace: "default", Name: "web"})
+		if err := k.consulTargets()[0].updateOwned(tag, endpoints, kvOps); err != nil {
+			t.Errorf("%d nodes: error updating: %s", test.nodes, err)
+			continue
+		}
+
+		if exp, act := test.nodes, len(consul.Services()); exp != act {
+			t.Errorf("%d nodes: registered %d services, expected %d", test.nodes, act, exp)
+		}
+		if _, ok := consul.KV()["kube2consul/default/web"]; !ok {
+			t.Errorf("%d nodes: metadata not written", test.nodes)
+		}
+		atomic := false
+		for _, req := range consul.Requests() {
+			if req.Path != "/v1/txn" {
+				continue
+			}
+			var ops consulapi.TxnOps
+			if err := json.Unmarshal(req.Body, &ops); err != nil {
+				t.Fatal(err)
+			}
+			for _, op := range ops {
+				if op.Service != nil {
+					atomic = true
+				}
+			}
+		}
+		if test.atomic != atomic {
+			t.Errorf("%d nodes: registrations sent in the transaction of the metadata: %t, expected %t", test.nodes, atomic, test.atomic)
+		}
+	}
+}
+
+func TestUpdateOwnedTxnAgentNode(t *testing.T) {
+	consul := fakeconsul.New()
+	defer consul.Close()
+	agentMeta := map[string]string{"consul-version": "1.0.0"}
+	consul.RegisterNode(consulapi.Node{Node: "node-0", Address: "10.0.0.1", Meta: agentMeta})
+	consul.RegisterCheck(consulapi.HealthCheck{Node: "node-0", CheckID: SerfHealthCheckID, Status: consulapi.HealthPassing})
+
+	k := New()
+	k.consulAddress = consul.Address()
+	k.kvPrefix = "kube2consul"
+
+	tag := service.OwnerTag("default", "web")
+	var endpoints []interfaces.Endpoint
+	for i := 0; i < 2; i++ {
+		endpoints = append(endpoints, interfaces.Endpoint{
+			DnsLabel:    "default-web",
+			NodeName:    fmt.Sprintf("node-%d", i),
+			NodeAddress: fmt.Sprintf("10.0.0.%d", i),
+			NodePort:    30080,
+			Tags:        []string{tag},
+		})
+	}
+	kvOps := k.metadataOps("default", "web", &interfaces.ServiceMetadata{Namespace: "default", Name: "web"})
+	if err := k.consulTargets()[0].updateOwned(tag, endpoints, kvOps); err != nil {
+		t.Fatal(err)
+	}
+	if consul.RequestCount("PUT", "/v1/txn") == 0 {
+		t.Fatal("Registrations not sent in a transaction")
+	}
+
+	// agent nodes only get service operations, other nodes are marked
+	nodes := consul.Nodes()
+	if exp, act := "10.0.0.1", nodes["node-0"].Address; exp != act {
+		t.Errorf("Address '%s' of the agent node is not the expected '%s'", act, exp)
+	}
+	if exp, act := agentMeta, nodes["node-0"].Meta; !reflect.DeepEqual(exp, act) {
+		t.Errorf("Meta data %v of the agent node is not the expected %v", act, exp)
+	}
+	if exp, act := "true", nodes["node-1"].Meta[ManagedNodeMeta]; exp != act {
+		t.Errorf("Node meta %s is '%s', expected '%s'", ManagedNodeMeta, act, exp)
+	}
+	if exp, act := 2, len(consul.Services()); exp != act {
+		t.Errorf("Registered %d services, expected %d", act, exp)
+	}
+}
@@ -0,0 +1,239 @@
+package kube2consul
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/ghodss/yaml"
+	kapi "k8s.io/kubernetes/pkg/api"
+
+	"github.com/jetstack-experimental/kube2consul/pkg/interfaces"
+	"github.com/jetstack-experimental/kube2consul/pkg/service"
+)
+
+const (
+	outputTable = "table"
+	outputWide  = "wide"
+	outputJSON  = "json"
+	outputYAML  = "yaml"
+)
+
+// listRow is a single consul registration (or a failure to determine one)
+// as printed by the list command
+type listRow struct {
+	Namespace     string            `json:"namespace"`
+	Service       string            `json:"service"`
+	ConsulService string            `json:"consulService,omitempty"`
+	OriginalName  string            `json:"originalName,omitempty"`
+	Node          string            `json:"node,omitempty"`
+	Address       string            `json:"address,omitempty"`
+	Port          int32             `json:"port,omitempty"`
+	Tags          []string          `json:"tags,omitempty"`
+	Meta          map[string]string `json:"meta,omitempty"`
+	Maintenance   string            `json:"maintenance,omitempty"`
+	Location      string            `json:"location,omitempty"`
+	Conflict      string            `json:"conflict,omitempty"`
+	Error         string            `json:"error,omitempty"`
+}
+
+func (r *listRow) status() string {
+	if r.Error != "" {
+		return r.Error
+	}
+	if r.Conflict != "" {
+		return fmt.Sprintf("conflict: %s", r.Conflict)
+	}
+	if r.Maintenance != "" {
+		return fmt.Sprintf("maintenance: %s", r.Maintenance)
+	}
+	if r.OriginalName != "" {
+		return fmt.Sprintf("renamed: %s", service.ValidateName(r.OriginalName))
+	}
+	return "ok"
+}
+
+func (k *Kube2Consul) cmdList() error {
+	return k.list(os.Stdout)
+}
+
+// list writes the registrations of all exported services to out. It fails
+// if any of them can't be determined.
+func (k *Kube2Consul) list(out io.Writer) error {
+	switch k.listOutput {
+	case outputTable, outputWide, outputJSON, outputYAML:
+	default:
+		return fmt.Errorf("unknown output format '%s'", k.listOutput)
+	}
+
+	selector, err := k.labelSelector()
+	if err != nil {
+		return err
+	}
+	if err := k.startInformers(); err != nil {
+		return err
+	}
+
+	svcs, err := k.KubernetesClientset().Core().Services(k.namespace).List(kapi.ListOptions{
+		LabelSelector: selector,
+	})
+	if err != nil {
+		return fmt.Errorf("error getting services: %s", err)
+	}
+
+	rows := []listRow{}
+	claims := newNameClaims()
+	for _, svc := range svcs.Items {
+		if !service.Exported(&svc) {
+			continue
+		}
+		svcRows := k.listRows(&svc)
+		rows = append(rows, svcRows...)
+
+		location := k.consulLocation(svc.Namespace)
+		var endpoints []interfaces.Endpoint
+		for _, row := range svcRows {
+			if row.ConsulService != "" {
+				endpoints = append(endpoints, interfaces.Endpoint{DnsLabel: row.ConsulService, Location: location})
+			}
+		}
+		claims.set(&nameOwner{
+			tag:       service.OwnerTag(svc.Namespace, svc.Name),
+			created:   svc.CreationTimestamp.Time,
+			endpoints: endpoints,
+		})
+	}
+	for i := range rows {
+		if rows[i].ConsulService == "" {
+			continue
+		}
+		endpoint := interfaces.Endpoint{
+			DnsLabel: rows[i].ConsulService,
+			Location: k.consulLocation(rows[i].Namespace),
+		}
+		if conflict := claims.conflict(endpoint); conflict != nil {
+			rows[i].Conflict = conflict.describe(k.conflictPolicy, service.OwnerTag(rows[i].Namespace, rows[i].Service))
+		}
+	}
+
+	if err := writeListRows(out, k.listOutput, rows); err != nil {
+		return err
+	}
+
+	failed := 0
+	for _, row := range rows {
+		if row.Error != "" {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d rows could not be determined", failed, len(rows))
+	}
+	return nil
+}
+
+func (k *Kube2Consul) listRows(svc *kapi.Service) []listRow {
+	endpoints, err := k.KubernetesClientset().Core().Endpoints(svc.Namespace).Get(svc.Name)
+	if err != nil {
+		return []listRow{{
+			Namespace: svc.Namespace,
+			Service:   svc.Name,
+			Error:     fmt.Sprintf("error getting endpoints: %s", err),
+		}}
+	}
+
+	s := service.New(k, svc.Namespace, svc.Name)
+	s.UpdateService(svc)
+	s.UpdateEndpoints(endpoints)
+
+	location := ""
+	if l := k.consulLocation(svc.Namespace); l != (interfaces.Location{}) {
+		location = l.String()
+	}
+
+	var rows []listRow
+	list, errs := s.List()
+	for _, elem := range list {
+		address := elem.NodeAddress
+		if elem.Address != "" {
+			address = elem.Address
+		}
+		rows = append(rows, listRow{
+			Namespace:     svc.Namespace,
+			Service:       svc.Name,
+			ConsulService: elem.DnsLabel,
+			OriginalName:  elem.OriginalName,
+			Node:          elem.NodeName,
+			Address:       address,
+			Port:          elem.NodePort,
+			Tags:          elem.Tags,
+			Meta:          elem.Meta,
+			Maintenance:   elem.Maintenance,
+			Location:      location,
+		})
+	}
+	for _, err := range errs {
+		rows = append(rows, listRow{
+			Namespace: svc.Namespace,
+			Service:   svc.Name,
+			Error:     err.Error(),
+		})
+	}
+	return rows
+}
+
+func writeListRows(out io.Writer, format string, rows []listRow) error {
+	switch format {
+	case outputJSON:
+		data, err := json.MarshalIndent(rows, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(out, string(data))
+		return err
+	case outputYAML:
+		data, err := yaml.Marshal(rows)
+		if err != nil {
+			return err
+		}
+		_, err = out.Write(data)
+		return err
+	}
+
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	header := []string{"NAMESPACE", "SERVICE", "CONSUL SERVICE", "NODE", "ADDRESS", "PORT", "STATUS"}
+	if format == outputWide {
+		header = append(header, "LOCATION")
+	}
+	header = append(header, "TAGS")
+	fmt.Fprintln(w, strings.Join(header, "\t"))
+
+	for _, row := range rows {
+		port := ""
+		if row.Port != 0 {
+			port = fmt.Sprintf("%d", row.Port)
+		}
+		fields := []string{
+			row.Namespace,
+			row.Service,
+			row.ConsulService,
+			row.Node,
+			row.Address,
+			port,
+			row.status(),
+		}
+		if format == outputWide {
+			location := row.Location
+			if location == "" {
+				location = "default"
+			}
+			fields = append(fields, location)
+		}
+		fields = append(fields, strings.Join(row.Tags, ","))
+		fmt.Fprintln(w, strings.Join(fields, "\t"))
+	}
+	return w.Flush()
+}
@@ -0,0 +1,208 @@
+package kube2consul
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ghodss/yaml"
+	kapi "k8s.io/kubernetes/pkg/api"
+)
+
+var testListRows = []listRow{
+	{
+		Namespace:     "default",
+		Service:       "web",
+		ConsulService: "default-web",
+		Node:          "node-1",
+		Address:       "10.0.0.1",
+		Port:          30080,
+		Tags:          []string{"kube2consul-default/web", "http"},
+	},
+	{
+		Namespace:     "team",
+		Service:       "db",
+		ConsulService: "team-db",
+		Node:          "node-2",
+		Address:       "172.16.0.2",
+		Port:          5432,
+		Maintenance:   "node cordoned",
+		Location:      "dc2",
+	},
+	{
+		Namespace: "team",
+		Service:   "broken",
+		Error:     "unable to get node of PodIP 172.16.0.9",
+	},
+}
+
+// lines splits output into lines without the padding of the last column
+func lines(output string) []string {
+	var lines []string
+	for _, line := range strings.Split(strings.TrimSuffix(output, "\n"), "\n") {
+		lines = append(lines, strings.TrimRight(line, " "))
+	}
+	return lines
+}
+
+func TestWriteListRows(t *testing.T) {
+	for _, test := range []struct {
+		format string
+		// expected lines of table formats
+		lines []string
+		// decodes the rows of structured formats
+		decode func([]byte, interface{}) error
+	}{
+		{
+			format: outputTable,
+			lines: []string{
+				"NAMESPACE  SERVICE  CONSUL SERVICE  NODE    ADDRESS     PORT   STATUS                                  TAGS",
+				"default    web      default-web     node-1  10.0.0.1    30080  ok                                      kube2consul-default/web,http",
+				"team       db       team-db         node-2  172.16.0.2  5432   maintenance: node cordoned",
+				"team       broken                                              unable to get node of PodIP 172.16.0.9",
+			},
+		},
+		{
+			format: outputWide,
+			lines: []string{
+				"NAMESPACE  SERVICE  CONSUL SERVICE  NODE    ADDRESS     PORT   STATUS                                  LOCATION  TAGS",
+				"default    web      default-web     node-1  10.0.0.1    30080  ok                                      default   kube2consul-default/web,http",
+				"team       db       team-db         node-2  172.16.0.2  5432   maintenance: node cordoned              dc2",
+				"team       broken                                              unable to get node of PodIP 172.16.0.9  default",
+			},
+		},
+		{format: outputJSON, decode: json.Unmarshal},
+		{format: outputYAML, decode: yaml.Unmarshal},
+	} {
+		var out bytes.Buffer
+		if err := writeListRows(&out, test.format, testListRows); err != nil {
+			t.Errorf("%s: %s", test.format, err)
+			continue
+		}
+
+		if test.decode == nil {
+			if act := lines(out.String()); !reflect.DeepEqual(test.lines, act) {
+				t.Errorf("%s: output\n%s\nis not the expected\n%s", test.format, strings.Join(act, "\n"), strings.Join(test.lines, "\n"))
+			}
+			continue
+		}
+		var rows []listRow
+		if err := test.decode(out.Bytes(), &rows); err != nil {
+			t.Errorf("%s: error decoding output: %s", test.format, err)
+			continue
+		}
+		if !reflect.DeepEqual(testListRows, rows) {
+			t.Errorf("%s: rows %v are not the expected %v", test.format, rows, testListRows)
+		}
+	}
+}
+
+func TestListStatus(t *testing.T) {
+	for _, test := range []struct {
+		row listRow
+		exp string
+	}{
+		{row: listRow{}, exp: "ok"},
+		{row: listRow{OriginalName: "web_api"}, exp: "renamed: consul service name 'web_api' contains characters other than letters, digits and '-'"},
+		{row: listRow{Maintenance: "node cordoned", OriginalName: "web_api"}, exp: "maintenance: node cordoned"},
+		{row: listRow{Conflict: "a-b/c", Maintenance: "node cordoned"}, exp: "conflict: a-b/c"},
+		{row: listRow{Error: "failed", Conflict: "a-b/c"}, exp: "failed"},
+	} {
+		if act := test.row.status(); test.exp != act {
+			t.Errorf("Status '%s' is not the expected '%s'", act, test.exp)
+		}
+	}
+}
+
+func TestList(t *testing.T) {
+	f, consul := newE2E()
+	defer consul.Close()
+	defer f.stop()
+
+	web, err := f.clientset.Core().Services("default").Get("web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	web.Labels = map[string]string{"app": "web"}
+	if _, err := f.clientset.Core().Services("default").Update(web); err != nil {
+		t.Fatal(err)
+	}
+	// not exported
+	internal := nodePortService("default", "internal", time.Now())
+	internal.Spec.Type = kapi.ServiceTypeClusterIP
+	// an endpoint without a pod
+	broken := nodePortService("default", "broken", time.Now())
+	for _, obj := range []*kapi.Service{internal, broken} {
+		if _, err := f.clientset.Core().Services("default").Create(obj); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := f.clientset.Core().Endpoints("default").Create(endpoints("default", "broken", "172.16.0.9")); err != nil {
+		t.Fatal(err)
+	}
+	f.listOutput = outputJSON
+
+	var out bytes.Buffer
+	err = f.list(&out)
+	if err == nil || !strings.Contains(err.Error(), "1 of 3 rows") {
+		t.Errorf("Error '%v' doesn't report the failed row", err)
+	}
+	var rows []listRow
+	if err := json.Unmarshal(out.Bytes(), &rows); err != nil {
+		t.Fatal(err)
+	}
+	var listed []string
+	for _, row := range rows {
+		listed = append(listed, row.Service+"/"+row.Node)
+		if row.Service == "broken" && row.Error == "" {
+			t.Errorf("Row of default/broken has no error")
+		}
+	}
+	sort.Strings(listed)
+	if exp := []string{"broken/", "web/node-1", "web/node-2"}; !reflect.DeepEqual(exp, listed) {
+		t.Errorf("Rows %v are not the expected %v", listed, exp)
+	}
+}
+
+func TestListSelector(t *testing.T) {
+	// only the unlabeled default/web is exported
+	for _, test := range []struct {
+		selector string
+		rows     int
+	}{
+		{selector: "app=web", rows: 0},
+		{selector: "app!=web", rows: 2},
+	} {
+		f, consul := newE2E()
+		f.selector = test.selector
+		f.listOutput = outputJSON
+
+		var out bytes.Buffer
+		err := f.list(&out)
+		f.stop()
+		consul.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var rows []listRow
+		if err := json.Unmarshal(out.Bytes(), &rows); err != nil {
+			t.Fatal(err)
+		}
+		if exp, act := test.rows, len(rows); exp != act {
+			t.Errorf("%s: listed %d rows, expected %d", test.selector, act, exp)
+		}
+	}
+
+	// unknown formats fail before listing
+	f, consul := newE2E()
+	defer consul.Close()
+	defer f.stop()
+	f.listOutput = "xml"
+	if err := f.list(&bytes.Buffer{}); err == nil {
+		t.Error("Expected error of unknown output format")
+	}
+}
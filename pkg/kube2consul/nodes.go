@@ -0,0 +1,426 @@
+package kube2consul
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	consulapi "github.com/hashicorp/consul/api"
+	kapi "k8s.io/kubernetes/pkg/api"
+	kcache "k8s.io/kubernetes/pkg/client/cache"
+	kframework "k8s.io/kubernetes/pkg/controller/framework"
+
+	"github.com/jetstack-experimental/kube2consul/pkg/detect_node"
+	"github.com/jetstack-experimental/kube2consul/pkg/interfaces"
+	"github.com/jetstack-experimental/kube2consul/pkg/metrics"
+	"github.com/jetstack-experimental/kube2consul/pkg/registry/consul"
+	"github.com/jetstack-experimental/kube2consul/pkg/service"
+)
+
+// NodeReadyCheckID is the ID of the node level check reflecting the
+// kubernetes NodeReady condition
+const NodeReadyCheckID = "kube2consul:node-ready"
+
+// NodeMaintenanceCheckID is the ID of the check consul itself uses for nodes
+// in maintenance mode
+const NodeMaintenanceCheckID = "_node_maintenance"
+
+func (k *Kube2Consul) watchForNodes() {
+	k.Informers().Nodes().AddEventHandler(k.afterSync(kframework.ResourceEventHandlerFuncs{
+		AddFunc:    k.newNode,
+		DeleteFunc: k.removeNode,
+		UpdateFunc: k.updateNode,
+	}))
+}
+
+func (k *Kube2Consul) newNode(obj interface{}) {
+	if n, ok := obj.(*kapi.Node); ok {
+		nodeLog(n.Name, "add").Debug("add node")
+		k.handleNode(n)
+	}
+}
+
+func (k *Kube2Consul) removeNode(obj interface{}) {
+	if d, ok := obj.(kcache.DeletedFinalStateUnknown); ok {
+		obj = d.Obj
+	}
+	if n, ok := obj.(*kapi.Node); ok {
+		nodeLog(n.Name, "delete").Debug("remove node")
+		k.nodesLock.Lock()
+		delete(k.nodes, n.Name)
+		delete(k.maintenance, n.Name)
+		k.nodesLock.Unlock()
+		if k.registryName != RegistryConsul || (!k.syncNodes && k.nodeCleanupInterval == 0) {
+			return
+		}
+		// nodes registered by the node sync go with the kubernetes node.
+		// Otherwise services usually are still registered on the node, it
+		// is removed by the periodic cleanup once they are gone.
+		err := k.write("node/"+n.Name, func(t *consulTarget) error {
+			var errs []string
+			for _, location := range t.nodeLocations() {
+				if err := t.deregisterManagedNode(location, n.Name, t.syncNodes); err != nil {
+					errs = append(errs, err.Error())
+				}
+			}
+			if len(errs) > 0 {
+				return fmt.Errorf("%s", strings.Join(errs, "; "))
+			}
+			return nil
+		})
+		if err != nil {
+			nodeLog(n.Name, "delete").Warn(err)
+		}
+	}
+}
+
+func (k *Kube2Consul) updateNode(oldObj, obj interface{}) {
+	if n, ok := obj.(*kapi.Node); ok {
+		k.handleNode(n)
+	}
+}
+
+func (k *Kube2Consul) handleNode(node *kapi.Node) {
+	if k.syncNodes {
+		k.syncNode(node)
+	}
+	if err := k.syncMaintenance(node); err != nil {
+		nodeLog(node.Name, "maintenance").Warn(err)
+	}
+}
+
+// syncNode registers a node if its registration changed since it has been
+// registered last, as node status updates are frequent
+func (k *Kube2Consul) syncNode(node *kapi.Node) {
+	reg, err := k.nodeRegistration(node)
+	if err != nil {
+		nodeLog(node.Name, "update").Warn(err)
+		return
+	}
+
+	k.nodesLock.Lock()
+	last, ok := k.nodes[node.Name]
+	k.nodesLock.Unlock()
+	if ok && reflect.DeepEqual(last, reg) {
+		return
+	}
+
+	err = k.write("node/"+node.Name, func(t *consulTarget) error {
+		return t.registerNode(reg)
+	})
+	if err != nil {
+		nodeLog(node.Name, "update").Warn(err)
+		return
+	}
+
+	k.nodesLock.Lock()
+	k.nodes[node.Name] = reg
+	k.nodesLock.Unlock()
+}
+
+// nodeRegistration returns the catalog registration of a kubernetes node,
+// including its selected labels as node meta data and its readiness check
+func (k *Kube2Consul) nodeRegistration(node *kapi.Node) (*consulapi.CatalogRegistration, error) {
+	address, err := detect_node.NodeAddress(node)
+	if err != nil {
+		return nil, err
+	}
+
+	meta := k.managedNodeMeta()
+	for key, value := range node.Labels {
+		if service.MatchKey(k.nodeMetaLabels, key) {
+			meta[service.MetaKey(key)] = value
+		}
+	}
+
+	status, output := nodeStatus(node)
+	return &consulapi.CatalogRegistration{
+		Node:     node.Name,
+		Address:  address,
+		NodeMeta: meta,
+		Check: &consulapi.AgentCheck{
+			Node:    node.Name,
+			CheckID: NodeReadyCheckID,
+			Name:    "Kubernetes node ready",
+			Status:  status,
+			Output:  output,
+		},
+	}, nil
+}
+
+// nodeStatus maps the NodeReady condition and cordoning to a check status
+func nodeStatus(node *kapi.Node) (status string, output string) {
+	for _, condition := range node.Status.Conditions {
+		if condition.Type != kapi.NodeReady {
+			continue
+		}
+		if condition.Status != kapi.ConditionTrue {
+			return consulapi.HealthCritical, fmt.Sprintf("Node not ready: %s", condition.Message)
+		}
+		if node.Spec.Unschedulable {
+			return consulapi.HealthWarning, "Node is ready, but cordoned"
+		}
+		return consulapi.HealthPassing, "Node is ready"
+	}
+	return consulapi.HealthCritical, "Node has no ready condition"
+}
+
+// registerNode registers a node in every datacenter and partition services
+// are registered in. Nodes run by a consul agent only get the readiness
+// check, the agent maintains their address and meta data.
+func (t *consulTarget) registerNode(reg *consulapi.CatalogRegistration) error {
+	if t.dryRun {
+		nodeLog(reg.Node, "register_node").Info("Would register node")
+		metrics.ConsulOperations.WithLabelValues(t.name, "register_node", metrics.ResultDryRun).Inc()
+		return nil
+	}
+
+	return t.forNodeLocations(func(location interfaces.Location) error {
+		agent, err := t.agents.IsAgent(location, reg.Node)
+		if err != nil {
+			return err
+		}
+		located := *reg
+		located.Datacenter = location.Datacenter
+		located.Partition = location.Partition
+		if agent {
+			located.SkipNodeUpdate = true
+			located.NodeMeta = nil
+		}
+
+		nodeLog(reg.Node, "register_node").Debugf("Registering node with check status %s", reg.Check.Status)
+		if _, err := t.ConsulCatalog().Register(&located, consul.WriteOptions(location)); err != nil {
+			metrics.ConsulOperations.WithLabelValues(t.name, "register_node", metrics.ResultError).Inc()
+			return fmt.Errorf("error registering node %s: %s", reg.Node, err)
+		}
+		metrics.ConsulOperations.WithLabelValues(t.name, "register_node", metrics.ResultSuccess).Inc()
+		return nil
+	})
+}
+
+// forNodeLocations calls write for each datacenter and partition nodes are
+// written to, and joins the errors
+func (t *consulTarget) forNodeLocations(write func(location interfaces.Location) error) error {
+	var errs []string
+	for _, location := range t.nodeLocations() {
+		location.Namespace = ""
+		if err := write(location); err != nil {
+			if location != (interfaces.Location{}) {
+				err = fmt.Errorf("%s: %s", location, err)
+			}
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+func (t *consulTarget) deregisterNode(location interfaces.Location, nodeName string) error {
+	if t.dryRun {
+		nodeLog(nodeName, "deregister_node").Info("Would deregister node")
+		metrics.ConsulOperations.WithLabelValues(t.name, "deregister_node", metrics.ResultDryRun).Inc()
+		return nil
+	}
+
+	nodeLog(nodeName, "deregister_node").Info("Deregistering node")
+	t.agents.Forget(location, nodeName)
+	_, err := t.ConsulCatalog().Deregister(&consulapi.CatalogDeregistration{
+		Node:       nodeName,
+		Datacenter: location.Datacenter,
+		Partition:  location.Partition,
+	}, consul.WriteOptions(location))
+	if err != nil {
+		metrics.ConsulOperations.WithLabelValues(t.name, "deregister_node", metrics.ResultError).Inc()
+		return fmt.Errorf("error deregistering node %s: %s", nodeName, err)
+	}
+	metrics.ConsulOperations.WithLabelValues(t.name, "deregister_node", metrics.ResultSuccess).Inc()
+	return nil
+}
+
+// syncMaintenance applies the maintenance mode of a node if it changed since
+// it has been seen last. A node seen for the first time is cleaned up, so
+// maintenance is lifted even if the node was uncordoned while not running.
+func (k *Kube2Consul) syncMaintenance(node *kapi.Node) error {
+	mode := k.serviceOptions.NodeMaintenance
+	if mode == "" || mode == interfaces.NodeMaintenanceOff {
+		return nil
+	}
+
+	maintenance, reason := service.NodeInMaintenance(node)
+	k.nodesLock.Lock()
+	last, ok := k.maintenance[node.Name]
+	k.nodesLock.Unlock()
+	if ok && last == reason {
+		return nil
+	}
+
+	if maintenance {
+		nodeLog(node.Name, "maintenance").Infof("Node entered maintenance: %s", reason)
+	} else if ok {
+		nodeLog(node.Name, "maintenance").Info("Node left maintenance")
+	}
+
+	switch mode {
+	case interfaces.NodeMaintenanceCheck:
+		err := k.write("maintenance/"+node.Name, func(t *consulTarget) error {
+			if maintenance {
+				return t.registerMaintenanceCheck(node, reason)
+			}
+			return t.deregisterMaintenanceCheck(node.Name)
+		})
+		if err != nil {
+			return err
+		}
+	case interfaces.NodeMaintenanceWithdraw:
+		if maintenance || ok {
+			k.queueServiceUpdates(kapi.NamespaceAll)
+		}
+	}
+
+	k.nodesLock.Lock()
+	k.maintenance[node.Name] = reason
+	k.nodesLock.Unlock()
+	return nil
+}
+
+// queueServiceUpdates schedules re-registering the services of a namespace,
+// so event handlers don't wait for all of them to be updated. Updates queued
+// while others run are coalesced.
+func (k *Kube2Consul) queueServiceUpdates(namespace string) {
+	k.pendingUpdatesLock.Lock()
+	k.pendingUpdates[namespace] = true
+	k.pendingUpdatesLock.Unlock()
+
+	select {
+	case k.updatesSignal <- struct{}{}:
+	default:
+	}
+}
+
+// runServiceUpdates applies the queued service updates until kube2consul is
+// stopped
+func (k *Kube2Consul) runServiceUpdates() {
+	for {
+		select {
+		case <-k.stopCh:
+			return
+		case <-k.updatesSignal:
+		}
+
+		k.pendingUpdatesLock.Lock()
+		pending := k.pendingUpdates
+		k.pendingUpdates = make(map[string]bool)
+		k.pendingUpdatesLock.Unlock()
+
+		if pending[kapi.NamespaceAll] {
+			k.updateServices(kapi.NamespaceAll)
+			continue
+		}
+		for namespace := range pending {
+			k.updateServices(namespace)
+		}
+	}
+}
+
+// updateServices re-registers all known services of a namespace, e.g. after
+// the set of nodes they can be registered on changed
+func (k *Kube2Consul) updateServices(namespace string) {
+	k.servicesLock.Lock()
+	svcs := make([]*service.Service, 0, len(k.services))
+	for _, svc := range k.services {
+		if namespace == kapi.NamespaceAll || svc.Namespace == namespace {
+			svcs = append(svcs, svc)
+		}
+	}
+	k.servicesLock.Unlock()
+
+	for _, svc := range svcs {
+		if err := svc.Update(); err != nil {
+			serviceLog(svc.Namespace, svc.Name, "update").Warnf("Error updating service: %s", err)
+		}
+	}
+}
+
+// registerMaintenanceCheck puts a node into maintenance by registering a
+// critical node level check, which fails all services on the node
+func (t *consulTarget) registerMaintenanceCheck(node *kapi.Node, reason string) error {
+	if t.dryRun {
+		nodeLog(node.Name, "register_check").Info("Would register maintenance check")
+		metrics.ConsulOperations.WithLabelValues(t.name, "register_check", metrics.ResultDryRun).Inc()
+		return nil
+	}
+
+	address, err := detect_node.NodeAddress(node)
+	if err != nil {
+		return err
+	}
+
+	return t.forNodeLocations(func(location interfaces.Location) error {
+		// the check would create missing nodes
+		existing, _, err := t.ConsulCatalog().Node(node.Name, consul.QueryOptions(location))
+		if err != nil {
+			return fmt.Errorf("error getting node %s: %s", node.Name, err)
+		}
+		if existing == nil || existing.Node == nil {
+			return nil
+		}
+
+		nodeLog(node.Name, "register_check").Debug("Registering maintenance check")
+		_, err = t.ConsulCatalog().Register(&consulapi.CatalogRegistration{
+			Node:           node.Name,
+			Address:        address,
+			Datacenter:     location.Datacenter,
+			Partition:      location.Partition,
+			SkipNodeUpdate: true,
+			Check: &consulapi.AgentCheck{
+				Node:      node.Name,
+				CheckID:   NodeMaintenanceCheckID,
+				Name:      "Node Maintenance Mode",
+				Notes:     reason,
+				Status:    consulapi.HealthCritical,
+				Output:    reason,
+				Partition: location.Partition,
+			},
+		}, consul.WriteOptions(location))
+		if err != nil {
+			metrics.ConsulOperations.WithLabelValues(t.name, "register_check", metrics.ResultError).Inc()
+			return fmt.Errorf("error registering maintenance check of node %s: %s", node.Name, err)
+		}
+		metrics.ConsulOperations.WithLabelValues(t.name, "register_check", metrics.ResultSuccess).Inc()
+		return nil
+	})
+}
+
+func (t *consulTarget) deregisterMaintenanceCheck(nodeName string) error {
+	if t.dryRun {
+		nodeLog(nodeName, "deregister_check").Info("Would deregister maintenance check")
+		metrics.ConsulOperations.WithLabelValues(t.name, "deregister_check", metrics.ResultDryRun).Inc()
+		return nil
+	}
+
+	return t.forNodeLocations(func(location interfaces.Location) error {
+		nodeLog(nodeName, "deregister_check").Debug("Deregistering maintenance check")
+		_, err := t.ConsulCatalog().Deregister(&consulapi.CatalogDeregistration{
+			Node:       nodeName,
+			CheckID:    NodeMaintenanceCheckID,
+			Datacenter: location.Datacenter,
+			Partition:  location.Partition,
+		}, consul.WriteOptions(location))
+		if err != nil {
+			metrics.ConsulOperations.WithLabelValues(t.name, "deregister_check", metrics.ResultError).Inc()
+			return fmt.Errorf("error deregistering maintenance check of node %s: %s", nodeName, err)
+		}
+		metrics.ConsulOperations.WithLabelValues(t.name, "deregister_check", metrics.ResultSuccess).Inc()
+		return nil
+	})
+}
+
+func nodeLog(nodeName string, operation string) *log.Entry {
+	return log.WithFields(log.Fields{
+		"node":      nodeName,
+		"operation": operation,
+	})
+}
@@ -0,0 +1,200 @@
+package kube2consul
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	consulapi "github.com/hashicorp/consul/api"
+	kapi "k8s.io/kubernetes/pkg/api"
+
+	"github.com/jetstack-experimental/kube2consul/pkg/interfaces"
+	"github.com/jetstack-experimental/kube2consul/pkg/testing/fakeconsul"
+)
+
+func TestSyncNode(t *testing.T) {
+	consul := fakeconsul.New()
+	defer consul.Close()
+
+	k := New()
+	k.consulAddress = consul.Address()
+	k.syncNodes = true
+	k.nodeMetaLabels = []string{"zone"}
+
+	node := &kapi.Node{
+		ObjectMeta: kapi.ObjectMeta{
+			Name:   "node-1",
+			Labels: map[string]string{"zone": "a", "other": "x"},
+		},
+		Status: kapi.NodeStatus{
+			Addresses:  []kapi.NodeAddress{{Type: kapi.NodeInternalIP, Address: "10.0.0.1"}},
+			Conditions: []kapi.NodeCondition{{Type: kapi.NodeReady, Status: kapi.ConditionTrue}},
+		},
+	}
+	k.syncNode(node)
+
+	registered, ok := consul.Nodes()["node-1"]
+	if !ok {
+		t.Fatalf("Node not registered: %v", consul.Nodes())
+	}
+	if exp, act := "10.0.0.1", registered.Address; exp != act {
+		t.Errorf("Node address '%s' is not the expected '%s'", act, exp)
+	}
+	if exp, act := "a", registered.Meta["zone"]; exp != act {
+		t.Errorf("Node meta zone is '%s', expected '%s'", act, exp)
+	}
+	if _, ok := registered.Meta["other"]; ok {
+		t.Errorf("Unselected label in node meta %v", registered.Meta)
+	}
+	if exp, act := consulapi.HealthPassing, consul.Checks()["node-1/"+NodeReadyCheckID].Status; exp != act {
+		t.Errorf("Check status '%s' is not the expected '%s'", act, exp)
+	}
+
+	// status updates not changing the registration are not written
+	consul.Reset()
+	node.Status.Conditions[0].LastHeartbeatTime = node.CreationTimestamp
+	k.syncNode(node)
+	if act := consul.RequestCount("PUT", "/v1/catalog/register"); act != 0 {
+		t.Errorf("Sent %d register requests for an unchanged node", act)
+	}
+
+	node.Spec.Unschedulable = true
+	k.syncNode(node)
+	if exp, act := consulapi.HealthWarning, consul.Checks()["node-1/"+NodeReadyCheckID].Status; exp != act {
+		t.Errorf("Check status of cordoned node '%s' is not the expected '%s'", act, exp)
+	}
+}
+
+func TestNodeRegistration(t *testing.T) {
+	k := New()
+	k.nodeMetaLabels = []string{"zone"}
+
+	node := &kapi.Node{
+		ObjectMeta: kapi.ObjectMeta{
+			Name:   "node-1",
+			Labels: map[string]string{"zone": "a", "other": "x"},
+		},
+		Status: kapi.NodeStatus{
+			Addresses:  []kapi.NodeAddress{{Type: kapi.NodeInternalIP, Address: "10.0.0.1"}},
+			Conditions: []kapi.NodeCondition{{Type: kapi.NodeReady, Status: kapi.ConditionTrue}},
+		},
+	}
+	reg, err := k.nodeRegistration(node)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp, act := "10.0.0.1", reg.Address; exp != act {
+		t.Errorf("Node address '%s' is not the expected '%s'", act, exp)
+	}
+	if exp, act := "a", reg.NodeMeta["zone"]; exp != act {
+		t.Errorf("Node meta zone is '%s', expected '%s'", act, exp)
+	}
+	if _, ok := reg.NodeMeta["other"]; ok {
+		t.Errorf("Unselected label in node meta %v", reg.NodeMeta)
+	}
+	if exp, act := consulapi.HealthPassing, reg.Check.Status; exp != act {
+		t.Errorf("Check status '%s' is not the expected '%s'", act, exp)
+	}
+
+	node.Spec.Unschedulable = true
+	if exp, act := consulapi.HealthWarning, mustNodeRegistration(t, k, node).Check.Status; exp != act {
+		t.Errorf("Check status of cordoned node '%s' is not the expected '%s'", act, exp)
+	}
+
+	node.Status.Conditions[0].Status = kapi.ConditionFalse
+	if exp, act := consulapi.HealthCritical, mustNodeRegistration(t, k, node).Check.Status; exp != act {
+		t.Errorf("Check status of not ready node '%s' is not the expected '%s'", act, exp)
+	}
+}
+
+func mustNodeRegistration(t *testing.T, k *Kube2Consul, node *kapi.Node) *consulapi.CatalogRegistration {
+	reg, err := k.nodeRegistration(node)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return reg
+}
+
+func TestSyncAgentNode(t *testing.T) {
+	consul := fakeconsul.New()
+	defer consul.Close()
+	agentMeta := map[string]string{"consul-version": "1.0.0"}
+	consul.RegisterNode(consulapi.Node{Node: "node-1", Address: "10.0.0.1", Meta: agentMeta})
+	consul.RegisterCheck(consulapi.HealthCheck{Node: "node-1", CheckID: SerfHealthCheckID, Status: consulapi.HealthPassing})
+
+	k := New()
+	k.consulAddress = consul.Address()
+	k.syncNodes = true
+	k.nodeMetaLabels = []string{"zone"}
+	k.syncNode(readyNode("node-1", "10.0.0.2"))
+
+	// agents keep their address and meta data, the check is added
+	registered := consul.Nodes()["node-1"]
+	if exp, act := "10.0.0.1", registered.Address; exp != act {
+		t.Errorf("Address '%s' of the agent node is not the expected '%s'", act, exp)
+	}
+	if exp, act := agentMeta, registered.Meta; !reflect.DeepEqual(exp, act) {
+		t.Errorf("Meta data %v of the agent node is not the expected %v", act, exp)
+	}
+	if _, ok := consul.Checks()["node-1/"+NodeReadyCheckID]; !ok {
+		t.Errorf("Readiness check not registered: %v", consul.Checks())
+	}
+}
+
+func TestSyncNodeRouted(t *testing.T) {
+	consul := fakeconsul.New()
+	defer consul.Close()
+
+	k := New()
+	k.consulAddress = consul.Address()
+	k.syncNodes = true
+	k.serviceOptions.NodeMaintenance = interfaces.NodeMaintenanceCheck
+	route, err := parseRoute("namespaces=team-*,partition=team")
+	if err != nil {
+		t.Fatal(err)
+	}
+	k.routes = []consulRoute{route}
+
+	node := readyNode("node-1", "10.0.0.1")
+	node.Spec.Unschedulable = true
+	k.handleNode(node)
+
+	// nodes and their maintenance checks are written to every partition
+	// services are routed to
+	partitions := func(check string) map[string]bool {
+		written := make(map[string]bool)
+		for _, req := range consul.Requests() {
+			if req.Path != "/v1/catalog/register" {
+				continue
+			}
+			var reg consulapi.CatalogRegistration
+			if err := json.Unmarshal(req.Body, &reg); err != nil {
+				t.Fatal(err)
+			}
+			if reg.Check == nil || reg.Check.CheckID != check {
+				continue
+			}
+			if exp, act := strings.Contains(req.Query, "partition=team"), reg.Partition == "team"; exp != act {
+				t.Errorf("Registration in partition '%s' sent with query '%s'", reg.Partition, req.Query)
+			}
+			written[reg.Partition] = true
+		}
+		return written
+	}
+	for _, check := range []string{NodeReadyCheckID, NodeMaintenanceCheckID} {
+		if exp, act := map[string]bool{"": true, "team": true}, partitions(check); !reflect.DeepEqual(exp, act) {
+			t.Errorf("Check %s written to partitions %v, expected %v", check, act, exp)
+		}
+	}
+}
+
+func readyNode(name string, address string) *kapi.Node {
+	return &kapi.Node{
+		ObjectMeta: kapi.ObjectMeta{Name: name},
+		Status: kapi.NodeStatus{
+			Addresses:  []kapi.NodeAddress{{Type: kapi.NodeInternalIP, Address: address}},
+			Conditions: []kapi.NodeCondition{{Type: kapi.NodeReady, Status: kapi.ConditionTrue}},
+		},
+	}
+}
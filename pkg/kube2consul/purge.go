@@ -0,0 +1,184 @@
+package kube2consul
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	kapi "k8s.io/kubernetes/pkg/api"
+
+	"github.com/jetstack-experimental/kube2consul/pkg/interfaces"
+	"github.com/jetstack-experimental/kube2consul/pkg/metrics"
+	"github.com/jetstack-experimental/kube2consul/pkg/service"
+)
+
+func (k *Kube2Consul) cmdPurge() error {
+	if k.purgeService != "" && k.namespace == kapi.NamespaceAll {
+		return fmt.Errorf("--service requires --namespace")
+	}
+
+	failed := 0
+	targets := k.consulTargets()
+	for _, t := range targets {
+		if len(targets) > 1 {
+			fmt.Printf("Consul target %s:\n", t.name)
+		}
+		errs, err := t.purge()
+		if err != nil {
+			return err
+		}
+		for _, err := range errs {
+			log.WithField("target", t.name).Warn(err)
+		}
+		failed += len(errs)
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("purge finished with %d errors", failed)
+	}
+	return nil
+}
+
+// purge removes the registrations in scope of the purge from the target
+// after asking for confirmation. It returns the errors of single operations
+// and fails if the registrations can't be listed or the purge is aborted.
+func (t *consulTarget) purge() ([]error, error) {
+	endpoints, err := t.ownedEndpoints(t.purgeOwnerFilter())
+	if err != nil {
+		return nil, fmt.Errorf("error getting registrations from consul: %s", err)
+	}
+	if len(endpoints) == 0 {
+		fmt.Println("No registrations found")
+		return nil, nil
+	}
+
+	sort.Sort(byNodeAndService(endpoints))
+	rows := make([]listRow, len(endpoints))
+	for i, endpoint := range endpoints {
+		rows[i] = purgeRow(endpoint)
+	}
+	if err := writeListRows(os.Stdout, outputWide, rows); err != nil {
+		return nil, err
+	}
+
+	if !t.purgeYes && !t.dryRun && !confirm(t.stdin, fmt.Sprintf("Deregister %d services from consul?", len(endpoints))) {
+		return nil, fmt.Errorf("aborted")
+	}
+
+	var errs []error
+	nodes := make(map[interfaces.Location]map[string]bool)
+	for _, endpoint := range endpoints {
+		if err := t.deregister(endpoint); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		location := endpoint.Location
+		location.Namespace = ""
+		if nodes[location] == nil {
+			nodes[location] = make(map[string]bool)
+		}
+		nodes[location][endpoint.NodeName] = true
+	}
+
+	if t.registryName == RegistryConsul {
+		for _, location := range t.nodeLocations() {
+			key := location
+			key.Namespace = ""
+			for nodeName := range nodes[key] {
+				if err := t.deregisterEmptyNode(location, nodeName); err != nil {
+					errs = append(errs, err)
+				}
+			}
+		}
+	}
+
+	if t.kvPrefix != "" {
+		if err := t.purgeMetadata(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs, nil
+}
+
+// purgeOwnerFilter matches the registrations of all services, a namespace or
+// a single service
+func (k *Kube2Consul) purgeOwnerFilter() func(string) bool {
+	if k.purgeService != "" {
+		ownerTag := service.OwnerTag(k.namespace, k.purgeService)
+		return func(tag string) bool {
+			return tag == ownerTag
+		}
+	}
+	prefix := service.OwnerTagPrefix
+	if k.namespace != kapi.NamespaceAll {
+		prefix = service.OwnerTag(k.namespace, "")
+	}
+	return func(tag string) bool {
+		return strings.HasPrefix(tag, prefix)
+	}
+}
+
+// purgeMetadata removes the metadata documents in scope of the purge
+func (t *consulTarget) purgeMetadata() error {
+	prefix := t.metadataPrefix(t.namespace)
+	if t.purgeService != "" {
+		prefix = t.metadataKey(t.namespace, t.purgeService)
+	}
+
+	if t.dryRun {
+		log.WithFields(log.Fields{"key": prefix, "operation": "kv_delete"}).Info("Would delete metadata")
+		metrics.ConsulOperations.WithLabelValues(t.name, "kv_delete", metrics.ResultDryRun).Inc()
+		return nil
+	}
+
+	log.WithFields(log.Fields{"key": prefix, "operation": "kv_delete"}).Info("Deleting metadata")
+	if _, err := t.ConsulClient().KV().DeleteTree(prefix, nil); err != nil {
+		metrics.ConsulOperations.WithLabelValues(t.name, "kv_delete", metrics.ResultError).Inc()
+		return fmt.Errorf("error deleting metadata %s: %s", prefix, err)
+	}
+	metrics.ConsulOperations.WithLabelValues(t.name, "kv_delete", metrics.ResultSuccess).Inc()
+	return nil
+}
+
+func purgeRow(endpoint interfaces.Endpoint) listRow {
+	row := listRow{
+		ConsulService: endpoint.DnsLabel,
+		Node:          endpoint.NodeName,
+		Address:       endpoint.NodeAddress,
+		Port:          endpoint.NodePort,
+		Tags:          endpoint.Tags,
+	}
+	if endpoint.Location != (interfaces.Location{}) {
+		row.Location = endpoint.Location.String()
+	}
+	for _, tag := range endpoint.Tags {
+		if namespace, name, ok := service.ParseOwnerTag(tag); ok {
+			row.Namespace = namespace
+			row.Service = name
+			break
+		}
+	}
+	return row
+}
+
+// confirm asks the user a yes/no question, reading the answer from in
+func confirm(in *bufio.Reader, question string) bool {
+	fmt.Printf("%s [y/N] ", question)
+	answer, err := in.ReadString('\n')
+	if err != nil {
+		return false
+	}
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
+type byNodeAndService []interfaces.Endpoint
+
+func (e byNodeAndService) Len() int      { return len(e) }
+func (e byNodeAndService) Swap(i, j int) { e[i], e[j] = e[j], e[i] }
+func (e byNodeAndService) Less(i, j int) bool {
+	return endpointKey(e[i]) < endpointKey(e[j])
+}
@@ -0,0 +1,290 @@
+package kube2consul
+
+import (
+	"bufio"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	consulapi "github.com/hashicorp/consul/api"
+	dto "github.com/prometheus/client_model/go"
+	kapi "k8s.io/kubernetes/pkg/api"
+
+	"github.com/jetstack-experimental/kube2consul/pkg/metrics"
+	"github.com/jetstack-experimental/kube2consul/pkg/service"
+	"github.com/jetstack-experimental/kube2consul/pkg/testing/fakeconsul"
+)
+
+// operationCount returns the count of a consul operation of the default target
+func operationCount(t *testing.T, operation string, result string) float64 {
+	var m dto.Metric
+	if err := metrics.ConsulOperations.WithLabelValues(DefaultTargetName, operation, result).Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetCounter().GetValue()
+}
+
+// newPurgeTest returns kube2consul and a consul with the managed node node-1,
+// which has a service of default/web and one not registered by kube2consul,
+// and the managed node node-2 with a service of default/web only
+func newPurgeTest() (*Kube2Consul, *fakeconsul.Server) {
+	consul := fakeconsul.New()
+	k := New()
+	k.consulAddress = consul.Address()
+	k.purgeYes = true
+
+	for _, node := range []string{"node-1", "node-2"} {
+		consul.RegisterNode(consulapi.Node{Node: node, Address: "10.0.0.1", Meta: k.managedNodeMeta()})
+		consul.RegisterService(node, consulapi.AgentService{
+			ID:      "default-web",
+			Service: "default-web",
+			Tags:    []string{service.OwnerTag("default", "web")},
+		})
+	}
+	consul.RegisterService("node-1", consulapi.AgentService{ID: "other", Service: "other"})
+	return k, consul
+}
+
+func TestPurgeDryRunEmptyNodes(t *testing.T) {
+	k, consul := newPurgeTest()
+	defer consul.Close()
+	k.dryRun = true
+
+	before := operationCount(t, "deregister_node", metrics.ResultDryRun)
+	if err := k.cmdPurge(); err != nil {
+		t.Fatal(err)
+	}
+
+	// only node-2 would be left empty
+	if exp, act := float64(1), operationCount(t, "deregister_node", metrics.ResultDryRun)-before; exp != act {
+		t.Errorf("Would deregister %.0f nodes, expected %.0f", act, exp)
+	}
+	if exp, act := 3, len(consul.Services()); exp != act {
+		t.Errorf("Dry run changed the catalog to %d services, expected %d", act, exp)
+	}
+
+	// a real run agrees
+	k, consul = newPurgeTest()
+	defer consul.Close()
+	if err := k.cmdPurge(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := consul.Nodes()["node-2"]; ok {
+		t.Error("Empty node node-2 not deregistered")
+	}
+	if _, ok := consul.Nodes()["node-1"]; !ok {
+		t.Error("Node node-1 deregistered")
+	}
+}
+
+func TestPurgeOwnerFilter(t *testing.T) {
+	tags := []string{
+		service.OwnerTag("default", "web"),
+		service.OwnerTag("default", "web-api"),
+		service.OwnerTag("team", "web"),
+		"web",
+	}
+	for _, test := range []struct {
+		namespace string
+		service   string
+		exp       []string
+	}{
+		{
+			namespace: kapi.NamespaceAll,
+			exp:       []string{service.OwnerTag("default", "web"), service.OwnerTag("default", "web-api"), service.OwnerTag("team", "web")},
+		},
+		{
+			namespace: "default",
+			exp:       []string{service.OwnerTag("default", "web"), service.OwnerTag("default", "web-api")},
+		},
+		{
+			namespace: "default",
+			service:   "web",
+			exp:       []string{service.OwnerTag("default", "web")},
+		},
+		{
+			namespace: "def",
+			exp:       nil,
+		},
+	} {
+		k := New()
+		k.namespace = test.namespace
+		k.purgeService = test.service
+		filter := k.purgeOwnerFilter()
+
+		var act []string
+		for _, tag := range tags {
+			if filter(tag) {
+				act = append(act, tag)
+			}
+		}
+		if !reflect.DeepEqual(test.exp, act) {
+			t.Errorf("Namespace '%s', service '%s': matched %v, expected %v", test.namespace, test.service, act, test.exp)
+		}
+	}
+}
+
+func TestPurgeScope(t *testing.T) {
+	for _, test := range []struct {
+		cluster   string
+		namespace string
+		service   string
+		// services left on node-1
+		left []string
+	}{
+		{
+			namespace: kapi.NamespaceAll,
+			left:      []string{"other"},
+		},
+		{
+			namespace: "default",
+			left:      []string{"other", "team-db-a", "team-db-b"},
+		},
+		{
+			namespace: "default",
+			service:   "web",
+			left:      []string{"default-api-a", "other", "team-db-a", "team-db-b"},
+		},
+		// registrations of other clusters are kept
+		{
+			cluster:   "a",
+			namespace: kapi.NamespaceAll,
+			left:      []string{"default-web-b", "other", "team-db-b"},
+		},
+		{
+			cluster:   "b",
+			namespace: "default",
+			left:      []string{"default-api-a", "default-web-a", "other", "team-db-a", "team-db-b"},
+		},
+	} {
+		consul := fakeconsul.New()
+		consul.RegisterNode(consulapi.Node{Node: "node-1", Address: "10.0.0.1"})
+		for _, svc := range []struct{ namespace, name, cluster string }{
+			{"default", "web", "a"},
+			{"default", "web", "b"},
+			{"default", "api", "a"},
+			{"team", "db", "a"},
+			{"team", "db", "b"},
+		} {
+			name := svc.namespace + "-" + svc.name + "-" + svc.cluster
+			consul.RegisterService("node-1", consulapi.AgentService{
+				ID:      name,
+				Service: name,
+				Tags:    []string{service.OwnerTag(svc.namespace, svc.name), service.ClusterTag(svc.cluster)},
+			})
+		}
+		consul.RegisterService("node-1", consulapi.AgentService{ID: "other", Service: "other"})
+
+		k := New()
+		k.consulAddress = consul.Address()
+		k.purgeYes = true
+		k.clusterName = test.cluster
+		k.namespace = test.namespace
+		k.purgeService = test.service
+		if err := k.cmdPurge(); err != nil {
+			t.Errorf("Cluster '%s', namespace '%s', service '%s': unexpected error: %s", test.cluster, test.namespace, test.service, err)
+		}
+
+		var left []string
+		for _, svc := range consul.Services() {
+			left = append(left, svc.ID)
+		}
+		sort.Strings(left)
+		if !reflect.DeepEqual(test.left, left) {
+			t.Errorf("Cluster '%s', namespace '%s', service '%s': left %v, expected %v", test.cluster, test.namespace, test.service, left, test.left)
+		}
+		consul.Close()
+	}
+}
+
+func TestPurgeConfirm(t *testing.T) {
+	for _, test := range []struct {
+		answer  string
+		purged  bool
+		aborted bool
+	}{
+		{answer: "y\n", purged: true},
+		{answer: " Yes \n", purged: true},
+		{answer: "n\n", aborted: true},
+		{answer: "\n", aborted: true},
+		// stdin closed without an answer
+		{answer: "", aborted: true},
+	} {
+		k, consul := newPurgeTest()
+		k.purgeYes = false
+		k.stdin = bufio.NewReader(strings.NewReader(test.answer))
+
+		err := k.cmdPurge()
+		if aborted := err != nil && err.Error() == "aborted"; aborted != test.aborted {
+			t.Errorf("Answer %q: aborted %t, expected %t (%v)", test.answer, aborted, test.aborted, err)
+		}
+		if purged := len(consul.Services()) == 1; purged != test.purged {
+			t.Errorf("Answer %q: purged %t, expected %t", test.answer, purged, test.purged)
+		}
+		consul.Close()
+	}
+
+	// --yes and dry runs don't ask
+	for _, dryRun := range []bool{false, true} {
+		k, consul := newPurgeTest()
+		k.purgeYes = !dryRun
+		k.dryRun = dryRun
+		k.stdin = bufio.NewReader(strings.NewReader("n\n"))
+		if err := k.cmdPurge(); err != nil {
+			t.Errorf("Dry run %t: unexpected error: %s", dryRun, err)
+		}
+		consul.Close()
+	}
+}
+
+func TestConfirm(t *testing.T) {
+	for _, test := range []struct {
+		answer    string
+		confirmed bool
+	}{
+		{answer: "y\n", confirmed: true},
+		{answer: " Yes \n", confirmed: true},
+		{answer: "n\n"},
+		{answer: "\n"},
+		// stdin closed without an answer
+		{answer: ""},
+	} {
+		if confirmed := confirm(bufio.NewReader(strings.NewReader(test.answer)), "Purge?"); confirmed != test.confirmed {
+			t.Errorf("Answer %q: confirmed %t, expected %t", test.answer, confirmed, test.confirmed)
+		}
+	}
+
+	// answers of piped input are read one by one from the shared reader
+	in := bufio.NewReader(strings.NewReader("y\nn\n"))
+	if !confirm(in, "First?") || confirm(in, "Second?") {
+		t.Error("Answers of piped input weren't read in turn")
+	}
+}
+
+func TestPurgeConfirmTargets(t *testing.T) {
+	k, consul := newPurgeTest()
+	defer consul.Close()
+	dc2 := fakeconsul.New()
+	defer dc2.Close()
+	dc2.RegisterNode(consulapi.Node{Node: "node-1", Address: "10.0.0.1"})
+	dc2.RegisterService("node-1", consulapi.AgentService{
+		ID:      "default-web",
+		Service: "default-web",
+		Tags:    []string{service.OwnerTag("default", "web")},
+	})
+	k.targetSpecs = []string{"name=dc2,address=" + dc2.Address()}
+
+	// every target is confirmed by its own answer of piped input
+	k.purgeYes = false
+	k.stdin = bufio.NewReader(strings.NewReader("y\ny\n"))
+	if err := k.cmdPurge(); err != nil {
+		t.Fatal(err)
+	}
+	if exp, act := 1, len(consul.Services()); exp != act {
+		t.Errorf("Left %d services in the default target, expected %d", act, exp)
+	}
+	if exp, act := 0, len(dc2.Services()); exp != act {
+		t.Errorf("Left %d services in target dc2, expected %d", act, exp)
+	}
+}
@@ -0,0 +1,90 @@
+package kube2consul
+
+import (
+	"sync"
+)
+
+// queuedWrite is a pending write to a consul target
+type queuedWrite struct {
+	key string
+	op  func(*consulTarget) error
+	// generation of the key the write was pushed with
+	gen uint64
+}
+
+// writeQueue holds the pending writes of a consul target. Writes are keyed by
+// what they change, e.g. an owner tag or a node, and only the latest write of
+// a key is kept, as it supersedes all earlier ones.
+type writeQueue struct {
+	lock    sync.Mutex
+	keys    []string
+	pending map[string]*queuedWrite
+	gens    map[string]uint64
+	// signaled after writes have been pushed
+	signal chan struct{}
+}
+
+func newWriteQueue() *writeQueue {
+	return &writeQueue{
+		pending: make(map[string]*queuedWrite),
+		gens:    make(map[string]uint64),
+		signal:  make(chan struct{}, 1),
+	}
+}
+
+// push adds a write, replacing a pending write of the same key
+func (q *writeQueue) push(key string, op func(*consulTarget) error) {
+	q.lock.Lock()
+	q.gens[key]++
+	q.add(&queuedWrite{key: key, op: op, gen: q.gens[key]})
+	q.lock.Unlock()
+	q.notify()
+}
+
+// retry adds a failed write again, unless a later write of its key has been
+// pushed in the meantime
+func (q *writeQueue) retry(w *queuedWrite) {
+	q.lock.Lock()
+	if q.gens[w.key] != w.gen {
+		q.lock.Unlock()
+		return
+	}
+	q.add(w)
+	q.lock.Unlock()
+	q.notify()
+}
+
+func (q *writeQueue) add(w *queuedWrite) {
+	if _, ok := q.pending[w.key]; !ok {
+		q.keys = append(q.keys, w.key)
+	}
+	q.pending[w.key] = w
+}
+
+func (q *writeQueue) notify() {
+	select {
+	case q.signal <- struct{}{}:
+	default:
+	}
+}
+
+// pop removes and returns the oldest pending write, nil if there is none
+func (q *writeQueue) pop() *queuedWrite {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if len(q.keys) == 0 {
+		return nil
+	}
+	key := q.keys[0]
+	q.keys = q.keys[1:]
+	w := q.pending[key]
+	delete(q.pending, key)
+	return w
+}
+
+// len returns the number of pending writes
+func (q *writeQueue) len() int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return len(q.keys)
+}
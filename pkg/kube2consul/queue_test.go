@@ -0,0 +1,85 @@
+package kube2consul
+
+import (
+	"reflect"
+	"testing"
+)
+
+// popKeys returns the keys of all pending writes in order
+func popKeys(q *writeQueue) []string {
+	var keys []string
+	for w := q.pop(); w != nil; w = q.pop() {
+		keys = append(keys, w.key)
+	}
+	return keys
+}
+
+func TestWriteQueue(t *testing.T) {
+	q := newWriteQueue()
+	written := ""
+	op := func(name string) func(*consulTarget) error {
+		return func(*consulTarget) error {
+			written = name
+			return nil
+		}
+	}
+
+	q.push("a", op("a1"))
+	q.push("b", op("b1"))
+	q.push("a", op("a2"))
+	if exp, act := 2, q.len(); exp != act {
+		t.Errorf("Queue length %d is not the expected %d", act, exp)
+	}
+	select {
+	case <-q.signal:
+	default:
+		t.Error("Queue not signaled after push")
+	}
+
+	// a replaced write keeps the position of its key
+	w := q.pop()
+	if exp, act := "a", w.key; exp != act {
+		t.Errorf("Key '%s' is not the expected '%s'", act, exp)
+	}
+	w.op(nil)
+	if exp, act := "a2", written; exp != act {
+		t.Errorf("Write '%s' is not the latest '%s'", act, exp)
+	}
+	if exp, act := []string{"b"}, popKeys(q); !reflect.DeepEqual(exp, act) {
+		t.Errorf("Keys %v are not the expected %v", act, exp)
+	}
+	if w := q.pop(); w != nil {
+		t.Errorf("Unexpected write of key '%s' in empty queue", w.key)
+	}
+}
+
+func TestWriteQueueRetry(t *testing.T) {
+	q := newWriteQueue()
+	noop := func(*consulTarget) error { return nil }
+
+	q.push("a", noop)
+	q.push("b", noop)
+	failedA := q.pop()
+	failedB := q.pop()
+
+	// a failed write is queued again if its key hasn't been written since
+	q.retry(failedA)
+	if exp, act := []string{"a"}, popKeys(q); !reflect.DeepEqual(exp, act) {
+		t.Errorf("Keys %v are not the expected %v", act, exp)
+	}
+
+	// but not if it has been superseded, even if that write went through
+	q.push("b", noop)
+	q.pop()
+	q.retry(failedB)
+	if exp, act := 0, q.len(); exp != act {
+		t.Errorf("Queue length %d after retrying a superseded write, expected %d", act, exp)
+	}
+
+	// a retry doesn't replace a newer pending write
+	q.push("a", noop)
+	q.retry(failedA)
+	if w := q.pop(); w == nil || w.gen == failedA.gen {
+		t.Errorf("Pending write of key 'a' replaced by the retry of generation %d", failedA.gen)
+	}
+}
@@ -0,0 +1,162 @@
+package kube2consul
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/time/rate"
+	"k8s.io/kubernetes/pkg/util/flowcontrol"
+
+	"github.com/jetstack-experimental/kube2consul/pkg/metrics"
+)
+
+const (
+	// ClientConsul and ClientKubernetes label the throttling metrics
+	ClientConsul     = "consul"
+	ClientKubernetes = "kubernetes"
+
+	// consulDefaultWait is the duration consul holds blocking queries
+	// without a wait time
+	consulDefaultWait = 5 * time.Minute
+)
+
+// clientTransport rate limits the requests of a client, applies a timeout to
+// each request once it is sent and cancels all requests on shutdown. Blocking
+// consul queries aren't rate limited, they are held by consul until something
+// changed and would take up the budget of writes.
+type clientTransport struct {
+	next    http.RoundTripper
+	ctx     context.Context
+	limiter *rate.Limiter
+	timeout func(req *http.Request) time.Duration
+
+	client string
+	target string
+}
+
+func (t *clientTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.limiter != nil && !blockingQuery(req) {
+		start := time.Now()
+		if err := t.limiter.Wait(t.ctx); err != nil {
+			return nil, err
+		}
+		metrics.ClientThrottleSeconds.WithLabelValues(t.client, t.target).Observe(time.Since(start).Seconds())
+	}
+
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if timeout := t.timeout(req); timeout > 0 {
+		ctx, cancel = context.WithTimeout(t.ctx, timeout)
+	} else {
+		ctx, cancel = context.WithCancel(t.ctx)
+	}
+	resp, err := t.next.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	// the timeout covers reading the body
+	resp.Body = &cancelBody{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+// cancelBody releases the context of a request once its body is closed
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// consulTransport wraps the transport of a consul target
+func (k *Kube2Consul) consulTransport(target string, next http.RoundTripper) http.RoundTripper {
+	var limiter *rate.Limiter
+	if k.consulQPS > 0 {
+		limiter = rate.NewLimiter(rate.Limit(k.consulQPS), k.consulBurst)
+	}
+	return &clientTransport{
+		next:    next,
+		ctx:     k.ctx,
+		limiter: limiter,
+		timeout: consulRequestTimeout(k.consulTimeout),
+		client:  ClientConsul,
+		target:  target,
+	}
+}
+
+// consulRequestTimeout extends the timeout of blocking queries by the time
+// consul may hold them, including the jitter it adds
+func consulRequestTimeout(timeout time.Duration) func(req *http.Request) time.Duration {
+	return func(req *http.Request) time.Duration {
+		if timeout <= 0 {
+			return 0
+		}
+		if !blockingQuery(req) {
+			return timeout
+		}
+		query := req.URL.Query()
+		wait, err := time.ParseDuration(query.Get("wait"))
+		if err != nil || wait <= 0 {
+			wait = consulDefaultWait
+		}
+		return timeout + wait + wait/16
+	}
+}
+
+// blockingQuery tells if a request is a blocking consul query
+func blockingQuery(req *http.Request) bool {
+	return req.URL.Query().Get("index") != ""
+}
+
+// kubernetesTransport wraps the transport of the kubernetes clients. They
+// are rate limited by kubernetesRateLimiter.
+func (k *Kube2Consul) kubernetesTransport(next http.RoundTripper) http.RoundTripper {
+	return &clientTransport{
+		next:    next,
+		ctx:     k.ctx,
+		timeout: kubernetesRequestTimeout(k.kubernetesTimeout),
+		client:  ClientKubernetes,
+	}
+}
+
+// kubernetesRequestTimeout applies the timeout to all but watch requests,
+// which are kept open on purpose
+func kubernetesRequestTimeout(timeout time.Duration) func(req *http.Request) time.Duration {
+	return func(req *http.Request) time.Duration {
+		if req.URL.Query().Get("watch") == "true" || strings.Contains(req.URL.Path, "/watch/") {
+			return 0
+		}
+		return timeout
+	}
+}
+
+// kubernetesRateLimiter returns the rate limiter of the kubernetes clients,
+// which records the time requests are throttled
+func (k *Kube2Consul) kubernetesRateLimiter() flowcontrol.RateLimiter {
+	if k.kubernetesQPS <= 0 {
+		return flowcontrol.NewFakeAlwaysRateLimiter()
+	}
+	return &throttledRateLimiter{
+		RateLimiter: flowcontrol.NewTokenBucketRateLimiter(k.kubernetesQPS, k.kubernetesBurst),
+		client:      ClientKubernetes,
+	}
+}
+
+// throttledRateLimiter records how long Accept blocked
+type throttledRateLimiter struct {
+	flowcontrol.RateLimiter
+	client string
+}
+
+func (l *throttledRateLimiter) Accept() {
+	start := time.Now()
+	l.RateLimiter.Accept()
+	metrics.ClientThrottleSeconds.WithLabelValues(l.client, "").Observe(time.Since(start).Seconds())
+}
@@ -0,0 +1,113 @@
+package kube2consul
+
+import (
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/jetstack-experimental/kube2consul/pkg/interfaces"
+	"github.com/jetstack-experimental/kube2consul/pkg/registry/consul"
+	"github.com/jetstack-experimental/kube2consul/pkg/registry/memory"
+	"github.com/jetstack-experimental/kube2consul/pkg/service"
+)
+
+const (
+	RegistryConsul = "consul"
+	RegistryMemory = "memory"
+)
+
+// Registry returns the backend services are registered in for the target.
+// Dry runs work on an in-memory copy of the owned registrations of the
+// backend.
+func (t *consulTarget) Registry() interfaces.Registry {
+	t.registryLock.Lock()
+	defer t.registryLock.Unlock()
+
+	if t.registry == nil {
+		registry := t.newRegistry(t.registryName)
+		if t.dryRun {
+			registry = newDryRunRegistry(registry)
+		}
+		t.registry = registry
+	}
+	return t.registry
+}
+
+// newRegistry returns the registry of a name validated with the flags
+func (t *consulTarget) newRegistry(name string) interfaces.Registry {
+	if name == RegistryMemory {
+		return memory.New()
+	}
+	registry := consul.New(t.ConsulClient())
+	// keep the node meta data maintained by the node sync
+	registry.SkipNodeUpdate = t.syncNodes
+	// mark nodes created by registrations, so they can be cleaned up
+	registry.NodeMeta = t.managedNodeMeta()
+	registry.Agents = t.agents
+	return registry
+}
+
+// dryRunRegistry is a memory registry, which is seeded with the
+// registrations made by kube2consul in the backend the first time a location
+// is listed
+type dryRunRegistry struct {
+	*memory.Registry
+	backend interfaces.Registry
+	seeded  map[interfaces.Location]bool
+	lock    sync.Mutex
+}
+
+func newDryRunRegistry(backend interfaces.Registry) *dryRunRegistry {
+	return &dryRunRegistry{
+		Registry: memory.New(),
+		backend:  backend,
+		seeded:   make(map[interfaces.Location]bool),
+	}
+}
+
+func (r *dryRunRegistry) ListOwned(location interfaces.Location, owned func(tag string) bool) ([]interfaces.Endpoint, error) {
+	r.seed(location)
+	return r.Registry.ListOwned(location, owned)
+}
+
+func (r *dryRunRegistry) seed(location interfaces.Location) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.seeded[location] {
+		return
+	}
+	r.seeded[location] = true
+
+	endpoints, err := r.backend.ListOwned(location, func(tag string) bool {
+		_, _, ok := service.ParseOwnerTag(tag)
+		return ok
+	})
+	if err != nil {
+		log.WithField("location", location.String()).Warnf("Error getting registrations, dry run starts from an empty registry: %s", err)
+		return
+	}
+	for _, endpoint := range endpoints {
+		r.Registry.Register(endpoint)
+	}
+}
+
+// nodeEndpoints returns the registrations on a node in the given locations,
+// which are seeded first if needed
+func (r *dryRunRegistry) nodeEndpoints(locations []interfaces.Location, nodeName string) ([]interfaces.Endpoint, error) {
+	var nodeEndpoints []interfaces.Endpoint
+	for _, location := range locations {
+		endpoints, err := r.ListOwned(location, func(tag string) bool {
+			_, _, ok := service.ParseOwnerTag(tag)
+			return ok
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, endpoint := range endpoints {
+			if endpoint.NodeName == nodeName {
+				nodeEndpoints = append(nodeEndpoints, endpoint)
+			}
+		}
+	}
+	return nodeEndpoints, nil
+}
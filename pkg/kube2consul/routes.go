@@ -0,0 +1,190 @@
+package kube2consul
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	kapi "k8s.io/kubernetes/pkg/api"
+	kframework "k8s.io/kubernetes/pkg/controller/framework"
+
+	"github.com/jetstack-experimental/kube2consul/pkg/interfaces"
+	"github.com/jetstack-experimental/kube2consul/pkg/service"
+)
+
+// Annotations of kubernetes namespaces selecting the consul location of
+// their services, if enabled by --consul-route-annotations
+const (
+	ConsulDatacenterAnnotation = "kube2consul.io/consul-datacenter"
+	ConsulNamespaceAnnotation  = "kube2consul.io/consul-namespace"
+	ConsulPartitionAnnotation  = "kube2consul.io/consul-partition"
+)
+
+// consulRoute maps kubernetes namespaces to a consul location
+type consulRoute struct {
+	// namespaces is matched exactly or, if ending with '*', by prefix
+	namespaces string
+	location   interfaces.Location
+}
+
+func (r *consulRoute) matches(namespace string) bool {
+	if strings.HasSuffix(r.namespaces, "*") {
+		return strings.HasPrefix(namespace, strings.TrimSuffix(r.namespaces, "*"))
+	}
+	return namespace == r.namespaces
+}
+
+// parseRoute parses a route given as comma separated key=value pairs, e.g.
+// 'namespaces=team-a-*,datacenter=eu-west,namespace=team-a'
+func parseRoute(spec string) (consulRoute, error) {
+	var route consulRoute
+	for _, pair := range strings.Split(spec, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 {
+			return route, fmt.Errorf("invalid consul route '%s': expected key=value, got '%s'", spec, pair)
+		}
+		switch parts[0] {
+		case "namespaces":
+			route.namespaces = parts[1]
+		case "datacenter":
+			route.location.Datacenter = parts[1]
+		case "namespace":
+			route.location.Namespace = parts[1]
+		case "partition":
+			route.location.Partition = parts[1]
+		default:
+			return route, fmt.Errorf("invalid consul route '%s': unknown key '%s'", spec, parts[0])
+		}
+	}
+
+	if route.namespaces == "" {
+		return route, fmt.Errorf("invalid consul route '%s': namespaces is required", spec)
+	}
+	if route.location == (interfaces.Location{}) {
+		return route, fmt.Errorf("invalid consul route '%s': one of datacenter, namespace or partition is required", spec)
+	}
+	return route, nil
+}
+
+// routeLocation returns the consul location of the services of a kubernetes
+// namespace. Annotations of the namespace take precedence over the first
+// matching route.
+func (k *Kube2Consul) routeLocation(namespace string, annotations map[string]string) interfaces.Location {
+	if k.routeAnnotations {
+		location := interfaces.Location{
+			Datacenter: annotations[ConsulDatacenterAnnotation],
+			Namespace:  annotations[ConsulNamespaceAnnotation],
+			Partition:  annotations[ConsulPartitionAnnotation],
+		}
+		if location != (interfaces.Location{}) {
+			return location
+		}
+	}
+	for i := range k.routes {
+		if k.routes[i].matches(namespace) {
+			return k.routes[i].location
+		}
+	}
+	return interfaces.Location{}
+}
+
+// consulLocation returns the consul location of the services of a
+// kubernetes namespace and remembers it, so registrations left there are
+// found even after the route of the namespace changed
+func (k *Kube2Consul) consulLocation(namespace string) interfaces.Location {
+	location := k.routeLocation(namespace, k.namespaceAnnotations(namespace))
+
+	k.locationsLock.Lock()
+	k.locations[location] = true
+	k.locationsLock.Unlock()
+	return location
+}
+
+func (k *Kube2Consul) namespaceAnnotations(namespace string) map[string]string {
+	if !k.routeAnnotations {
+		return nil
+	}
+	obj, exists, err := k.Informers().Namespaces().GetIndexer().GetByKey(namespace)
+	if err != nil || !exists {
+		return nil
+	}
+	return obj.(*kapi.Namespace).Annotations
+}
+
+// consulLocations returns all locations registrations may be in, which are
+// looked at by ownership queries. The default location comes first.
+func (k *Kube2Consul) consulLocations() []interfaces.Location {
+	set := make(map[interfaces.Location]bool)
+	for i := range k.routes {
+		set[k.routes[i].location] = true
+	}
+	if k.routeAnnotations {
+		for _, obj := range k.Informers().Namespaces().GetStore().List() {
+			ns := obj.(*kapi.Namespace)
+			set[k.routeLocation(ns.Name, ns.Annotations)] = true
+		}
+	}
+	k.locationsLock.Lock()
+	for location := range k.locations {
+		set[location] = true
+	}
+	k.locationsLock.Unlock()
+	delete(set, interfaces.Location{})
+
+	locations := make([]interfaces.Location, 0, len(set))
+	for location := range set {
+		locations = append(locations, location)
+	}
+	sort.Sort(byLocation(locations))
+	return append([]interfaces.Location{{}}, locations...)
+}
+
+// withLocation returns a copy of endpoints placed in location
+func withLocation(endpoints []interfaces.Endpoint, location interfaces.Location) []interfaces.Endpoint {
+	located := make([]interfaces.Endpoint, len(endpoints))
+	for i, endpoint := range endpoints {
+		endpoint.Location = location
+		located[i] = endpoint
+	}
+	return located
+}
+
+// ownerLocation returns the consul location of the registrations of an
+// owner tag
+func (k *Kube2Consul) ownerLocation(tag string) interfaces.Location {
+	namespace, _, _ := service.ParseOwnerTag(tag)
+	return k.consulLocation(namespace)
+}
+
+// watchForNamespaces re-registers the services of a namespace once its
+// route annotations changed
+func (k *Kube2Consul) watchForNamespaces() {
+	k.Informers().Namespaces().AddEventHandler(k.afterSync(kframework.ResourceEventHandlerFuncs{
+		UpdateFunc: k.updateNamespace,
+	}))
+}
+
+func (k *Kube2Consul) updateNamespace(oldObj, obj interface{}) {
+	old, ok := oldObj.(*kapi.Namespace)
+	if !ok {
+		return
+	}
+	ns, ok := obj.(*kapi.Namespace)
+	if !ok {
+		return
+	}
+	if k.routeLocation(old.Name, old.Annotations) == k.routeLocation(ns.Name, ns.Annotations) {
+		return
+	}
+	k.queueServiceUpdates(ns.Name)
+}
+
+type byLocation []interfaces.Location
+
+func (l byLocation) Len() int           { return len(l) }
+func (l byLocation) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+func (l byLocation) Less(i, j int) bool { return l[i].String() < l[j].String() }
@@ -0,0 +1,262 @@
+package kube2consul
+
+import (
+	"fmt"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	kapi "k8s.io/kubernetes/pkg/api"
+	kcache "k8s.io/kubernetes/pkg/client/cache"
+
+	"github.com/jetstack-experimental/kube2consul/pkg/detect_node"
+	"github.com/jetstack-experimental/kube2consul/pkg/informers"
+	"github.com/jetstack-experimental/kube2consul/pkg/interfaces"
+	"github.com/jetstack-experimental/kube2consul/pkg/service"
+)
+
+// snapshot answers node lookups from pods and nodes listed once, so a sync
+// does not hit the apiserver for every endpoint address
+type snapshot struct {
+	interfaces.Kube2Consul
+	pods  interfaces.PodLister
+	nodes map[string]*kapi.Node
+}
+
+func newSnapshot(k interfaces.Kube2Consul, pods []kapi.Pod, nodes []kapi.Node) *snapshot {
+	podIndexer := kcache.NewIndexer(kcache.MetaNamespaceKeyFunc, informers.PodIndexers)
+	for i := range pods {
+		podIndexer.Add(&pods[i])
+	}
+	s := &snapshot{
+		Kube2Consul: k,
+		pods:        informers.NewPodLister(podIndexer),
+		nodes:       make(map[string]*kapi.Node),
+	}
+	for i := range nodes {
+		s.nodes[nodes[i].Name] = &nodes[i]
+	}
+	return s
+}
+
+func (s *snapshot) PodLister() interfaces.PodLister {
+	return s.pods
+}
+
+func (s *snapshot) NodeNameByPodIP(podIP string) (string, error) {
+	pod, err := s.pods.GetByIP(podIP)
+	if err != nil {
+		return "", err
+	}
+	return pod.Spec.NodeName, nil
+}
+
+func (s *snapshot) NodeByName(nodeName string) (*kapi.Node, error) {
+	if node, ok := s.nodes[nodeName]; ok {
+		return node, nil
+	}
+	return nil, fmt.Errorf("No node found with name %s", nodeName)
+}
+
+func (s *snapshot) NodeIPByPodIP(podIP string) (string, error) {
+	nodeName, err := s.NodeNameByPodIP(podIP)
+	if err != nil {
+		return "", err
+	}
+	node, err := s.NodeByName(nodeName)
+	if err != nil {
+		return "", err
+	}
+	return detect_node.NodeAddress(node)
+}
+
+func (k *Kube2Consul) cmdSync() error {
+	selector, err := k.labelSelector()
+	if err != nil {
+		return err
+	}
+	options := kapi.ListOptions{LabelSelector: selector}
+
+	svcs, err := k.KubernetesClientset().Core().Services(k.namespace).List(options)
+	if err != nil {
+		return fmt.Errorf("error getting services: %s", err)
+	}
+	endpoints, err := k.KubernetesClientset().Core().Endpoints(k.namespace).List(options)
+	if err != nil {
+		return fmt.Errorf("error getting endpoints: %s", err)
+	}
+	pods, err := k.KubernetesClientset().Core().Pods(k.namespace).List(kapi.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("error getting pods: %s", err)
+	}
+	nodes, err := k.KubernetesClientset().Core().Nodes().List(kapi.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("error getting nodes: %s", err)
+	}
+
+	snap := newSnapshot(k, pods.Items, nodes.Items)
+
+	// namespace annotations are looked up in the informer cache
+	if k.routeAnnotations {
+		k.Informers().Namespaces()
+		k.Informers().Start(k.stopCh)
+		if !k.Informers().WaitForCacheSync(k.stopCh) {
+			return fmt.Errorf("stopped before namespaces were listed")
+		}
+	}
+
+	var errs []error
+	if k.syncNodes {
+		for i := range nodes.Items {
+			reg, err := k.nodeRegistration(&nodes.Items[i])
+			if err == nil {
+				err = k.write("node/"+reg.Node, func(t *consulTarget) error {
+					return t.registerNode(reg)
+				})
+			}
+			if err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	if k.serviceOptions.NodeMaintenance == interfaces.NodeMaintenanceCheck {
+		for i := range nodes.Items {
+			if err := k.syncMaintenance(&nodes.Items[i]); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+
+	endpointsByKey := make(map[string]*kapi.Endpoints)
+	for i := range endpoints.Items {
+		e := &endpoints.Items[i]
+		endpointsByKey[fmt.Sprintf("%s/%s", e.Namespace, e.Name)] = e
+	}
+
+	claims := newNameClaims()
+	docs := make(map[string]*interfaces.ServiceMetadata)
+	ownerTags := make(map[string]bool)
+	for i := range svcs.Items {
+		svc := &svcs.Items[i]
+		ownerTags[service.OwnerTag(svc.Namespace, svc.Name)] = true
+
+		if !service.Exported(svc) {
+			continue
+		}
+		e, ok := endpointsByKey[fmt.Sprintf("%s/%s", svc.Namespace, svc.Name)]
+		if !ok {
+			continue
+		}
+
+		s := service.New(snap, svc.Namespace, svc.Name)
+		s.UpdateService(svc)
+		s.UpdateEndpoints(e)
+		docs[k.metadataKey(svc.Namespace, svc.Name)] = s.Metadata()
+		list, listErrs := s.List()
+		for _, err := range listErrs {
+			errs = append(errs, fmt.Errorf("%s/%s: %s", svc.Namespace, svc.Name, err))
+		}
+		claims.set(&nameOwner{
+			tag:       service.OwnerTag(svc.Namespace, svc.Name),
+			created:   svc.CreationTimestamp.Time,
+			endpoints: withLocation(list, k.consulLocation(svc.Namespace)),
+		})
+	}
+
+	if k.ingress {
+		ingresses, err := k.KubernetesClientset().Extensions().Ingresses(k.namespace).List(options)
+		if err != nil {
+			return fmt.Errorf("error getting ingresses: %s", err)
+		}
+		var controllerPods []*kapi.Pod
+		if k.ingressControllerPods != nil {
+			pods, err := k.KubernetesClientset().Core().Pods(k.ingressControllerNamespace).List(kapi.ListOptions{
+				LabelSelector: k.ingressControllerPods,
+			})
+			if err != nil {
+				return fmt.Errorf("error getting ingress controller pods: %s", err)
+			}
+			for i := range pods.Items {
+				controllerPods = append(controllerPods, &pods.Items[i])
+			}
+		}
+		for i := range ingresses.Items {
+			ing := &ingresses.Items[i]
+			ownerTags[service.IngressOwnerTag(ing.Namespace, ing.Name)] = true
+			list, err := k.ingressEndpoints(snap, controllerPods, ing)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("ingress %s/%s: %s", ing.Namespace, ing.Name, err))
+				continue
+			}
+			claims.set(&nameOwner{
+				tag:       service.IngressOwnerTag(ing.Namespace, ing.Name),
+				created:   ing.CreationTimestamp.Time,
+				endpoints: withLocation(list, k.consulLocation(ing.Namespace)),
+			})
+		}
+	}
+	desired := claims.resolveAll(k.conflictPolicy)
+
+	for _, err := range errs {
+		log.Warn(err)
+	}
+	failed := len(errs)
+	targets := k.consulTargets()
+	for _, t := range targets {
+		result := t.sync(desired, docs, k.syncOwnerFilter(ownerTags))
+		for _, err := range result.Errors {
+			log.WithField("target", t.name).Warn(err)
+		}
+		failed += len(result.Errors)
+
+		summary := result.String()
+		if len(targets) > 1 {
+			summary = fmt.Sprintf("%s: %s", t.name, summary)
+		}
+		if k.dryRun {
+			summary += " (dry run)"
+		}
+		fmt.Println(summary)
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("sync finished with %d errors", failed)
+	}
+	return nil
+}
+
+// sync reconciles the registrations and metadata documents in the target
+// with the desired ones
+func (t *consulTarget) sync(desired []interfaces.Endpoint, docs map[string]*interfaces.ServiceMetadata, owned func(string) bool) *syncResult {
+	existing, err := t.ownedEndpoints(owned)
+	if err != nil {
+		return &syncResult{Errors: []error{fmt.Errorf("error getting registrations from consul: %s", err)}}
+	}
+
+	result := t.reconcile(desired, existing)
+	if t.kvPrefix != "" {
+		result.Errors = append(result.Errors, t.syncMetadata(docs, t.selector == "")...)
+	}
+	return result
+}
+
+// syncOwnerFilter restricts the registrations considered by a sync to the
+// namespace and selector of the command. Services that no longer match a
+// label selector can't be told apart, so they are only cleaned up without one.
+// Ingress registrations are left alone unless ingresses are enabled.
+func (k *Kube2Consul) syncOwnerFilter(ownerTags map[string]bool) func(string) bool {
+	if k.selector != "" {
+		return func(tag string) bool {
+			return ownerTags[tag]
+		}
+	}
+	prefix := service.OwnerTagPrefix
+	if k.namespace != kapi.NamespaceAll {
+		prefix = service.OwnerTag(k.namespace, "")
+	}
+	return func(tag string) bool {
+		if !k.ingress && service.IsIngressOwnerTag(tag) {
+			return false
+		}
+		return strings.HasPrefix(tag, prefix)
+	}
+}
@@ -0,0 +1,63 @@
+package kube2consul
+
+import (
+	"reflect"
+	"testing"
+
+	consulapi "github.com/hashicorp/consul/api"
+
+	"github.com/jetstack-experimental/kube2consul/pkg/service"
+)
+
+func TestSync(t *testing.T) {
+	for _, dryRun := range []bool{false, true} {
+		f, consul := newE2E()
+		f.dryRun = dryRun
+		// default/web is registered on node-1 with an outdated port and
+		// missing on node-2, default/gone and unowned services are left over
+		consul.RegisterNode(consulapi.Node{Node: "node-1", Address: "10.0.0.1"})
+		consul.RegisterService("node-1", consulapi.AgentService{
+			ID:      "default-web",
+			Service: "default-web",
+			Port:    30081,
+			Tags:    []string{service.OwnerTag("default", "web")},
+		})
+		consul.RegisterService("node-1", consulapi.AgentService{
+			ID:      "default-gone",
+			Service: "default-gone",
+			Tags:    []string{service.OwnerTag("default", "gone")},
+		})
+		consul.RegisterService("node-1", consulapi.AgentService{ID: "other", Service: "other"})
+
+		if err := f.cmdSync(); err != nil {
+			t.Errorf("Dry run %t: unexpected error: %s", dryRun, err)
+		}
+
+		exp := map[string]int{"node-1/default-web": 30080, "node-2/default-web": 30080, "node-1/other": 0}
+		if dryRun {
+			exp = map[string]int{"node-1/default-web": 30081, "node-1/default-gone": 0, "node-1/other": 0}
+		}
+		act := make(map[string]int)
+		for key, svc := range consul.Services() {
+			act[key] = svc.Port
+		}
+		if !reflect.DeepEqual(exp, act) {
+			t.Errorf("Dry run %t: services %v, expected %v", dryRun, act, exp)
+		}
+		consul.Close()
+	}
+}
+
+func TestSyncFailed(t *testing.T) {
+	f, consul := newE2E()
+	defer consul.Close()
+	consul.Fail("/v1/catalog/register", 2)
+
+	// failed registrations make the sync fail
+	if err := f.cmdSync(); err == nil {
+		t.Error("Expected error of failed registrations")
+	}
+	if exp, act := 0, len(consul.Services()); exp != act {
+		t.Errorf("Registered %d services despite failures, expected %d", act, exp)
+	}
+}
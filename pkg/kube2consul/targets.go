@@ -0,0 +1,288 @@
+package kube2consul
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	consulapi "github.com/hashicorp/consul/api"
+
+	"github.com/jetstack-experimental/kube2consul/pkg/interfaces"
+	"github.com/jetstack-experimental/kube2consul/pkg/metrics"
+	"github.com/jetstack-experimental/kube2consul/pkg/registry/consul"
+)
+
+const (
+	// DefaultTargetName is the name of the consul target given by the
+	// --consul-* flags if no datacenter is configured
+	DefaultTargetName = "default"
+
+	// targetRetryDelay is the delay before a failed write is retried
+	targetRetryDelay = 10 * time.Second
+)
+
+// consulTarget is a consul cluster or datacenter registrations are written
+// to. All targets receive the same registrations, each through its own
+// write queue, so an unavailable target doesn't hold up the others.
+type consulTarget struct {
+	*Kube2Consul
+
+	name   string
+	client *consulapi.Client
+
+	registry     interfaces.Registry
+	registryLock sync.Mutex
+	agents       *consul.AgentNodes
+
+	queue *writeQueue
+
+	healthy    bool
+	healthLock sync.Mutex
+}
+
+func newConsulTarget(k *Kube2Consul, name string, config *consulapi.Config) (*consulTarget, error) {
+	if config.Transport == nil {
+		config.Transport = consulapi.DefaultConfig().Transport
+	}
+	httpClient, err := consulapi.NewHttpClient(config.Transport, config.TLSConfig)
+	if err != nil {
+		return nil, fmt.Errorf("consul target %s: %s", name, err)
+	}
+	httpClient.Transport = k.consulTransport(name, httpClient.Transport)
+	config.HttpClient = httpClient
+
+	client, err := consulapi.NewClient(config)
+	if err != nil {
+		return nil, fmt.Errorf("consul target %s: %s", name, err)
+	}
+	return &consulTarget{
+		Kube2Consul: k,
+		name:        name,
+		client:      client,
+		agents:      consul.NewAgentNodes(client),
+		queue:       newWriteQueue(),
+		healthy:     true,
+	}, nil
+}
+
+func (t *consulTarget) ConsulClient() *consulapi.Client {
+	return t.client
+}
+
+func (t *consulTarget) ConsulCatalog() *consulapi.Catalog {
+	return t.client.Catalog()
+}
+
+// consulTargets returns the target given by the --consul-* flags followed by
+// those given by --consul-target
+func (k *Kube2Consul) consulTargets() []*consulTarget {
+	k.targetsLock.Lock()
+	defer k.targetsLock.Unlock()
+
+	if k.targets == nil {
+		targets, err := k.newConsulTargets()
+		if err != nil {
+			panic(err.Error())
+		}
+		k.targets = targets
+	}
+	return k.targets
+}
+
+func (k *Kube2Consul) newConsulTargets() ([]*consulTarget, error) {
+	config := consulapi.DefaultConfig()
+	config.Address = k.consulAddress
+	config.Token = k.consulToken
+	config.Datacenter = k.consulDatacenter
+	// keep TLS settings of the environment unless overridden
+	if k.consulTLS.CAFile != "" {
+		config.TLSConfig.CAFile = k.consulTLS.CAFile
+	}
+	if k.consulTLS.CertFile != "" {
+		config.TLSConfig.CertFile = k.consulTLS.CertFile
+	}
+	if k.consulTLS.KeyFile != "" {
+		config.TLSConfig.KeyFile = k.consulTLS.KeyFile
+	}
+	if k.consulTLS.InsecureSkipVerify {
+		config.TLSConfig.InsecureSkipVerify = true
+	}
+	name := k.consulDatacenter
+	if name == "" {
+		name = DefaultTargetName
+	}
+
+	primary, err := newConsulTarget(k, name, config)
+	if err != nil {
+		return nil, err
+	}
+	targets := []*consulTarget{primary}
+	names := map[string]bool{name: true}
+	for _, spec := range k.targetSpecs {
+		name, config, err := parseTarget(spec)
+		if err != nil {
+			return nil, err
+		}
+		if names[name] {
+			return nil, fmt.Errorf("duplicate consul target name '%s'", name)
+		}
+		names[name] = true
+
+		target, err := newConsulTarget(k, name, config)
+		if err != nil {
+			return nil, err
+		}
+		targets = append(targets, target)
+	}
+	return targets, nil
+}
+
+// parseTarget parses a consul target given as comma separated key=value
+// pairs, e.g. 'name=eu,address=https://consul.eu:8501,datacenter=eu-west'.
+// The name defaults to the datacenter or the address. The ACL token is read
+// from a file, so it doesn't show up in the process list.
+func parseTarget(spec string) (string, *consulapi.Config, error) {
+	config := consulapi.DefaultConfig()
+	config.Address = ""
+	var name string
+
+	for _, pair := range strings.Split(spec, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 {
+			return "", nil, fmt.Errorf("invalid consul target '%s': expected key=value, got '%s'", spec, pair)
+		}
+		key, value := parts[0], parts[1]
+		switch key {
+		case "name":
+			name = value
+		case "address":
+			config.Address = value
+		case "datacenter":
+			config.Datacenter = value
+		case "token-file":
+			token, err := ioutil.ReadFile(value)
+			if err != nil {
+				return "", nil, fmt.Errorf("invalid consul target '%s': %s: %s", spec, key, err)
+			}
+			config.Token = strings.TrimSpace(string(token))
+		case "ca-file":
+			config.TLSConfig.CAFile = value
+		case "cert-file":
+			config.TLSConfig.CertFile = value
+		case "key-file":
+			config.TLSConfig.KeyFile = value
+		case "tls-skip-verify":
+			skip, err := strconv.ParseBool(value)
+			if err != nil {
+				return "", nil, fmt.Errorf("invalid consul target '%s': %s: %s", spec, key, err)
+			}
+			config.TLSConfig.InsecureSkipVerify = skip
+		default:
+			return "", nil, fmt.Errorf("invalid consul target '%s': unknown key '%s'", spec, key)
+		}
+	}
+
+	if config.Address == "" {
+		return "", nil, fmt.Errorf("invalid consul target '%s': address is required", spec)
+	}
+	if name == "" {
+		name = config.Datacenter
+	}
+	if name == "" {
+		name = config.Address
+	}
+	return name, config, nil
+}
+
+// write applies op to all consul targets. While running, writes are queued
+// per target and a pending write of the same key is replaced, so errors are
+// only logged. Otherwise they are applied in turn and all errors returned.
+func (k *Kube2Consul) write(key string, op func(*consulTarget) error) error {
+	targets := k.consulTargets()
+	if k.queueWrites {
+		for _, t := range targets {
+			t.queue.push(key, op)
+			metrics.ConsulQueueLength.WithLabelValues(t.name).Set(float64(t.queue.len()))
+		}
+		return nil
+	}
+
+	if len(targets) == 1 {
+		return op(targets[0])
+	}
+	var errs []string
+	for _, t := range targets {
+		if err := op(t); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %s", t.name, err))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// startConsulTargets switches to queued writes and starts a writer for each
+// target, as well as a drift watcher if enabled
+func (k *Kube2Consul) startConsulTargets() {
+	k.queueWrites = true
+	for _, t := range k.consulTargets() {
+		metrics.SetTargetHealth(t.name, nil)
+		go t.run()
+		if k.watchConsul && k.registryName == RegistryConsul && !k.dryRun {
+			go t.watchForDrift()
+		}
+		if k.nodeCleanupInterval > 0 && k.registryName == RegistryConsul {
+			go t.watchForEmptyNodes()
+		}
+	}
+}
+
+// run applies the queued writes until kube2consul is stopped. Failed writes
+// are retried after a delay unless they have been superseded by then.
+func (t *consulTarget) run() {
+	for {
+		select {
+		case <-t.stopCh:
+			return
+		case <-t.queue.signal:
+		}
+
+		for w := t.queue.pop(); w != nil; w = t.queue.pop() {
+			err := w.op(t)
+			t.setHealth(err)
+			if err != nil {
+				log.WithFields(log.Fields{"target": t.name, "key": w.key}).Warnf("Error writing to consul, retrying in %s: %s", targetRetryDelay, err)
+				failed := w
+				time.AfterFunc(targetRetryDelay, func() {
+					t.queue.retry(failed)
+				})
+			}
+			metrics.ConsulQueueLength.WithLabelValues(t.name).Set(float64(t.queue.len()))
+		}
+	}
+}
+
+// setHealth records the result of the last write and logs changes of the
+// health of the target
+func (t *consulTarget) setHealth(err error) {
+	t.healthLock.Lock()
+	healthy := t.healthy
+	t.healthy = err == nil
+	t.healthLock.Unlock()
+
+	if healthy && err != nil {
+		log.WithField("target", t.name).Warn("Consul target became unhealthy")
+	} else if !healthy && err == nil {
+		log.WithField("target", t.name).Info("Consul target recovered")
+	}
+	metrics.SetTargetHealth(t.name, err)
+}
@@ -0,0 +1,79 @@
+package kube2consul
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestParseTarget(t *testing.T) {
+	tokenFile, err := ioutil.TempFile("", "kube2consul-token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tokenFile.Name())
+	tokenFile.WriteString("secret\n")
+	tokenFile.Close()
+
+	for _, test := range []struct {
+		spec       string
+		name       string
+		address    string
+		datacenter string
+		token      string
+		skipVerify bool
+		err        bool
+	}{
+		{
+			spec:       "name=eu,address=https://consul.eu:8501,datacenter=eu-west,token-file=" + tokenFile.Name() + ",tls-skip-verify=true",
+			name:       "eu",
+			address:    "https://consul.eu:8501",
+			datacenter: "eu-west",
+			token:      "secret",
+			skipVerify: true,
+		},
+		{
+			spec:       " address=consul.eu:8500, datacenter=eu-west ,",
+			name:       "eu-west",
+			address:    "consul.eu:8500",
+			datacenter: "eu-west",
+		},
+		{
+			spec:    "address=consul.eu:8500",
+			name:    "consul.eu:8500",
+			address: "consul.eu:8500",
+		},
+		{spec: "name=eu", err: true},
+		{spec: "address", err: true},
+		{spec: "address=consul.eu:8500,token=secret", err: true},
+		{spec: "address=consul.eu:8500,token-file=/nonexistent", err: true},
+		{spec: "address=consul.eu:8500,tls-skip-verify=maybe", err: true},
+	} {
+		name, config, err := parseTarget(test.spec)
+		if test.err {
+			if err == nil {
+				t.Errorf("%s: expected error", test.spec)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.spec, err)
+			continue
+		}
+		if exp, act := test.name, name; exp != act {
+			t.Errorf("%s: name '%s' is not the expected '%s'", test.spec, act, exp)
+		}
+		if exp, act := test.address, config.Address; exp != act {
+			t.Errorf("%s: address '%s' is not the expected '%s'", test.spec, act, exp)
+		}
+		if exp, act := test.datacenter, config.Datacenter; exp != act {
+			t.Errorf("%s: datacenter '%s' is not the expected '%s'", test.spec, act, exp)
+		}
+		if exp, act := test.token, config.Token; exp != act {
+			t.Errorf("%s: token '%s' is not the expected '%s'", test.spec, act, exp)
+		}
+		if exp, act := test.skipVerify, config.TLSConfig.InsecureSkipVerify; exp != act {
+			t.Errorf("%s: tls-skip-verify %t is not the expected %t", test.spec, act, exp)
+		}
+	}
+}
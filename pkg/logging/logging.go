@@ -0,0 +1,119 @@
+package logging
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+// Warnings samples repetitive warnings, see SetSampleLimit
+var Warnings = NewSampler(0, time.Minute)
+
+// Setup configures the global logger
+func Setup(level string, format string) error {
+	lvl, err := log.ParseLevel(level)
+	if err != nil {
+		return err
+	}
+
+	switch format {
+	case FormatText:
+		log.SetFormatter(&log.TextFormatter{})
+	case FormatJSON:
+		log.SetFormatter(&log.JSONFormatter{})
+	default:
+		return fmt.Errorf("unknown log format '%s'", format)
+	}
+
+	log.SetOutput(os.Stderr)
+	log.SetLevel(lvl)
+	return nil
+}
+
+// SetSampleLimit limits the number of repetitive warnings logged per minute,
+// 0 disables sampling
+func SetSampleLimit(limit int) {
+	Warnings.mutex.Lock()
+	defer Warnings.mutex.Unlock()
+	Warnings.limit = limit
+}
+
+// Sampler limits how often messages with the same key are logged
+type Sampler struct {
+	limit    int
+	interval time.Duration
+	windows  map[string]*window
+	mutex    sync.Mutex
+
+	now func() time.Time
+	// called with the messages dropped of keys not seen again
+	report func(key string, dropped int)
+}
+
+type window struct {
+	start time.Time
+	count int
+}
+
+func NewSampler(limit int, interval time.Duration) *Sampler {
+	return &Sampler{
+		limit:    limit,
+		interval: interval,
+		windows:  make(map[string]*window),
+		now:      time.Now,
+		report:   reportDropped,
+	}
+}
+
+func reportDropped(key string, dropped int) {
+	log.WithField("suppressed", dropped).Warnf("Suppressed %d repetitions of: %s", dropped, key)
+}
+
+// Allow reports whether a message with key should be logged. It also returns
+// the number of messages with that key dropped in the previous interval, so
+// they can be mentioned in the next message that is logged.
+func (s *Sampler) Allow(key string) (allow bool, dropped int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.limit <= 0 {
+		return true, 0
+	}
+
+	now := s.now()
+	w, ok := s.windows[key]
+	if !ok || now.Sub(w.start) > s.interval {
+		if ok && w.count > s.limit {
+			dropped = w.count - s.limit
+		}
+		delete(s.windows, key)
+		s.prune(now)
+		s.windows[key] = &window{start: now, count: 1}
+		return true, dropped
+	}
+
+	w.count++
+	return w.count <= s.limit, 0
+}
+
+// prune forgets keys that have not been seen for an interval, after
+// reporting the messages dropped in their last one
+func (s *Sampler) prune(now time.Time) {
+	for key, w := range s.windows {
+		if now.Sub(w.start) <= s.interval {
+			continue
+		}
+		if w.count > s.limit {
+			s.report(key, w.count-s.limit)
+		}
+		delete(s.windows, key)
+	}
+}
@@ -0,0 +1,104 @@
+package logging
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// sample is a message passed to a sampler after advancing its clock
+type sample struct {
+	advance time.Duration
+	key     string
+	allow   bool
+	dropped int
+}
+
+func TestSampler(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		limit    int
+		samples  []sample
+		reported map[string]int
+		windows  int
+	}{
+		{
+			name:  "disabled",
+			limit: 0,
+			samples: []sample{
+				{key: "a", allow: true},
+				{key: "a", allow: true},
+			},
+			windows: 0,
+		},
+		{
+			name:  "limit per key",
+			limit: 2,
+			samples: []sample{
+				{key: "a", allow: true},
+				{key: "a", allow: true},
+				{key: "b", allow: true},
+				{key: "a", allow: false},
+				{advance: 30 * time.Second, key: "a", allow: false},
+			},
+			windows: 2,
+		},
+		{
+			name:  "dropped passed to the next message",
+			limit: 1,
+			samples: []sample{
+				{key: "a", allow: true},
+				{key: "a", allow: false},
+				{key: "a", allow: false},
+				{advance: 2 * time.Minute, key: "a", allow: true, dropped: 2},
+				{key: "a", allow: false},
+			},
+			windows: 1,
+		},
+		{
+			name:  "pruned",
+			limit: 1,
+			samples: []sample{
+				{key: "a", allow: true},
+				{key: "b", allow: true},
+				{key: "b", allow: false},
+				{advance: 2 * time.Minute, key: "c", allow: true},
+			},
+			reported: map[string]int{"b": 1},
+			windows:  1,
+		},
+		{
+			name:  "not pruned within the interval",
+			limit: 1,
+			samples: []sample{
+				{key: "a", allow: true},
+				{key: "a", allow: false},
+				{advance: 30 * time.Second, key: "b", allow: true},
+			},
+			windows: 2,
+		},
+	} {
+		now := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+		reported := make(map[string]int)
+		s := NewSampler(test.limit, time.Minute)
+		s.now = func() time.Time { return now }
+		s.report = func(key string, dropped int) { reported[key] += dropped }
+
+		for i, sample := range test.samples {
+			now = now.Add(sample.advance)
+			allow, dropped := s.Allow(sample.key)
+			if allow != sample.allow || dropped != sample.dropped {
+				t.Errorf("%s: message %d with key %s: got allow %t, dropped %d, expected %t, %d", test.name, i, sample.key, allow, dropped, sample.allow, sample.dropped)
+			}
+		}
+		if test.reported == nil {
+			test.reported = map[string]int{}
+		}
+		if !reflect.DeepEqual(test.reported, reported) {
+			t.Errorf("%s: reported drops %v, expected %v", test.name, reported, test.reported)
+		}
+		if exp, act := test.windows, len(s.windows); exp != act {
+			t.Errorf("%s: kept %d windows, expected %d", test.name, act, exp)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package metrics
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+)
+
+// TargetHealth is the state of a consul target as reported on /healthz
+type TargetHealth struct {
+	Healthy bool   `json:"healthy"`
+	Error   string `json:"error,omitempty"`
+}
+
+var health = struct {
+	sync.Mutex
+	targets map[string]TargetHealth
+}{targets: make(map[string]TargetHealth)}
+
+// SetTargetHealth records the result of the last write to a consul target
+func SetTargetHealth(target string, err error) {
+	state := TargetHealth{Healthy: err == nil}
+	if err != nil {
+		state.Error = err.Error()
+	}
+
+	health.Lock()
+	health.targets[target] = state
+	health.Unlock()
+
+	if state.Healthy {
+		ConsulTargetUp.WithLabelValues(target).Set(1)
+	} else {
+		ConsulTargetUp.WithLabelValues(target).Set(0)
+	}
+}
+
+// Health returns the state of all consul targets by name
+func Health() map[string]TargetHealth {
+	health.Lock()
+	defer health.Unlock()
+	targets := make(map[string]TargetHealth, len(health.targets))
+	for name, state := range health.targets {
+		targets[name] = state
+	}
+	return targets
+}
+
+// serveHealth responds with the state of all consul targets. The status is
+// 503 if any of them is unhealthy.
+func serveHealth(w http.ResponseWriter, r *http.Request) {
+	targets := Health()
+	status := http.StatusOK
+	for _, state := range targets {
+		if !state.Healthy {
+			status = http.StatusServiceUnavailable
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{"targets": targets})
+}
@@ -0,0 +1,111 @@
+package metrics
+
+import (
+	"net"
+	"net/http"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	ResultSuccess = "success"
+	ResultError   = "error"
+	ResultDryRun  = "dry_run"
+)
+
+var (
+	// ConsulOperations counts the write operations against the consul
+	// catalog by target, operation and result
+	ConsulOperations = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "kube2consul",
+			Name:      "consul_operations_total",
+			Help:      "Number of write operations against the consul catalog.",
+		},
+		[]string{"target", "operation", "result"},
+	)
+
+	// ConsulDrift counts registrations changed in consul by someone else,
+	// by target and kind of change: missing, changed or unexpected
+	ConsulDrift = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "kube2consul",
+			Name:      "consul_drift_total",
+			Help:      "Number of registrations found changed out-of-band in consul.",
+		},
+		[]string{"target", "kind"},
+	)
+
+	// ConsulTargetUp is 1 if the last write to a consul target succeeded
+	ConsulTargetUp = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "kube2consul",
+			Name:      "consul_target_up",
+			Help:      "Whether the last write to the consul target succeeded.",
+		},
+		[]string{"target"},
+	)
+
+	// ConsulNameConflicts is the number of kubernetes services and ingresses
+	// requesting a consul service name requested by others as well
+	ConsulNameConflicts = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: "kube2consul",
+			Name:      "consul_name_conflicts",
+			Help:      "Number of services and ingresses with conflicting consul service names.",
+		},
+	)
+
+	// ConsulQueueLength is the number of writes pending per consul target
+	ConsulQueueLength = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "kube2consul",
+			Name:      "consul_queue_length",
+			Help:      "Number of writes waiting to be applied to the consul target.",
+		},
+		[]string{"target"},
+	)
+
+	// ClientThrottleSeconds is the time API requests waited for the client
+	// side rate limit, by client (consul or kubernetes) and consul target
+	ClientThrottleSeconds = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "kube2consul",
+			Name:      "client_throttle_seconds",
+			Help:      "Time API requests waited for the client side rate limit.",
+			Buckets:   []float64{0.001, 0.01, 0.05, 0.1, 0.5, 1, 5, 10},
+		},
+		[]string{"client", "target"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(ConsulOperations)
+	prometheus.MustRegister(ConsulDrift)
+	prometheus.MustRegister(ConsulTargetUp)
+	prometheus.MustRegister(ConsulQueueLength)
+	prometheus.MustRegister(ConsulNameConflicts)
+	prometheus.MustRegister(ClientThrottleSeconds)
+}
+
+// Serve exposes the metrics and the health of the consul targets on address
+// in the background. It fails if address can't be listened on and returns
+// the listener, which stops serving once closed.
+func Serve(address string) (net.Listener, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", prometheus.Handler())
+	mux.HandleFunc("/healthz", serveHealth)
+	go func() {
+		log.Infof("Serving metrics on %s", listener.Addr())
+		if err := http.Serve(listener, mux); err != nil {
+			log.Warnf("Stopped serving metrics: %s", err)
+		}
+	}()
+	return listener, nil
+}
@@ -0,0 +1,77 @@
+package metrics
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func get(t *testing.T, url string) (int, string) {
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, string(body)
+}
+
+func TestServe(t *testing.T) {
+	listener, err := Serve("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	url := fmt.Sprintf("http://%s", listener.Addr())
+
+	// the address is bound before Serve returns
+	if _, err := Serve(listener.Addr().String()); err == nil {
+		t.Error("Expected error serving on an address in use")
+	}
+
+	SetTargetHealth("dc1", nil)
+	status, body := get(t, url+"/healthz")
+	if exp, act := http.StatusOK, status; exp != act {
+		t.Errorf("Status %d of healthy targets is not the expected %d", act, exp)
+	}
+
+	SetTargetHealth("dc2", errors.New("connection refused"))
+	status, body = get(t, url+"/healthz")
+	if exp, act := http.StatusServiceUnavailable, status; exp != act {
+		t.Errorf("Status %d of an unhealthy target is not the expected %d", act, exp)
+	}
+	var health struct {
+		Targets map[string]TargetHealth `json:"targets"`
+	}
+	if err := json.Unmarshal([]byte(body), &health); err != nil {
+		t.Fatal(err)
+	}
+	exp := map[string]TargetHealth{
+		"dc1": {Healthy: true},
+		"dc2": {Healthy: false, Error: "connection refused"},
+	}
+	if act := health.Targets; !reflect.DeepEqual(exp, act) {
+		t.Errorf("Health %v is not the expected %v", act, exp)
+	}
+
+	status, body = get(t, url+"/metrics")
+	if exp, act := http.StatusOK, status; exp != act {
+		t.Errorf("Status %d of metrics is not the expected %d", act, exp)
+	}
+	for _, line := range []string{
+		`kube2consul_consul_target_up{target="dc1"} 1`,
+		`kube2consul_consul_target_up{target="dc2"} 0`,
+	} {
+		if !strings.Contains(body, line) {
+			t.Errorf("Metrics don't contain '%s'", line)
+		}
+	}
+}
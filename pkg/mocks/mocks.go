@@ -5,7 +5,10 @@ package mocks
 
 import (
 	gomock "github.com/golang/mock/gomock"
-	release_1_3 "k8s.io/kubernetes/pkg/client/clientset_generated/release_1_3"
+	interfaces "github.com/jetstack-experimental/kube2consul/pkg/interfaces"
+	api "k8s.io/kubernetes/pkg/api"
+	internalclientset "k8s.io/kubernetes/pkg/client/clientset_generated/internalclientset"
+	record "k8s.io/kubernetes/pkg/client/record"
 	unversioned "k8s.io/kubernetes/pkg/client/unversioned"
 )
 
@@ -30,9 +33,9 @@ func (_m *MockKube2Consul) EXPECT() *_MockKube2ConsulRecorder {
 	return _m.recorder
 }
 
-func (_m *MockKube2Consul) KubernetesClientset() *release_1_3.Clientset {
+func (_m *MockKube2Consul) KubernetesClientset() internalclientset.Interface {
 	ret := _m.ctrl.Call(_m, "KubernetesClientset")
-	ret0, _ := ret[0].(*release_1_3.Clientset)
+	ret0, _ := ret[0].(internalclientset.Interface)
 	return ret0
 }
 
@@ -40,9 +43,9 @@ func (_mr *_MockKube2ConsulRecorder) KubernetesClientset() *gomock.Call {
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "KubernetesClientset")
 }
 
-func (_m *MockKube2Consul) KubernetesClient() *unversioned.Client {
+func (_m *MockKube2Consul) KubernetesClient() unversioned.Interface {
 	ret := _m.ctrl.Call(_m, "KubernetesClient")
-	ret0, _ := ret[0].(*unversioned.Client)
+	ret0, _ := ret[0].(unversioned.Interface)
 	return ret0
 }
 
@@ -50,6 +53,37 @@ func (_mr *_MockKube2ConsulRecorder) KubernetesClient() *gomock.Call {
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "KubernetesClient")
 }
 
+func (_m *MockKube2Consul) NodeLister() interfaces.NodeLister {
+	ret := _m.ctrl.Call(_m, "NodeLister")
+	ret0, _ := ret[0].(interfaces.NodeLister)
+	return ret0
+}
+
+func (_mr *_MockKube2ConsulRecorder) NodeLister() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "NodeLister")
+}
+
+func (_m *MockKube2Consul) PodLister() interfaces.PodLister {
+	ret := _m.ctrl.Call(_m, "PodLister")
+	ret0, _ := ret[0].(interfaces.PodLister)
+	return ret0
+}
+
+func (_mr *_MockKube2ConsulRecorder) PodLister() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "PodLister")
+}
+
+func (_m *MockKube2Consul) NodeByName(_param0 string) (*api.Node, error) {
+	ret := _m.ctrl.Call(_m, "NodeByName", _param0)
+	ret0, _ := ret[0].(*api.Node)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockKube2ConsulRecorder) NodeByName(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "NodeByName", arg0)
+}
+
 func (_m *MockKube2Consul) NodeIPByPodIP(_param0 string) (string, error) {
 	ret := _m.ctrl.Call(_m, "NodeIPByPodIP", _param0)
 	ret0, _ := ret[0].(string)
@@ -72,12 +106,180 @@ func (_mr *_MockKube2ConsulRecorder) NodeNameByPodIP(arg0 interface{}) *gomock.C
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "NodeNameByPodIP", arg0)
 }
 
-func (_m *MockKube2Consul) UpdateConsul(namespace string, name string, endpoints []Endpoint) error {
-	ret := _m.ctrl.Call(_m, "UpdateConsul", namespace, name, endpoints)
+func (_m *MockKube2Consul) ServiceOptions() *interfaces.ServiceOptions {
+	ret := _m.ctrl.Call(_m, "ServiceOptions")
+	ret0, _ := ret[0].(*interfaces.ServiceOptions)
+	return ret0
+}
+
+func (_mr *_MockKube2ConsulRecorder) ServiceOptions() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "ServiceOptions")
+}
+
+func (_m *MockKube2Consul) EventRecorder() record.EventRecorder {
+	ret := _m.ctrl.Call(_m, "EventRecorder")
+	ret0, _ := ret[0].(record.EventRecorder)
+	return ret0
+}
+
+func (_mr *_MockKube2ConsulRecorder) EventRecorder() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "EventRecorder")
+}
+
+func (_m *MockKube2Consul) UpdateConsul(namespace string, name string, endpoints []interfaces.Endpoint, metadata *interfaces.ServiceMetadata) error {
+	ret := _m.ctrl.Call(_m, "UpdateConsul", namespace, name, endpoints, metadata)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockKube2ConsulRecorder) UpdateConsul(arg0, arg1, arg2, arg3 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "UpdateConsul", arg0, arg1, arg2, arg3)
+}
+
+// Mock of NodeLister interface
+type MockNodeLister struct {
+	ctrl     *gomock.Controller
+	recorder *_MockNodeListerRecorder
+}
+
+// Recorder for MockNodeLister (not exported)
+type _MockNodeListerRecorder struct {
+	mock *MockNodeLister
+}
+
+func NewMockNodeLister(ctrl *gomock.Controller) *MockNodeLister {
+	mock := &MockNodeLister{ctrl: ctrl}
+	mock.recorder = &_MockNodeListerRecorder{mock}
+	return mock
+}
+
+func (_m *MockNodeLister) EXPECT() *_MockNodeListerRecorder {
+	return _m.recorder
+}
+
+func (_m *MockNodeLister) Get(name string) (*api.Node, error) {
+	ret := _m.ctrl.Call(_m, "Get", name)
+	ret0, _ := ret[0].(*api.Node)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockNodeListerRecorder) Get(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "Get", arg0)
+}
+
+func (_m *MockNodeLister) List() ([]*api.Node, error) {
+	ret := _m.ctrl.Call(_m, "List")
+	ret0, _ := ret[0].([]*api.Node)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockNodeListerRecorder) List() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "List")
+}
+
+// Mock of PodLister interface
+type MockPodLister struct {
+	ctrl     *gomock.Controller
+	recorder *_MockPodListerRecorder
+}
+
+// Recorder for MockPodLister (not exported)
+type _MockPodListerRecorder struct {
+	mock *MockPodLister
+}
+
+func NewMockPodLister(ctrl *gomock.Controller) *MockPodLister {
+	mock := &MockPodLister{ctrl: ctrl}
+	mock.recorder = &_MockPodListerRecorder{mock}
+	return mock
+}
+
+func (_m *MockPodLister) EXPECT() *_MockPodListerRecorder {
+	return _m.recorder
+}
+
+func (_m *MockPodLister) GetByIP(podIP string) (*api.Pod, error) {
+	ret := _m.ctrl.Call(_m, "GetByIP", podIP)
+	ret0, _ := ret[0].(*api.Pod)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockPodListerRecorder) GetByIP(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "GetByIP", arg0)
+}
+
+func (_m *MockPodLister) List() ([]*api.Pod, error) {
+	ret := _m.ctrl.Call(_m, "List")
+	ret0, _ := ret[0].([]*api.Pod)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockPodListerRecorder) List() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "List")
+}
+
+// Mock of Registry interface
+type MockRegistry struct {
+	ctrl     *gomock.Controller
+	recorder *_MockRegistryRecorder
+}
+
+// Recorder for MockRegistry (not exported)
+type _MockRegistryRecorder struct {
+	mock *MockRegistry
+}
+
+func NewMockRegistry(ctrl *gomock.Controller) *MockRegistry {
+	mock := &MockRegistry{ctrl: ctrl}
+	mock.recorder = &_MockRegistryRecorder{mock}
+	return mock
+}
+
+func (_m *MockRegistry) EXPECT() *_MockRegistryRecorder {
+	return _m.recorder
+}
+
+func (_m *MockRegistry) Register(endpoint interfaces.Endpoint) error {
+	ret := _m.ctrl.Call(_m, "Register", endpoint)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockRegistryRecorder) Register(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "Register", arg0)
+}
+
+func (_m *MockRegistry) Deregister(endpoint interfaces.Endpoint) error {
+	ret := _m.ctrl.Call(_m, "Deregister", endpoint)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockRegistryRecorder) Deregister(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "Deregister", arg0)
+}
+
+func (_m *MockRegistry) ListOwned(location interfaces.Location, owned func(string) bool) ([]interfaces.Endpoint, error) {
+	ret := _m.ctrl.Call(_m, "ListOwned", location, owned)
+	ret0, _ := ret[0].([]interfaces.Endpoint)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockRegistryRecorder) ListOwned(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "ListOwned", arg0, arg1)
+}
+
+func (_m *MockRegistry) UpdateHealth(endpoint interfaces.Endpoint) error {
+	ret := _m.ctrl.Call(_m, "UpdateHealth", endpoint)
 	ret0, _ := ret[0].(error)
 	return ret0
 }
 
-func (_mr *_MockKube2ConsulRecorder) UpdateConsul(arg0, arg1, arg2 interface{}) *gomock.Call {
-	return _mr.mock.ctrl.RecordCall(_mr.mock, "UpdateConsul", arg0, arg1, arg2)
+func (_mr *_MockRegistryRecorder) UpdateHealth(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "UpdateHealth", arg0)
 }
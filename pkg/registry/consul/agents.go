@@ -0,0 +1,83 @@
+package consul
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	consulapi "github.com/hashicorp/consul/api"
+
+	"github.com/jetstack-experimental/kube2consul/pkg/interfaces"
+)
+
+// SerfHealthCheckID is the ID of the check of nodes run by a consul agent
+const SerfHealthCheckID = "serfHealth"
+
+// AgentNodeTTL is how long it is remembered whether a node is run by a
+// consul agent, as agents may join nodes created by registrations later on
+const AgentNodeTTL = time.Minute
+
+// AgentNodes tells whether catalog nodes are run by a consul agent, which
+// maintains the node itself, including its address and meta data
+type AgentNodes struct {
+	client *consulapi.Client
+	// TTL limits how long results are cached
+	TTL time.Duration
+
+	nodes map[string]agentNode
+	lock  sync.Mutex
+}
+
+type agentNode struct {
+	agent   bool
+	expires time.Time
+}
+
+func NewAgentNodes(client *consulapi.Client) *AgentNodes {
+	return &AgentNodes{
+		client: client,
+		TTL:    AgentNodeTTL,
+		nodes:  make(map[string]agentNode),
+	}
+}
+
+// IsAgent returns whether a node in a location is run by a consul agent
+func (a *AgentNodes) IsAgent(location interfaces.Location, nodeName string) (bool, error) {
+	key := agentNodeKey(location, nodeName)
+	a.lock.Lock()
+	node, ok := a.nodes[key]
+	a.lock.Unlock()
+	if ok && time.Now().Before(node.expires) {
+		return node.agent, nil
+	}
+
+	// nodes aren't namespaced
+	location.Namespace = ""
+	checks, _, err := a.client.Health().Node(nodeName, QueryOptions(location))
+	if err != nil {
+		return false, fmt.Errorf("error getting checks of node %s: %s", nodeName, err)
+	}
+	node = agentNode{expires: time.Now().Add(a.TTL)}
+	for _, check := range checks {
+		if check.CheckID == SerfHealthCheckID {
+			node.agent = true
+		}
+	}
+
+	a.lock.Lock()
+	a.nodes[key] = node
+	a.lock.Unlock()
+	return node.agent, nil
+}
+
+// Forget drops the cached result of a node, e.g. once it has been
+// deregistered
+func (a *AgentNodes) Forget(location interfaces.Location, nodeName string) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	delete(a.nodes, agentNodeKey(location, nodeName))
+}
+
+func agentNodeKey(location interfaces.Location, nodeName string) string {
+	return fmt.Sprintf("%s/%s/%s", location.Datacenter, location.Partition, nodeName)
+}
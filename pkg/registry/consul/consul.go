@@ -0,0 +1,291 @@
+package consul
+
+import (
+	"fmt"
+
+	consulapi "github.com/hashicorp/consul/api"
+
+	"github.com/jetstack-experimental/kube2consul/pkg/interfaces"
+)
+
+// Registry registers endpoints in the consul catalog
+type Registry struct {
+	client *consulapi.Client
+	// SkipNodeUpdate keeps the node address and meta data untouched when
+	// registering services, e.g. as nodes are maintained separately
+	SkipNodeUpdate bool
+	// NodeMeta is set on nodes created or updated by registrations
+	NodeMeta map[string]string
+	// Agents tells which nodes are run by a consul agent, registrations
+	// never update them
+	Agents *AgentNodes
+}
+
+var _ interfaces.Registry = &Registry{}
+
+func New(client *consulapi.Client) *Registry {
+	return &Registry{
+		client: client,
+		Agents: NewAgentNodes(client),
+	}
+}
+
+func (r *Registry) Register(endpoint interfaces.Endpoint) error {
+	reg := &consulapi.CatalogRegistration{
+		Node:       endpoint.NodeName,
+		Address:    endpoint.NodeAddress,
+		Service:    AgentService(endpoint),
+		Datacenter: endpoint.Location.Datacenter,
+		Partition:  endpoint.Location.Partition,
+	}
+	updateNode, err := r.updateNode(endpoint)
+	if err != nil {
+		return err
+	}
+	if updateNode {
+		reg.NodeMeta = r.NodeMeta
+	} else {
+		reg.SkipNodeUpdate = true
+	}
+	if endpoint.Maintenance != "" {
+		reg.Check = MaintenanceCheck(endpoint)
+	}
+
+	if _, err := r.client.Catalog().Register(reg, WriteOptions(endpoint.Location)); err != nil {
+		return fmt.Errorf("error registering %s on node %s: %s", endpoint.DnsLabel, endpoint.NodeName, err)
+	}
+	return nil
+}
+
+// RegisterOps returns the transaction operations of registering an endpoint,
+// which write the same as Register
+func (r *Registry) RegisterOps(endpoint interfaces.Endpoint) (consulapi.TxnOps, error) {
+	var ops consulapi.TxnOps
+	updateNode, err := r.updateNode(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if updateNode {
+		ops = append(ops, &consulapi.TxnOp{Node: &consulapi.NodeTxnOp{
+			Verb: consulapi.NodeSet,
+			Node: consulapi.Node{
+				Node:       endpoint.NodeName,
+				Address:    endpoint.NodeAddress,
+				Datacenter: endpoint.Location.Datacenter,
+				Partition:  endpoint.Location.Partition,
+				Meta:       r.NodeMeta,
+			},
+		}})
+	}
+	ops = append(ops, &consulapi.TxnOp{Service: &consulapi.ServiceTxnOp{
+		Verb:    consulapi.ServiceSet,
+		Node:    endpoint.NodeName,
+		Service: *AgentService(endpoint),
+	}})
+	if endpoint.Maintenance != "" {
+		ops = append(ops, &consulapi.TxnOp{Check: &consulapi.CheckTxnOp{
+			Verb:  consulapi.CheckSet,
+			Check: HealthCheck(MaintenanceCheck(endpoint)),
+		}})
+	}
+	return ops, nil
+}
+
+// updateNode returns whether registering an endpoint writes its node, which
+// it doesn't if node updates are skipped or the node is run by a consul
+// agent, which maintains it
+func (r *Registry) updateNode(endpoint interfaces.Endpoint) (bool, error) {
+	if r.SkipNodeUpdate {
+		return false, nil
+	}
+	agent, err := r.Agents.IsAgent(endpoint.Location, endpoint.NodeName)
+	if err != nil {
+		return false, err
+	}
+	return !agent, nil
+}
+
+// DeregisterOps returns the transaction operations of Deregister
+func (r *Registry) DeregisterOps(endpoint interfaces.Endpoint) consulapi.TxnOps {
+	return consulapi.TxnOps{{Service: &consulapi.ServiceTxnOp{
+		Verb: consulapi.ServiceDelete,
+		Node: endpoint.NodeName,
+		Service: consulapi.AgentService{
+			ID:        endpoint.ServiceID(),
+			Namespace: endpoint.Location.Namespace,
+			Partition: endpoint.Location.Partition,
+		},
+	}}}
+}
+
+func (r *Registry) Deregister(endpoint interfaces.Endpoint) error {
+	dereg := &consulapi.CatalogDeregistration{
+		Node:       endpoint.NodeName,
+		ServiceID:  endpoint.ServiceID(),
+		Datacenter: endpoint.Location.Datacenter,
+		Namespace:  endpoint.Location.Namespace,
+		Partition:  endpoint.Location.Partition,
+	}
+
+	if _, err := r.client.Catalog().Deregister(dereg, WriteOptions(endpoint.Location)); err != nil {
+		return fmt.Errorf("error deregistering %s from node %s: %s", endpoint.DnsLabel, endpoint.NodeName, err)
+	}
+	return nil
+}
+
+func (r *Registry) ListOwned(location interfaces.Location, owned func(tag string) bool) ([]interfaces.Endpoint, error) {
+	services, _, err := r.client.Catalog().Services(QueryOptions(location))
+	if err != nil {
+		return nil, err
+	}
+
+	var endpoints []interfaces.Endpoint
+	for name, tags := range services {
+		if !hasTag(tags, owned) {
+			continue
+		}
+
+		// the health endpoint includes the checks, which tell about
+		// maintenance
+		entries, _, err := r.client.Health().Service(name, "", false, QueryOptions(location))
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			if !hasTag(entry.Service.Tags, owned) {
+				continue
+			}
+			endpoint := interfaces.Endpoint{
+				ID:          entry.Service.ID,
+				DnsLabel:    entry.Service.Service,
+				NodeAddress: entry.Node.Address,
+				NodeName:    entry.Node.Node,
+				NodePort:    int32(entry.Service.Port),
+				Address:     entry.Service.Address,
+				Tags:        entry.Service.Tags,
+				Meta:        entry.Service.Meta,
+				Location:    location,
+			}
+			for _, check := range entry.Checks {
+				if check.CheckID == MaintenanceCheckID(endpoint) {
+					endpoint.Maintenance = check.Notes
+				}
+			}
+			endpoints = append(endpoints, endpoint)
+		}
+	}
+	return endpoints, nil
+}
+
+// UpdateHealth registers or removes the maintenance check of an endpoint
+func (r *Registry) UpdateHealth(endpoint interfaces.Endpoint) error {
+	if endpoint.Maintenance != "" {
+		return r.Register(endpoint)
+	}
+
+	dereg := &consulapi.CatalogDeregistration{
+		Node:       endpoint.NodeName,
+		CheckID:    MaintenanceCheckID(endpoint),
+		Datacenter: endpoint.Location.Datacenter,
+		Namespace:  endpoint.Location.Namespace,
+		Partition:  endpoint.Location.Partition,
+	}
+	if _, err := r.client.Catalog().Deregister(dereg, WriteOptions(endpoint.Location)); err != nil {
+		return fmt.Errorf("error deregistering maintenance check of %s from node %s: %s", endpoint.DnsLabel, endpoint.NodeName, err)
+	}
+	return nil
+}
+
+// UpdateHealthOps returns the transaction operations of UpdateHealth
+func (r *Registry) UpdateHealthOps(endpoint interfaces.Endpoint) (consulapi.TxnOps, error) {
+	if endpoint.Maintenance != "" {
+		return r.RegisterOps(endpoint)
+	}
+	return consulapi.TxnOps{{Check: &consulapi.CheckTxnOp{
+		Verb: consulapi.CheckDelete,
+		Check: consulapi.HealthCheck{
+			Node:      endpoint.NodeName,
+			CheckID:   MaintenanceCheckID(endpoint),
+			Namespace: endpoint.Location.Namespace,
+			Partition: endpoint.Location.Partition,
+		},
+	}}}, nil
+}
+
+// AgentService returns the catalog service of an endpoint
+func AgentService(endpoint interfaces.Endpoint) *consulapi.AgentService {
+	return &consulapi.AgentService{
+		ID:        endpoint.ServiceID(),
+		Service:   endpoint.DnsLabel,
+		Tags:      endpoint.Tags,
+		Meta:      endpoint.Meta,
+		Port:      int(endpoint.NodePort),
+		Address:   endpoint.Address,
+		Namespace: endpoint.Location.Namespace,
+		Partition: endpoint.Location.Partition,
+	}
+}
+
+// QueryOptions returns the options of reads in a location
+func QueryOptions(location interfaces.Location) *consulapi.QueryOptions {
+	return &consulapi.QueryOptions{
+		Datacenter: location.Datacenter,
+		Namespace:  location.Namespace,
+		Partition:  location.Partition,
+	}
+}
+
+// WriteOptions returns the options of writes in a location
+func WriteOptions(location interfaces.Location) *consulapi.WriteOptions {
+	return &consulapi.WriteOptions{
+		Datacenter: location.Datacenter,
+		Namespace:  location.Namespace,
+		Partition:  location.Partition,
+	}
+}
+
+// MaintenanceCheckID returns the ID of the maintenance check of an endpoint,
+// following the naming of consul's own service maintenance mode
+func MaintenanceCheckID(endpoint interfaces.Endpoint) string {
+	return fmt.Sprintf("_service_maintenance:%s", endpoint.ServiceID())
+}
+
+// MaintenanceCheck returns the critical check putting an endpoint into
+// maintenance, the reason is kept in the notes
+func MaintenanceCheck(endpoint interfaces.Endpoint) *consulapi.AgentCheck {
+	return &consulapi.AgentCheck{
+		Node:      endpoint.NodeName,
+		CheckID:   MaintenanceCheckID(endpoint),
+		Name:      "Service Maintenance Mode",
+		Notes:     endpoint.Maintenance,
+		Status:    consulapi.HealthCritical,
+		Output:    endpoint.Maintenance,
+		ServiceID: endpoint.ServiceID(),
+		Namespace: endpoint.Location.Namespace,
+		Partition: endpoint.Location.Partition,
+	}
+}
+
+// HealthCheck converts a check registration into its transaction form
+func HealthCheck(check *consulapi.AgentCheck) consulapi.HealthCheck {
+	return consulapi.HealthCheck{
+		Node:      check.Node,
+		CheckID:   check.CheckID,
+		Name:      check.Name,
+		Status:    check.Status,
+		Notes:     check.Notes,
+		Output:    check.Output,
+		ServiceID: check.ServiceID,
+		Namespace: check.Namespace,
+		Partition: check.Partition,
+	}
+}
+
+func hasTag(tags []string, match func(tag string) bool) bool {
+	for _, tag := range tags {
+		if match(tag) {
+			return true
+		}
+	}
+	return false
+}
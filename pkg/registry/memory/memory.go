@@ -0,0 +1,80 @@
+package memory
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/jetstack-experimental/kube2consul/pkg/interfaces"
+)
+
+// Registry keeps registrations in memory, for tests and dry runs
+type Registry struct {
+	endpoints map[string]interfaces.Endpoint
+	mutex     sync.Mutex
+}
+
+var _ interfaces.Registry = &Registry{}
+
+func New() *Registry {
+	return &Registry{
+		endpoints: make(map[string]interfaces.Endpoint),
+	}
+}
+
+func key(endpoint interfaces.Endpoint) string {
+	return fmt.Sprintf("%s/%s/%s", endpoint.Location, endpoint.NodeName, endpoint.ServiceID())
+}
+
+func (r *Registry) Register(endpoint interfaces.Endpoint) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.endpoints[key(endpoint)] = endpoint
+	return nil
+}
+
+func (r *Registry) Deregister(endpoint interfaces.Endpoint) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	delete(r.endpoints, key(endpoint))
+	return nil
+}
+
+// ListOwned returns the matching registrations ordered by node and service ID
+func (r *Registry) ListOwned(location interfaces.Location, owned func(tag string) bool) ([]interfaces.Endpoint, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	keys := make([]string, 0, len(r.endpoints))
+	for k := range r.endpoints {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var endpoints []interfaces.Endpoint
+	for _, k := range keys {
+		if r.endpoints[k].Location != location {
+			continue
+		}
+		for _, tag := range r.endpoints[k].Tags {
+			if owned(tag) {
+				endpoints = append(endpoints, r.endpoints[k])
+				break
+			}
+		}
+	}
+	return endpoints, nil
+}
+
+func (r *Registry) UpdateHealth(endpoint interfaces.Endpoint) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	existing, ok := r.endpoints[key(endpoint)]
+	if !ok {
+		return fmt.Errorf("%s is not registered on node %s", endpoint.ServiceID(), endpoint.NodeName)
+	}
+	existing.Maintenance = endpoint.Maintenance
+	r.endpoints[key(endpoint)] = existing
+	return nil
+}
@@ -0,0 +1,107 @@
+package memory
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/jetstack-experimental/kube2consul/pkg/interfaces"
+)
+
+// ownedBy returns a filter matching tags with prefix
+func ownedBy(prefix string) func(string) bool {
+	return func(tag string) bool {
+		return strings.HasPrefix(tag, prefix)
+	}
+}
+
+// listed returns the node and service ID of endpoints
+func listed(endpoints []interfaces.Endpoint) []string {
+	var list []string
+	for _, endpoint := range endpoints {
+		list = append(list, fmt.Sprintf("%s/%s", endpoint.NodeName, endpoint.ServiceID()))
+	}
+	return list
+}
+
+func TestRegistry(t *testing.T) {
+	r := New()
+	eu := interfaces.Location{Datacenter: "eu"}
+	for _, endpoint := range []interfaces.Endpoint{
+		{DnsLabel: "web", NodeName: "node-2", Tags: []string{"owner-a"}},
+		{DnsLabel: "web", NodeName: "node-1", Tags: []string{"other", "owner-a"}},
+		{DnsLabel: "db", ID: "db-0", NodeName: "node-1", Tags: []string{"owner-b"}},
+		{DnsLabel: "web", NodeName: "node-1", Tags: []string{"owner-a"}, Location: eu},
+		{DnsLabel: "cache", NodeName: "node-1", Tags: []string{"other"}},
+	} {
+		if err := r.Register(endpoint); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, test := range []struct {
+		location interfaces.Location
+		prefix   string
+		exp      []string
+	}{
+		// ordered by node and service ID
+		{prefix: "owner-", exp: []string{"node-1/db-0", "node-1/web", "node-2/web"}},
+		{prefix: "owner-a", exp: []string{"node-1/web", "node-2/web"}},
+		{location: eu, prefix: "owner-", exp: []string{"node-1/web"}},
+		{prefix: "none", exp: nil},
+	} {
+		endpoints, err := r.ListOwned(test.location, ownedBy(test.prefix))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if act := listed(endpoints); !reflect.DeepEqual(test.exp, act) {
+			t.Errorf("%s in '%s': registrations %v are not the expected %v", test.prefix, test.location, act, test.exp)
+		}
+	}
+
+	// registering again replaces the registration
+	if err := r.Register(interfaces.Endpoint{DnsLabel: "web", NodeName: "node-2", NodePort: 8080, Tags: []string{"owner-a"}}); err != nil {
+		t.Fatal(err)
+	}
+	endpoints, _ := r.ListOwned(interfaces.Location{}, ownedBy("owner-a"))
+	if exp, act := int32(8080), endpoints[1].NodePort; exp != act {
+		t.Errorf("Port %d is not the expected %d", act, exp)
+	}
+
+	// deregistering only affects the location of the endpoint
+	if err := r.Deregister(interfaces.Endpoint{DnsLabel: "web", NodeName: "node-1"}); err != nil {
+		t.Fatal(err)
+	}
+	endpoints, _ = r.ListOwned(interfaces.Location{}, ownedBy("owner-a"))
+	if exp, act := []string{"node-2/web"}, listed(endpoints); !reflect.DeepEqual(exp, act) {
+		t.Errorf("Registrations %v are not the expected %v", act, exp)
+	}
+	endpoints, _ = r.ListOwned(eu, ownedBy("owner-a"))
+	if exp, act := []string{"node-1/web"}, listed(endpoints); !reflect.DeepEqual(exp, act) {
+		t.Errorf("Registrations in %s %v are not the expected %v", eu, act, exp)
+	}
+}
+
+func TestRegistryUpdateHealth(t *testing.T) {
+	r := New()
+	endpoint := interfaces.Endpoint{DnsLabel: "web", NodeName: "node-1", Tags: []string{"owner"}}
+	if err := r.UpdateHealth(endpoint); err == nil {
+		t.Error("Expected error of an endpoint not registered")
+	}
+
+	r.Register(endpoint)
+	endpoint.Maintenance = "node cordoned"
+	endpoint.NodePort = 8080
+	if err := r.UpdateHealth(endpoint); err != nil {
+		t.Fatal(err)
+	}
+	endpoints, _ := r.ListOwned(interfaces.Location{}, ownedBy("owner"))
+	if exp, act := "node cordoned", endpoints[0].Maintenance; exp != act {
+		t.Errorf("Maintenance '%s' is not the expected '%s'", act, exp)
+	}
+	// only the health is updated
+	if exp, act := int32(0), endpoints[0].NodePort; exp != act {
+		t.Errorf("Port %d is not the expected %d", act, exp)
+	}
+}
@@ -0,0 +1,109 @@
+package service
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	kapi "k8s.io/kubernetes/pkg/api"
+
+	"github.com/jetstack-experimental/kube2consul/pkg/detect_node"
+	"github.com/jetstack-experimental/kube2consul/pkg/interfaces"
+)
+
+// ordinalSuffix matches the ordinal of pods created by a StatefulSet
+var ordinalSuffix = regexp.MustCompile("-([0-9]+)$")
+
+// statefulOwnerKinds are the controllers giving pods a stable ordinal
+var statefulOwnerKinds = map[string]bool{"StatefulSet": true, "PetSet": true}
+
+// ListPods returns one endpoint per pod and port of a headless service, so
+// pods can be addressed individually, e.g. as db-0.<service>.service.consul
+func (s *Service) ListPods() ([]interfaces.Endpoint, []error) {
+	var errs []error
+	var endpoints []interfaces.Endpoint
+
+	tags := append([]string{OwnerTag(s.Namespace, s.Name)}, s.mappedTags()...)
+	meta := s.mappedMeta()
+	maintenance := s.maintenanceReason()
+
+	for _, subset := range s.k8sEndpoints.Subsets {
+		ports := make([]portKey, len(subset.Ports))
+		for i, port := range subset.Ports {
+			ports[i] = portKey{Name: port.Name, Port: port.Port, Protocol: port.Protocol}
+		}
+		names := s.portNames(ports)
+
+		for _, addr := range subset.Addresses {
+			podName := addr.Hostname
+			if podName == "" && addr.TargetRef != nil {
+				podName = addr.TargetRef.Name
+			}
+			if podName == "" {
+				podName = strings.Replace(addr.IP, ".", "-", -1)
+			}
+
+			nodeName, err := s.kube2consul.NodeNameByPodIP(addr.IP)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("unable to get node of PodIP %s: %s", addr.IP, err))
+				continue
+			}
+			node, err := s.kube2consul.NodeByName(nodeName)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("unable to get node %s: %s", nodeName, err))
+				continue
+			}
+			if s.withdrawn(node) {
+				continue
+			}
+			nodeAddress, err := detect_node.NodeAddress(node)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+
+			podTags := append(append([]string{}, tags...), podName)
+			if match := ordinalSuffix.FindStringSubmatch(podName); match != nil && s.stableIdentity(addr) {
+				podTags = append(podTags, fmt.Sprintf("ordinal-%s", match[1]))
+			}
+
+			for i, port := range subset.Ports {
+				name, original := sanitizedName(names[i])
+				endpoints = append(endpoints, interfaces.Endpoint{
+					ID:           fmt.Sprintf("%s-%s", name, podName),
+					DnsLabel:     name,
+					OriginalName: original,
+					NodeName:     nodeName,
+					NodeAddress:  nodeAddress,
+					NodePort:     port.Port,
+					Address:      addr.IP,
+					Tags:         append(append([]string{}, podTags...), protocolTag(port.Protocol)),
+					Meta:         portMeta(meta, port.Protocol),
+					Maintenance:  maintenance,
+				})
+			}
+		}
+	}
+
+	return endpoints, errs
+}
+
+// stableIdentity returns whether the pod behind an address keeps its name,
+// either owned by a StatefulSet or with a hostname in the subdomain of the
+// service, so a numeric suffix of any other pod is not taken as an ordinal
+func (s *Service) stableIdentity(addr kapi.EndpointAddress) bool {
+	// only set by kubernetes if the subdomain of the pod matches the service
+	if addr.Hostname != "" {
+		return true
+	}
+	pod, err := s.kube2consul.PodLister().GetByIP(addr.IP)
+	if err != nil {
+		return false
+	}
+	for _, owner := range pod.OwnerReferences {
+		if statefulOwnerKinds[owner.Kind] {
+			return true
+		}
+	}
+	return pod.Spec.Hostname != "" && pod.Spec.Subdomain == s.Name
+}
@@ -0,0 +1,63 @@
+package service
+
+import (
+	kapi "k8s.io/kubernetes/pkg/api"
+
+	"github.com/jetstack-experimental/kube2consul/pkg/interfaces"
+)
+
+// MaintenanceAnnotation puts a node or service into maintenance, its value is
+// used as the reason
+const MaintenanceAnnotation = "kube2consul.io/maintenance"
+
+// DefaultMaintenanceReason is used for services annotated without a reason
+const DefaultMaintenanceReason = "Service is in maintenance"
+
+// maintenanceAnnotation returns the reason given by the maintenance
+// annotation, which is defaultReason for an empty or 'true' value
+func maintenanceAnnotation(annotations map[string]string, defaultReason string) (bool, string) {
+	reason, ok := annotations[MaintenanceAnnotation]
+	if !ok || reason == "false" {
+		return false, ""
+	}
+	if reason == "" || reason == "true" {
+		reason = defaultReason
+	}
+	return true, reason
+}
+
+// NodeInMaintenance checks if a node is cordoned or annotated for
+// maintenance and returns the reason
+func NodeInMaintenance(node *kapi.Node) (bool, string) {
+	if ok, reason := maintenanceAnnotation(node.Annotations, "Node is annotated for maintenance"); ok {
+		return true, reason
+	}
+	if node.Spec.Unschedulable {
+		return true, "Node is cordoned"
+	}
+	return false, ""
+}
+
+// maintenanceReason returns the reason all instances of the service are in
+// maintenance, or an empty string
+func (s *Service) maintenanceReason() string {
+	defaultReason := s.options().MaintenanceReason
+	if defaultReason == "" {
+		defaultReason = DefaultMaintenanceReason
+	}
+	_, reason := maintenanceAnnotation(s.k8sService.Annotations, defaultReason)
+	return reason
+}
+
+// withdrawn checks if the registrations on a node have to be removed, as it
+// is in maintenance
+func (s *Service) withdrawn(node *kapi.Node) bool {
+	if s.options().NodeMaintenance != interfaces.NodeMaintenanceWithdraw {
+		return false
+	}
+	maintenance, reason := NodeInMaintenance(node)
+	if maintenance {
+		s.log("list").Debugf("Skipping node %s in maintenance: %s", node.Name, reason)
+	}
+	return maintenance
+}
@@ -0,0 +1,110 @@
+package service
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/jetstack-experimental/kube2consul/pkg/interfaces"
+)
+
+const (
+	MetaNamespace    = "k8s-namespace"
+	MetaServiceUID   = "k8s-service-uid"
+	MetaPortProtocol = "k8s-port-protocol"
+
+	// limits of consul service meta data
+	maxMetaKeyLength   = 128
+	maxMetaValueLength = 512
+)
+
+var invalidMetaKeyChars = regexp.MustCompile("[^a-zA-Z0-9_-]")
+
+// MatchKey checks if key is allowed by one of patterns, which match either
+// exactly or, if ending with '*', by prefix
+func MatchKey(patterns []string, key string) bool {
+	for _, pattern := range patterns {
+		if strings.HasSuffix(pattern, "*") {
+			if strings.HasPrefix(key, strings.TrimSuffix(pattern, "*")) {
+				return true
+			}
+		} else if pattern == key {
+			return true
+		}
+	}
+	return false
+}
+
+// sortedKeys returns the keys of m matching patterns in a stable order
+func sortedKeys(m map[string]string, patterns []string) []string {
+	var keys []string
+	for key := range m {
+		if MatchKey(patterns, key) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// MetaKey converts a label or annotation key into a valid consul meta key
+func MetaKey(key string) string {
+	key = invalidMetaKeyChars.ReplaceAllString(key, "_")
+	if len(key) > maxMetaKeyLength {
+		key = key[:maxMetaKeyLength]
+	}
+	return key
+}
+
+func (s *Service) options() *interfaces.ServiceOptions {
+	if s.serviceOptions == nil {
+		return &interfaces.ServiceOptions{}
+	}
+	return s.serviceOptions
+}
+
+// mappedTags returns the consul tags configured for the service's labels and
+// annotations. Empty values give no tag in the value-only format.
+func (s *Service) mappedTags() []string {
+	opts := s.options()
+	var tags []string
+	add := func(m map[string]string, patterns []string) {
+		for _, key := range sortedKeys(m, patterns) {
+			if opts.TagFormat == interfaces.TagFormatValue {
+				if m[key] != "" {
+					tags = append(tags, m[key])
+				}
+			} else {
+				tags = append(tags, fmt.Sprintf("%s=%s", key, m[key]))
+			}
+		}
+	}
+	add(s.k8sService.Labels, opts.LabelTags)
+	add(s.k8sService.Annotations, opts.AnnotationTags)
+	return tags
+}
+
+// mappedMeta returns the consul service meta data of the service, including
+// the built-in namespace and UID fields
+func (s *Service) mappedMeta() map[string]string {
+	opts := s.options()
+	meta := make(map[string]string)
+	add := func(m map[string]string, patterns []string) {
+		for _, key := range sortedKeys(m, patterns) {
+			value := m[key]
+			if len(value) > maxMetaValueLength {
+				value = value[:maxMetaValueLength]
+			}
+			meta[MetaKey(key)] = value
+		}
+	}
+	add(s.k8sService.Labels, opts.LabelMeta)
+	add(s.k8sService.Annotations, opts.AnnotationMeta)
+
+	meta[MetaNamespace] = s.Namespace
+	if s.k8sService.UID != "" {
+		meta[MetaServiceUID] = string(s.k8sService.UID)
+	}
+	return meta
+}
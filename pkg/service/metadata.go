@@ -0,0 +1,45 @@
+package service
+
+import (
+	"github.com/jetstack-experimental/kube2consul/pkg/interfaces"
+)
+
+// Metadata describes the kubernetes service and the consul services it is
+// exported as
+func (s *Service) Metadata() *interfaces.ServiceMetadata {
+	svc := s.k8sService
+	metadata := &interfaces.ServiceMetadata{
+		Namespace:   s.Namespace,
+		Name:        s.Name,
+		UID:         string(svc.UID),
+		Type:        string(svc.Spec.Type),
+		ClusterIP:   svc.Spec.ClusterIP,
+		Labels:      svc.Labels,
+		Annotations: svc.Annotations,
+	}
+
+	for _, port := range svc.Spec.Ports {
+		metadata.Ports = append(metadata.Ports, interfaces.PortMetadata{
+			Name:       port.Name,
+			Protocol:   string(port.Protocol),
+			Port:       port.Port,
+			TargetPort: port.TargetPort.String(),
+			NodePort:   port.NodePort,
+		})
+	}
+
+	for _, owner := range svc.OwnerReferences {
+		metadata.Owners = append(metadata.Owners, interfaces.OwnerMetadata{
+			APIVersion: owner.APIVersion,
+			Kind:       owner.Kind,
+			Name:       owner.Name,
+			UID:        string(owner.UID),
+		})
+	}
+
+	for _, port := range s.ListPorts() {
+		metadata.ConsulServices = append(metadata.ConsulServices, port.DnsLabel)
+	}
+
+	return metadata
+}
@@ -0,0 +1,115 @@
+package service
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	kapi "k8s.io/kubernetes/pkg/api"
+
+	"github.com/jetstack-experimental/kube2consul/pkg/interfaces"
+)
+
+const (
+	// MaxNameLength is the longest consul service name served by consul DNS
+	MaxNameLength = 63
+
+	// nameHashLength is the number of hex digits of the hash appended to
+	// shortened names
+	nameHashLength = 8
+
+	// InvalidNameReason is the reason of events about services registered
+	// under a sanitized consul service name
+	InvalidNameReason = "InvalidConsulServiceName"
+)
+
+var invalidNameChars = regexp.MustCompile("[^a-zA-Z0-9-]+")
+
+// ValidateName returns why name can't be served by consul DNS, which only
+// serves labels of letters, digits and '-' up to 63 characters, or nil
+func ValidateName(name string) error {
+	switch {
+	case name == "":
+		return fmt.Errorf("consul service name is empty")
+	case len(name) > MaxNameLength:
+		return fmt.Errorf("consul service name '%s' is longer than %d characters", name, MaxNameLength)
+	case invalidNameChars.MatchString(name):
+		return fmt.Errorf("consul service name '%s' contains characters other than letters, digits and '-'", name)
+	case strings.HasPrefix(name, "-") || strings.HasSuffix(name, "-"):
+		return fmt.Errorf("consul service name '%s' starts or ends with '-'", name)
+	}
+	return nil
+}
+
+// SanitizeName turns name into a valid consul service name. Invalid
+// characters are replaced by '-'. Names that are still too long are truncated
+// and get a hash of the original name appended, so they stay unique and
+// don't change between runs.
+func SanitizeName(name string) string {
+	if ValidateName(name) == nil {
+		return name
+	}
+
+	sanitized := strings.Trim(invalidNameChars.ReplaceAllString(name, "-"), "-")
+	if sanitized != "" && len(sanitized) <= MaxNameLength {
+		return sanitized
+	}
+
+	sum := sha256.Sum256([]byte(name))
+	hash := hex.EncodeToString(sum[:])[:nameHashLength]
+	if len(sanitized) > MaxNameLength-nameHashLength-1 {
+		sanitized = strings.TrimRight(sanitized[:MaxNameLength-nameHashLength-1], "-")
+	}
+	if sanitized == "" {
+		return hash
+	}
+	return fmt.Sprintf("%s-%s", sanitized, hash)
+}
+
+// sanitizedName returns the consul service name for a generated name and the
+// generated name if it had to be changed
+func sanitizedName(name string) (string, string) {
+	sanitized := SanitizeName(name)
+	if sanitized == name {
+		return name, ""
+	}
+	return sanitized, name
+}
+
+// reportRenamed logs and records an event for consul service names that had
+// to be sanitized, once they changed
+func (s *Service) reportRenamed(endpoints []interfaces.Endpoint) {
+	renamed := make(map[string]string)
+	for _, endpoint := range endpoints {
+		if endpoint.OriginalName != "" {
+			renamed[endpoint.OriginalName] = endpoint.DnsLabel
+		}
+	}
+
+	originals := make([]string, 0, len(renamed))
+	for original := range renamed {
+		originals = append(originals, original)
+	}
+	sort.Strings(originals)
+
+	changed := len(renamed) != len(s.renamed)
+	for original, name := range renamed {
+		if s.renamed[original] != name {
+			changed = true
+		}
+	}
+	s.renamed = renamed
+	if !changed {
+		return
+	}
+
+	for _, original := range originals {
+		name := renamed[original]
+		reason := ValidateName(original)
+		s.log("list").WithField("consul_service", name).Warnf("Invalid %s, registering as '%s'", reason, name)
+		s.kube2consul.EventRecorder().Eventf(s.k8sService, kapi.EventTypeWarning, InvalidNameReason, "Invalid %s, registering as '%s'", reason, name)
+	}
+}
@@ -2,33 +2,102 @@ package service
 
 import (
 	"fmt"
+	"strconv"
+	"strings"
 	"sync"
 
 	log "github.com/Sirupsen/logrus"
 	kapi "k8s.io/kubernetes/pkg/api"
 
+	"github.com/jetstack-experimental/kube2consul/pkg/detect_node"
 	"github.com/jetstack-experimental/kube2consul/pkg/interfaces"
+	"github.com/jetstack-experimental/kube2consul/pkg/logging"
 )
 
 type Service struct {
-	Namespace    string
-	Name         string
-	kube2consul  interfaces.Kube2Consul
-	k8sService   *kapi.Service
-	k8sEndpoints *kapi.Endpoints
-	mutex        sync.Mutex
-	TestString   string
+	Namespace      string
+	Name           string
+	kube2consul    interfaces.Kube2Consul
+	k8sService     *kapi.Service
+	k8sEndpoints   *kapi.Endpoints
+	serviceOptions *interfaces.ServiceOptions
+	mutex          sync.Mutex
+	registered     bool
+	// consul service names reported as renamed, by original name
+	renamed    map[string]string
+	TestString string
+}
+
+// OwnerTagPrefix is shared by all tags marking catalog entries as registered
+// by kube2consul
+const OwnerTagPrefix = "kube2consul-"
+
+// OwnerTag returns the tag that marks catalog entries as registered by
+// kube2consul for a specific kubernetes service
+func OwnerTag(namespace string, name string) string {
+	return fmt.Sprintf("%s%s/%s", OwnerTagPrefix, namespace, name)
+}
+
+// IngressOwnerTag returns the tag that marks catalog entries as registered by
+// kube2consul for a specific kubernetes ingress
+func IngressOwnerTag(namespace string, name string) string {
+	return OwnerTag(namespace, fmt.Sprintf("ingress/%s", name))
+}
+
+// IsIngressOwnerTag checks if tag has been created by IngressOwnerTag
+func IsIngressOwnerTag(tag string) bool {
+	_, name, ok := ParseOwnerTag(tag)
+	return ok && strings.HasPrefix(name, "ingress/")
+}
+
+// ParseOwnerTag returns the namespace and name of the kubernetes service a
+// tag created by OwnerTag belongs to
+func ParseOwnerTag(tag string) (namespace string, name string, ok bool) {
+	if !strings.HasPrefix(tag, OwnerTagPrefix) {
+		return "", "", false
+	}
+	parts := strings.SplitN(strings.TrimPrefix(tag, OwnerTagPrefix), "/", 2)
+	if len(parts) != 2 {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}
+
+// ClusterTag returns the tag that marks catalog entries as registered by
+// kube2consul for a specific kubernetes cluster
+func ClusterTag(clusterName string) string {
+	return fmt.Sprintf("%scluster=%s", OwnerTagPrefix, clusterName)
+}
+
+// Exported checks if a kubernetes service is registered in consul
+func Exported(svc *kapi.Service) bool {
+	return svc.Spec.Type == kapi.ServiceTypeNodePort || Headless(svc)
+}
+
+// Headless checks if a kubernetes service has no cluster IP, so its pods are
+// registered individually
+func Headless(svc *kapi.Service) bool {
+	return svc.Spec.ClusterIP == kapi.ClusterIPNone
 }
 
 func New(kube2consul interfaces.Kube2Consul, namespace string, name string) *Service {
 	svc := Service{
-		Name:        name,
-		Namespace:   namespace,
-		kube2consul: kube2consul,
+		Name:           name,
+		Namespace:      namespace,
+		kube2consul:    kube2consul,
+		serviceOptions: kube2consul.ServiceOptions(),
 	}
 	return &svc
 }
 
+func (s *Service) log(operation string) *log.Entry {
+	return log.WithFields(log.Fields{
+		"namespace": s.Namespace,
+		"name":      s.Name,
+		"operation": operation,
+	})
+}
+
 func (s *Service) Key() string {
 	return fmt.Sprintf("%s.%s", s.Namespace, s.Name)
 }
@@ -42,17 +111,47 @@ func (s *Service) Update() error {
 		return nil
 	}
 
-	// only look at NodePort services
-	if s.k8sService.Spec.Type != kapi.ServiceTypeNodePort {
+	// only look at exported services, but clean up what has been registered
+	// before the type changed
+	var list []interfaces.Endpoint
+	var metadata *interfaces.ServiceMetadata
+	if Exported(s.k8sService) {
+		metadata = s.Metadata()
+		var errs []error
+		list, errs = s.List()
+		for _, err := range errs {
+			allow, dropped := logging.Warnings.Allow(err.Error())
+			if !allow {
+				continue
+			}
+			entry := s.log("list")
+			if dropped > 0 {
+				entry = entry.WithField("suppressed", dropped)
+			}
+			entry.Warnf("Error listing endpoints: %s", err)
+		}
+		s.reportRenamed(list)
+	} else if !s.registered {
 		return nil
 	}
 
-	list := s.List()
-	s.kube2consul.UpdateConsul(
-		s.Namespace,
-		s.Name,
-		list,
-	)
+	if err := s.kube2consul.UpdateConsul(s.Namespace, s.Name, list, metadata); err != nil {
+		return err
+	}
+	s.registered = metadata != nil
+
+	return nil
+}
+
+// Delete removes all registrations of the service
+func (s *Service) Delete() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if err := s.kube2consul.UpdateConsul(s.Namespace, s.Name, nil, nil); err != nil {
+		return err
+	}
+	s.registered = false
 
 	return nil
 }
@@ -70,64 +169,146 @@ func (s *Service) UpdateService(svc *kapi.Service) error {
 	s.mutex.Unlock()
 	return nil
 }
-func (s *Service) List() []interfaces.Endpoint {
+
+func (s *Service) List() ([]interfaces.Endpoint, []error) {
+	if Headless(s.k8sService) {
+		return s.ListPods()
+	}
+
 	var endpoints []interfaces.Endpoint
-	for _, node := range s.ListNodes() {
+	nodes, errs := s.ListNodes()
+	for _, node := range nodes {
 		for _, port := range s.ListPorts() {
 			port.NodeName = node.NodeName
 			port.NodeAddress = node.NodeAddress
 			endpoints = append(endpoints, port)
 		}
 	}
-	return endpoints
+	return endpoints, errs
 }
 
 func (s *Service) ListPorts() []interfaces.Endpoint {
 	var endpoints []interfaces.Endpoint
 
-	portCount := len(s.k8sService.Spec.Ports)
+	tags := append([]string{OwnerTag(s.Namespace, s.Name)}, s.mappedTags()...)
+	meta := s.mappedMeta()
+	maintenance := s.maintenanceReason()
 
-	for _, port := range s.k8sService.Spec.Ports {
-		name := fmt.Sprintf("%s-%s", s.Namespace, s.Name)
-		if portCount > 1 {
-			name = fmt.Sprintf("%s-%s", name, port.Name)
-		}
+	ports := make([]portKey, len(s.k8sService.Spec.Ports))
+	for i, port := range s.k8sService.Spec.Ports {
+		ports[i] = portKey{Name: port.Name, Port: port.Port, Protocol: port.Protocol}
+	}
+	names := s.portNames(ports)
+
+	for i, port := range s.k8sService.Spec.Ports {
+		name, original := sanitizedName(names[i])
 		endpoints = append(endpoints, interfaces.Endpoint{
-			DnsLabel: name,
-			NodePort: port.NodePort,
+			DnsLabel:     name,
+			OriginalName: original,
+			NodePort:     port.NodePort,
+			Tags:         append(append([]string{}, tags...), protocolTag(port.Protocol)),
+			Meta:         portMeta(meta, port.Protocol),
+			Maintenance:  maintenance,
 		})
 	}
 
 	return endpoints
 }
 
-func (s *Service) ListNodes() []interfaces.Endpoint {
+// portKey identifies a port when generating consul service names
+type portKey struct {
+	Name     string
+	Port     int32
+	Protocol kapi.Protocol
+}
+
+// portNames returns a unique consul service name for each port. A single
+// port uses the plain service name, otherwise the port name, or the port
+// number for unnamed ports, is appended. If that is still ambiguous, e.g. for
+// the same port using TCP and UDP, the protocol is appended as well. The
+// names are not sanitized yet, see sanitizedName.
+func (s *Service) portNames(ports []portKey) []string {
+	base := fmt.Sprintf("%s-%s", s.Namespace, s.Name)
+	names := make([]string, len(ports))
+	if len(ports) == 1 {
+		names[0] = base
+		return names
+	}
+
+	suffixes := make([]string, len(ports))
+	count := make(map[string]int)
+	for i, port := range ports {
+		suffixes[i] = port.Name
+		if suffixes[i] == "" {
+			suffixes[i] = strconv.Itoa(int(port.Port))
+		}
+		count[suffixes[i]]++
+	}
+
+	for i, port := range ports {
+		names[i] = fmt.Sprintf("%s-%s", base, suffixes[i])
+		if count[suffixes[i]] > 1 {
+			names[i] = fmt.Sprintf("%s-%s", names[i], protocolTag(port.Protocol))
+		}
+	}
+	return names
+}
+
+// protocolTag returns the tag of a port protocol, kubernetes defaults to TCP
+func protocolTag(protocol kapi.Protocol) string {
+	if protocol == "" {
+		protocol = kapi.ProtocolTCP
+	}
+	return strings.ToLower(string(protocol))
+}
+
+// portMeta adds the port specific fields to the meta data of a service, the
+// protocol defaults to TCP like in kubernetes
+func portMeta(meta map[string]string, protocol kapi.Protocol) map[string]string {
+	if protocol == "" {
+		protocol = kapi.ProtocolTCP
+	}
+	m := make(map[string]string, len(meta)+1)
+	for key, value := range meta {
+		m[key] = value
+	}
+	m[MetaPortProtocol] = string(protocol)
+	return m
+}
+
+func (s *Service) ListNodes() ([]interfaces.Endpoint, []error) {
+	var errs []error
 	nodes := make(map[string]bool)
 	for _, subset := range s.k8sEndpoints.Subsets {
 		for _, addr := range subset.Addresses {
 			name, err := s.kube2consul.NodeNameByPodIP(addr.IP)
 			if err != nil {
-				log.Warnf("Unable to get node of PodIP %s: %s", addr.IP, err)
+				errs = append(errs, fmt.Errorf("unable to get node of PodIP %s: %s", addr.IP, err))
 				continue
 			}
 			nodes[name] = true
 		}
 	}
 
-	objects := make([]interfaces.Endpoint, len(nodes))
-
-	i := 0
+	var objects []interfaces.Endpoint
 	for nodeName := range nodes {
-		node, err := s.kube2consul.KubernetesClientset().Core().Nodes().Get(nodeName)
+		node, err := s.kube2consul.NodeByName(nodeName)
 		if err != nil {
-			log.Warnf("Unable to get node %s: %s", nodeName, err)
+			errs = append(errs, fmt.Errorf("unable to get node %s: %s", nodeName, err))
 			continue
 		}
-		objects[i] = interfaces.Endpoint{
-			NodeName:    nodeName,
-			NodeAddress: node.Status.Addresses[0].Address,
+		if s.withdrawn(node) {
+			continue
+		}
+		address, err := detect_node.NodeAddress(node)
+		if err != nil {
+			errs = append(errs, err)
+			continue
 		}
-		i++
+		objects = append(objects, interfaces.Endpoint{
+			NodeName:    nodeName,
+			NodeAddress: address,
+		})
 	}
-	return objects
+	return objects, errs
 }
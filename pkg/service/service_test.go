@@ -1,11 +1,20 @@
 package service
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"reflect"
+	"strings"
 	"testing"
 
 	"github.com/golang/mock/gomock"
 	kapi "k8s.io/kubernetes/pkg/api"
+	kcache "k8s.io/kubernetes/pkg/client/cache"
+	"k8s.io/kubernetes/pkg/client/record"
 
+	"github.com/jetstack-experimental/kube2consul/pkg/informers"
+	"github.com/jetstack-experimental/kube2consul/pkg/interfaces"
 	"github.com/jetstack-experimental/kube2consul/pkg/mocks"
 )
 
@@ -34,12 +43,16 @@ func TestServiceOnePort(t *testing.T) {
 		t.Errorf("Element count %d is not the execpted %d", act, exp)
 	}
 
-	if exp, act := "default-one-port-service", endpoints[0].Name; exp != act {
+	if exp, act := "default-one-port-service", endpoints[0].DnsLabel; exp != act {
 		t.Errorf("Name '%s' is not the expected '%s'", act, exp)
 	}
-	if exp, act := int32(9192), endpoints[0].Port; exp != act {
+	if exp, act := int32(9192), endpoints[0].NodePort; exp != act {
 		t.Errorf("Port '%d' is not the expected '%d'", act, exp)
 	}
+	// the protocol defaults to TCP
+	if exp, act := string(kapi.ProtocolTCP), endpoints[0].Meta[MetaPortProtocol]; exp != act {
+		t.Errorf("Protocol meta '%s' is not the expected '%s'", act, exp)
+	}
 }
 
 func TestServiceTwoPorts(t *testing.T) {
@@ -72,20 +85,189 @@ func TestServiceTwoPorts(t *testing.T) {
 		t.Errorf("Element count %d is not the execpted %d", act, exp)
 	}
 
-	if exp, act := "default-two-port-service-http", endpoints[0].Name; exp != act {
+	if exp, act := "default-two-port-service-http", endpoints[0].DnsLabel; exp != act {
 		t.Errorf("Name '%s' is not the expected '%s'", act, exp)
 	}
-	if exp, act := int32(9192), endpoints[0].Port; exp != act {
+	if exp, act := int32(9192), endpoints[0].NodePort; exp != act {
 		t.Errorf("Port '%d' is not the expected '%d'", act, exp)
 	}
-	if exp, act := "default-two-port-service-https", endpoints[1].Name; exp != act {
+	if exp, act := "default-two-port-service-https", endpoints[1].DnsLabel; exp != act {
 		t.Errorf("Name '%s' is not the expected '%s'", act, exp)
 	}
-	if exp, act := int32(9193), endpoints[1].Port; exp != act {
+	if exp, act := int32(9193), endpoints[1].NodePort; exp != act {
 		t.Errorf("Port '%d' is not the expected '%d'", act, exp)
 	}
 }
 
+func TestServiceUnnamedPorts(t *testing.T) {
+
+	s := &Service{
+		Namespace: "default",
+		Name:      "unnamed-ports",
+		k8sService: &kapi.Service{
+			Spec: kapi.ServiceSpec{
+				Type: kapi.ServiceTypeNodePort,
+				Ports: []kapi.ServicePort{
+					kapi.ServicePort{
+						NodePort: int32(9192),
+						Port:     int32(80),
+					},
+					kapi.ServicePort{
+						NodePort: int32(9193),
+						Port:     int32(443),
+					},
+				},
+			},
+		},
+		k8sEndpoints: &kapi.Endpoints{},
+	}
+
+	endpoints := s.ListPorts()
+	if exp, act := 2, len(endpoints); exp != act {
+		t.Fatalf("Element count %d is not the execpted %d", act, exp)
+	}
+
+	if exp, act := "default-unnamed-ports-80", endpoints[0].DnsLabel; exp != act {
+		t.Errorf("Name '%s' is not the expected '%s'", act, exp)
+	}
+	if exp, act := "default-unnamed-ports-443", endpoints[1].DnsLabel; exp != act {
+		t.Errorf("Name '%s' is not the expected '%s'", act, exp)
+	}
+}
+
+func TestServiceSingleUnnamedPort(t *testing.T) {
+
+	s := &Service{
+		Namespace: "default",
+		Name:      "unnamed-port",
+		k8sService: &kapi.Service{
+			Spec: kapi.ServiceSpec{
+				Type: kapi.ServiceTypeNodePort,
+				Ports: []kapi.ServicePort{
+					kapi.ServicePort{
+						NodePort: int32(9192),
+						Port:     int32(80),
+					},
+				},
+			},
+		},
+		k8sEndpoints: &kapi.Endpoints{},
+	}
+
+	endpoints := s.ListPorts()
+	if exp, act := 1, len(endpoints); exp != act {
+		t.Fatalf("Element count %d is not the execpted %d", act, exp)
+	}
+
+	if exp, act := "default-unnamed-port", endpoints[0].DnsLabel; exp != act {
+		t.Errorf("Name '%s' is not the expected '%s'", act, exp)
+	}
+}
+
+func TestServiceDuplicatePortNames(t *testing.T) {
+
+	s := &Service{
+		Namespace: "kube-system",
+		Name:      "dns",
+		k8sService: &kapi.Service{
+			Spec: kapi.ServiceSpec{
+				Type: kapi.ServiceTypeNodePort,
+				Ports: []kapi.ServicePort{
+					kapi.ServicePort{
+						Name:     "dns",
+						NodePort: int32(9153),
+						Port:     int32(53),
+						Protocol: kapi.ProtocolUDP,
+					},
+					kapi.ServicePort{
+						Name:     "dns",
+						NodePort: int32(9153),
+						Port:     int32(53),
+						Protocol: kapi.ProtocolTCP,
+					},
+				},
+			},
+		},
+		k8sEndpoints: &kapi.Endpoints{},
+	}
+
+	endpoints := s.ListPorts()
+	if exp, act := 2, len(endpoints); exp != act {
+		t.Fatalf("Element count %d is not the execpted %d", act, exp)
+	}
+
+	if exp, act := "kube-system-dns-dns-udp", endpoints[0].DnsLabel; exp != act {
+		t.Errorf("Name '%s' is not the expected '%s'", act, exp)
+	}
+	if exp, act := "kube-system-dns-dns-tcp", endpoints[1].DnsLabel; exp != act {
+		t.Errorf("Name '%s' is not the expected '%s'", act, exp)
+	}
+}
+
+func TestServiceMixedProtocols(t *testing.T) {
+
+	s := &Service{
+		Namespace: "kube-system",
+		Name:      "dns",
+		k8sService: &kapi.Service{
+			Spec: kapi.ServiceSpec{
+				Type: kapi.ServiceTypeNodePort,
+				Ports: []kapi.ServicePort{
+					kapi.ServicePort{
+						NodePort: int32(9153),
+						Port:     int32(53),
+						Protocol: kapi.ProtocolUDP,
+					},
+					kapi.ServicePort{
+						NodePort: int32(9153),
+						Port:     int32(53),
+						Protocol: kapi.ProtocolTCP,
+					},
+					kapi.ServicePort{
+						Name:     "metrics",
+						NodePort: int32(9154),
+						Port:     int32(9153),
+					},
+				},
+			},
+		},
+		k8sEndpoints: &kapi.Endpoints{},
+	}
+
+	endpoints := s.ListPorts()
+	if exp, act := 3, len(endpoints); exp != act {
+		t.Fatalf("Element count %d is not the execpted %d", act, exp)
+	}
+
+	for i, exp := range []string{
+		"kube-system-dns-53-udp",
+		"kube-system-dns-53-tcp",
+		"kube-system-dns-metrics",
+	} {
+		if act := endpoints[i].DnsLabel; exp != act {
+			t.Errorf("Name '%s' is not the expected '%s'", act, exp)
+		}
+	}
+
+	for i, exp := range []string{"udp", "tcp", "tcp"} {
+		tags := endpoints[i].Tags
+		if act := tags[len(tags)-1]; exp != act {
+			t.Errorf("Protocol tag '%s' is not the expected '%s'", act, exp)
+		}
+	}
+}
+
+func testNode(name string, address string) *kapi.Node {
+	return &kapi.Node{
+		ObjectMeta: kapi.ObjectMeta{Name: name},
+		Status: kapi.NodeStatus{
+			Addresses: []kapi.NodeAddress{
+				kapi.NodeAddress{Type: kapi.NodeInternalIP, Address: address},
+			},
+		},
+	}
+}
+
 func TestServiceNoEndpoints(t *testing.T) {
 
 	s := &Service{
@@ -95,10 +277,13 @@ func TestServiceNoEndpoints(t *testing.T) {
 		k8sEndpoints: &kapi.Endpoints{},
 	}
 
-	addresses := s.ListAddresses()
-	if exp, act := 0, len(addresses); exp != act {
+	nodes, errs := s.ListNodes()
+	if exp, act := 0, len(nodes); exp != act {
 		t.Errorf("Element count %d is not the execpted %d", act, exp)
 	}
+	if len(errs) > 0 {
+		t.Errorf("Unexpected errors: %v", errs)
+	}
 }
 
 func TestServiceTwoEndpoints(t *testing.T) {
@@ -107,12 +292,14 @@ func TestServiceTwoEndpoints(t *testing.T) {
 	defer ctrl.Finish()
 
 	mockK2C := mocks.NewMockKube2Consul(ctrl)
-	mockK2C.EXPECT().NodeIPByPodIP("1.2.3.4").Return("192.168.0.1", nil)
-	mockK2C.EXPECT().NodeIPByPodIP("4.5.6.7").Return("192.168.0.2", nil)
+	mockK2C.EXPECT().NodeNameByPodIP("1.2.3.4").Return("node-1", nil)
+	mockK2C.EXPECT().NodeNameByPodIP("4.5.6.7").Return("node-2", nil)
+	mockK2C.EXPECT().NodeByName("node-1").Return(testNode("node-1", "192.168.0.1"), nil)
+	mockK2C.EXPECT().NodeByName("node-2").Return(testNode("node-2", "192.168.0.2"), nil)
 
 	s := &Service{
 		Namespace:  "default",
-		Name:       "no-endpoints",
+		Name:       "two-endpoints",
 		k8sService: &kapi.Service{},
 		k8sEndpoints: &kapi.Endpoints{
 			Subsets: []kapi.EndpointSubset{
@@ -127,9 +314,20 @@ func TestServiceTwoEndpoints(t *testing.T) {
 		kube2consul: mockK2C,
 	}
 
-	addresses := s.ListAddresses()
-	if exp, act := 2, len(addresses); exp != act {
-		t.Errorf("Element count %d is not the execpted %d", act, exp)
+	nodes, errs := s.ListNodes()
+	if exp, act := 2, len(nodes); exp != act {
+		t.Fatalf("Element count %d is not the execpted %d", act, exp)
+	}
+	if len(errs) > 0 {
+		t.Errorf("Unexpected errors: %v", errs)
+	}
+
+	addresses := map[string]string{}
+	for _, node := range nodes {
+		addresses[node.NodeName] = node.NodeAddress
+	}
+	if exp, act := "192.168.0.2", addresses["node-2"]; exp != act {
+		t.Errorf("Address '%s' is not the expected '%s'", act, exp)
 	}
 }
 
@@ -139,12 +337,46 @@ func TestServiceTwoEndpointsDuplicates(t *testing.T) {
 	defer ctrl.Finish()
 
 	mockK2C := mocks.NewMockKube2Consul(ctrl)
-	mockK2C.EXPECT().NodeIPByPodIP("1.2.3.4").Return("192.168.0.1", nil)
-	mockK2C.EXPECT().NodeIPByPodIP("1.2.3.5").Return("192.168.0.1", nil)
+	mockK2C.EXPECT().NodeNameByPodIP("1.2.3.4").Return("node-1", nil)
+	mockK2C.EXPECT().NodeNameByPodIP("1.2.3.5").Return("node-1", nil)
+	mockK2C.EXPECT().NodeByName("node-1").Return(testNode("node-1", "192.168.0.1"), nil)
+
+	s := &Service{
+		Namespace:  "default",
+		Name:       "duplicate-endpoints",
+		k8sService: &kapi.Service{},
+		k8sEndpoints: &kapi.Endpoints{
+			Subsets: []kapi.EndpointSubset{
+				kapi.EndpointSubset{
+					Addresses: []kapi.EndpointAddress{
+						kapi.EndpointAddress{IP: "1.2.3.4"},
+						kapi.EndpointAddress{IP: "1.2.3.5"},
+					},
+				},
+			},
+		},
+		kube2consul: mockK2C,
+	}
+
+	nodes, _ := s.ListNodes()
+	if exp, act := 1, len(nodes); exp != act {
+		t.Errorf("Element count %d is not the execpted %d", act, exp)
+	}
+}
+
+func TestServiceListNodesErrors(t *testing.T) {
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockK2C := mocks.NewMockKube2Consul(ctrl)
+	mockK2C.EXPECT().NodeNameByPodIP("1.2.3.4").Return("node-1", nil)
+	mockK2C.EXPECT().NodeNameByPodIP("1.2.3.5").Return("", fmt.Errorf("No pod found with podIP 1.2.3.5"))
+	mockK2C.EXPECT().NodeByName("node-1").Return(testNode("node-1", "192.168.0.1"), nil)
 
 	s := &Service{
 		Namespace:  "default",
-		Name:       "no-endpoints",
+		Name:       "missing-pod",
 		k8sService: &kapi.Service{},
 		k8sEndpoints: &kapi.Endpoints{
 			Subsets: []kapi.EndpointSubset{
@@ -159,8 +391,479 @@ func TestServiceTwoEndpointsDuplicates(t *testing.T) {
 		kube2consul: mockK2C,
 	}
 
-	addresses := s.ListAddresses()
-	if exp, act := 1, len(addresses); exp != act {
+	nodes, errs := s.ListNodes()
+	if exp, act := 1, len(nodes); exp != act {
 		t.Errorf("Element count %d is not the execpted %d", act, exp)
 	}
+	if exp, act := 1, len(errs); exp != act {
+		t.Errorf("Error count %d is not the execpted %d", act, exp)
+	}
+}
+
+func TestServiceListNodesWithdrawn(t *testing.T) {
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	cordoned := testNode("node-2", "192.168.0.2")
+	cordoned.Spec.Unschedulable = true
+
+	mockK2C := mocks.NewMockKube2Consul(ctrl)
+	mockK2C.EXPECT().NodeNameByPodIP("1.2.3.4").Return("node-1", nil)
+	mockK2C.EXPECT().NodeNameByPodIP("4.5.6.7").Return("node-2", nil)
+	mockK2C.EXPECT().NodeByName("node-1").Return(testNode("node-1", "192.168.0.1"), nil)
+	mockK2C.EXPECT().NodeByName("node-2").Return(cordoned, nil)
+
+	s := &Service{
+		Namespace:  "default",
+		Name:       "withdrawn",
+		k8sService: &kapi.Service{},
+		k8sEndpoints: &kapi.Endpoints{
+			Subsets: []kapi.EndpointSubset{
+				kapi.EndpointSubset{
+					Addresses: []kapi.EndpointAddress{
+						kapi.EndpointAddress{IP: "1.2.3.4"},
+						kapi.EndpointAddress{IP: "4.5.6.7"},
+					},
+				},
+			},
+		},
+		serviceOptions: &interfaces.ServiceOptions{
+			NodeMaintenance: interfaces.NodeMaintenanceWithdraw,
+		},
+		kube2consul: mockK2C,
+	}
+
+	nodes, _ := s.ListNodes()
+	if exp, act := 1, len(nodes); exp != act {
+		t.Fatalf("Element count %d is not the execpted %d", act, exp)
+	}
+	if exp, act := "node-1", nodes[0].NodeName; exp != act {
+		t.Errorf("Node '%s' is not the expected '%s'", act, exp)
+	}
+}
+
+func TestServiceList(t *testing.T) {
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockK2C := mocks.NewMockKube2Consul(ctrl)
+	mockK2C.EXPECT().NodeNameByPodIP("1.2.3.4").Return("node-1", nil)
+	mockK2C.EXPECT().NodeNameByPodIP("4.5.6.7").Return("node-2", nil)
+	mockK2C.EXPECT().NodeByName("node-1").Return(testNode("node-1", "192.168.0.1"), nil)
+	mockK2C.EXPECT().NodeByName("node-2").Return(testNode("node-2", "192.168.0.2"), nil)
+
+	s := &Service{
+		Namespace: "default",
+		Name:      "web",
+		k8sService: &kapi.Service{
+			Spec: kapi.ServiceSpec{
+				Type: kapi.ServiceTypeNodePort,
+				Ports: []kapi.ServicePort{
+					kapi.ServicePort{
+						Name:     "http",
+						NodePort: int32(9192),
+						Port:     int32(80),
+					},
+					kapi.ServicePort{
+						Name:     "https",
+						NodePort: int32(9193),
+						Port:     int32(443),
+					},
+				},
+			},
+		},
+		k8sEndpoints: &kapi.Endpoints{
+			Subsets: []kapi.EndpointSubset{
+				kapi.EndpointSubset{
+					Addresses: []kapi.EndpointAddress{
+						kapi.EndpointAddress{IP: "1.2.3.4"},
+						kapi.EndpointAddress{IP: "4.5.6.7"},
+					},
+				},
+			},
+		},
+		kube2consul: mockK2C,
+	}
+
+	endpoints, errs := s.List()
+	if exp, act := 4, len(endpoints); exp != act {
+		t.Fatalf("Element count %d is not the execpted %d", act, exp)
+	}
+	if len(errs) > 0 {
+		t.Errorf("Unexpected errors: %v", errs)
+	}
+
+	registered := map[string]int32{}
+	for _, endpoint := range endpoints {
+		registered[endpoint.NodeAddress+"/"+endpoint.DnsLabel] = endpoint.NodePort
+	}
+	for key, exp := range map[string]int32{
+		"192.168.0.1/default-web-http":  9192,
+		"192.168.0.1/default-web-https": 9193,
+		"192.168.0.2/default-web-http":  9192,
+		"192.168.0.2/default-web-https": 9193,
+	} {
+		if act, ok := registered[key]; !ok || exp != act {
+			t.Errorf("Endpoint %s has port %d, expected %d", key, act, exp)
+		}
+	}
+}
+
+func TestMatchKey(t *testing.T) {
+	patterns := []string{"app", "team/*"}
+	for key, exp := range map[string]bool{
+		"app":       true,
+		"app2":      false,
+		"team/":     true,
+		"team/name": true,
+		"team":      false,
+		"":          false,
+	} {
+		if act := MatchKey(patterns, key); exp != act {
+			t.Errorf("MatchKey(%v, '%s') is %t, expected %t", patterns, key, act, exp)
+		}
+	}
+	if MatchKey(nil, "app") {
+		t.Errorf("MatchKey without patterns matched")
+	}
+}
+
+func TestMetaKey(t *testing.T) {
+	for key, exp := range map[string]string{
+		"app":                    "app",
+		"app_name-1":             "app_name-1",
+		"example.com/team":       "example_com_team",
+		strings.Repeat("a", 130): strings.Repeat("a", 128),
+	} {
+		if act := MetaKey(key); exp != act {
+			t.Errorf("MetaKey('%s') is '%s', expected '%s'", key, act, exp)
+		}
+	}
+}
+
+func TestServiceMappedTags(t *testing.T) {
+	labels := map[string]string{"app": "web", "tier": "", "team/name": "a", "other": "x"}
+	annotations := map[string]string{"version": "1"}
+	for _, test := range []struct {
+		format string
+		exp    []string
+	}{
+		{format: interfaces.TagFormatKeyValue, exp: []string{"app=web", "team/name=a", "tier=", "version=1"}},
+		{format: interfaces.TagFormatValue, exp: []string{"web", "a", "1"}},
+	} {
+		s := &Service{
+			k8sService: &kapi.Service{
+				ObjectMeta: kapi.ObjectMeta{Labels: labels, Annotations: annotations},
+			},
+			serviceOptions: &interfaces.ServiceOptions{
+				LabelTags:      []string{"app", "tier", "team/*"},
+				AnnotationTags: []string{"version"},
+				TagFormat:      test.format,
+			},
+		}
+		if act := s.mappedTags(); !reflect.DeepEqual(test.exp, act) {
+			t.Errorf("Tags %v in format %s are not the expected %v", act, test.format, test.exp)
+		}
+	}
+}
+
+func TestServiceMappedMeta(t *testing.T) {
+	s := &Service{
+		Namespace: "default",
+		k8sService: &kapi.Service{
+			ObjectMeta: kapi.ObjectMeta{
+				UID:         "1234",
+				Labels:      map[string]string{"example.com/app": "web", "other": "x"},
+				Annotations: map[string]string{"description": strings.Repeat("a", 600)},
+			},
+		},
+		serviceOptions: &interfaces.ServiceOptions{
+			LabelMeta:      []string{"example.com/*"},
+			AnnotationMeta: []string{"description"},
+		},
+	}
+	exp := map[string]string{
+		"example_com_app": "web",
+		"description":     strings.Repeat("a", 512),
+		MetaNamespace:     "default",
+		MetaServiceUID:    "1234",
+	}
+	if act := s.mappedMeta(); !reflect.DeepEqual(exp, act) {
+		t.Errorf("Meta %v is not the expected %v", act, exp)
+	}
+}
+
+func TestServiceListPods(t *testing.T) {
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	pods := kcache.NewIndexer(kcache.MetaNamespaceKeyFunc, informers.PodIndexers)
+	for _, pod := range []*kapi.Pod{
+		{
+			ObjectMeta: kapi.ObjectMeta{
+				Namespace:       "default",
+				Name:            "db-0",
+				OwnerReferences: []kapi.OwnerReference{{Kind: "StatefulSet", Name: "db"}},
+			},
+			Status: kapi.PodStatus{PodIP: "1.2.3.1", Phase: kapi.PodRunning},
+		},
+		{
+			ObjectMeta: kapi.ObjectMeta{Namespace: "default", Name: "cache-1"},
+			Spec:       kapi.PodSpec{Hostname: "cache-1", Subdomain: "db"},
+			Status:     kapi.PodStatus{PodIP: "1.2.3.2", Phase: kapi.PodRunning},
+		},
+		{
+			ObjectMeta: kapi.ObjectMeta{Namespace: "default", Name: "worker-2"},
+			Spec:       kapi.PodSpec{Hostname: "worker-2", Subdomain: "other"},
+			Status:     kapi.PodStatus{PodIP: "1.2.3.3", Phase: kapi.PodRunning},
+		},
+		{
+			ObjectMeta: kapi.ObjectMeta{
+				Namespace:       "default",
+				Name:            "web-1234",
+				OwnerReferences: []kapi.OwnerReference{{Kind: "ReplicaSet", Name: "web"}},
+			},
+			Status: kapi.PodStatus{PodIP: "1.2.3.4", Phase: kapi.PodRunning},
+		},
+	} {
+		pods.Add(pod)
+	}
+
+	mockK2C := mocks.NewMockKube2Consul(ctrl)
+	mockK2C.EXPECT().PodLister().Return(informers.NewPodLister(pods)).AnyTimes()
+	mockK2C.EXPECT().NodeNameByPodIP(gomock.Any()).Return("node-1", nil).AnyTimes()
+	mockK2C.EXPECT().NodeByName("node-1").Return(&kapi.Node{
+		ObjectMeta: kapi.ObjectMeta{Name: "node-1"},
+		Status: kapi.NodeStatus{
+			Addresses: []kapi.NodeAddress{{Type: kapi.NodeInternalIP, Address: "192.168.0.1"}},
+		},
+	}, nil).AnyTimes()
+
+	target := func(name string) *kapi.ObjectReference {
+		return &kapi.ObjectReference{Kind: "Pod", Namespace: "default", Name: name}
+	}
+	s := &Service{
+		Namespace:  "default",
+		Name:       "db",
+		k8sService: &kapi.Service{},
+		k8sEndpoints: &kapi.Endpoints{
+			Subsets: []kapi.EndpointSubset{
+				kapi.EndpointSubset{
+					Addresses: []kapi.EndpointAddress{
+						kapi.EndpointAddress{IP: "1.2.3.1", TargetRef: target("db-0")},
+						kapi.EndpointAddress{IP: "1.2.3.2", TargetRef: target("cache-1")},
+						kapi.EndpointAddress{IP: "1.2.3.3", TargetRef: target("worker-2")},
+						kapi.EndpointAddress{IP: "1.2.3.4", TargetRef: target("web-1234")},
+						// hostname set by kubernetes for pods in the subdomain
+						kapi.EndpointAddress{IP: "1.2.3.5", Hostname: "db-5"},
+					},
+					Ports: []kapi.EndpointPort{{Name: "sql", Port: 5432, Protocol: kapi.ProtocolTCP}},
+				},
+			},
+		},
+		kube2consul: mockK2C,
+	}
+
+	endpoints, errs := s.ListPods()
+	if len(errs) > 0 {
+		t.Errorf("Unexpected errors: %v", errs)
+	}
+
+	exp := map[string]string{
+		"db-0":     "ordinal-0",
+		"cache-1":  "ordinal-1",
+		"worker-2": "",
+		"web-1234": "",
+		"db-5":     "ordinal-5",
+	}
+	act := make(map[string]string)
+	for _, endpoint := range endpoints {
+		pod := ""
+		ordinal := ""
+		for _, tag := range endpoint.Tags {
+			if strings.HasPrefix(tag, "ordinal-") {
+				ordinal = tag
+			} else if _, ok := exp[tag]; ok {
+				pod = tag
+			}
+		}
+		act[pod] = ordinal
+	}
+	if !reflect.DeepEqual(exp, act) {
+		t.Errorf("Ordinals %v are not the expected %v", act, exp)
+	}
+}
+
+func TestNodeInMaintenance(t *testing.T) {
+	node := &kapi.Node{}
+	if maintenance, _ := NodeInMaintenance(node); maintenance {
+		t.Errorf("Node without annotation and not cordoned is in maintenance")
+	}
+
+	node.Spec.Unschedulable = true
+	if maintenance, reason := NodeInMaintenance(node); !maintenance || reason != "Node is cordoned" {
+		t.Errorf("Cordoned node is not in maintenance, reason '%s'", reason)
+	}
+
+	node.Spec.Unschedulable = false
+	node.Annotations = map[string]string{MaintenanceAnnotation: "kernel upgrade"}
+	if maintenance, reason := NodeInMaintenance(node); !maintenance || reason != "kernel upgrade" {
+		t.Errorf("Annotated node is not in maintenance, reason '%s'", reason)
+	}
+
+	node.Annotations[MaintenanceAnnotation] = "false"
+	if maintenance, _ := NodeInMaintenance(node); maintenance {
+		t.Errorf("Node annotated with 'false' is in maintenance")
+	}
+}
+
+func TestServiceMaintenance(t *testing.T) {
+
+	s := &Service{
+		Namespace: "default",
+		Name:      "maintenance",
+		k8sService: &kapi.Service{
+			ObjectMeta: kapi.ObjectMeta{
+				Annotations: map[string]string{MaintenanceAnnotation: "true"},
+			},
+			Spec: kapi.ServiceSpec{
+				Type: kapi.ServiceTypeNodePort,
+				Ports: []kapi.ServicePort{
+					kapi.ServicePort{
+						NodePort: int32(9192),
+						Port:     int32(80),
+					},
+				},
+			},
+		},
+		k8sEndpoints: &kapi.Endpoints{},
+	}
+
+	if exp, act := DefaultMaintenanceReason, s.ListPorts()[0].Maintenance; exp != act {
+		t.Errorf("Maintenance '%s' is not the expected '%s'", act, exp)
+	}
+
+	s.k8sService.Annotations[MaintenanceAnnotation] = "database migration"
+	if exp, act := "database migration", s.ListPorts()[0].Maintenance; exp != act {
+		t.Errorf("Maintenance '%s' is not the expected '%s'", act, exp)
+	}
+
+	delete(s.k8sService.Annotations, MaintenanceAnnotation)
+	if act := s.ListPorts()[0].Maintenance; act != "" {
+		t.Errorf("Service without annotation is in maintenance '%s'", act)
+	}
+}
+
+func TestSanitizeName(t *testing.T) {
+	long := strings.Repeat("a", 70)
+
+	for _, test := range []struct {
+		name string
+		exp  string
+	}{
+		{"default-web", "default-web"},
+		{"default-web_http", "default-web-http"},
+		{"-default.web.", "default-web"},
+		{strings.Repeat("a", MaxNameLength), strings.Repeat("a", MaxNameLength)},
+		{long, strings.Repeat("a", 54) + "-" + nameHash(long)},
+		{strings.Repeat("a", 53) + "-" + long, strings.Repeat("a", 53) + "-" + nameHash(strings.Repeat("a", 53)+"-"+long)},
+		{"...", nameHash("...")},
+		{"", nameHash("")},
+	} {
+		act := SanitizeName(test.name)
+		if act != test.exp {
+			t.Errorf("Sanitized name of '%s' is '%s', expected '%s'", test.name, act, test.exp)
+		}
+		if err := ValidateName(act); err != nil {
+			t.Errorf("Sanitized name of '%s' is invalid: %s", test.name, err)
+		}
+	}
+
+	if a, b := SanitizeName(long+"-http"), SanitizeName(long+"-https"); a == b {
+		t.Errorf("Long names differing after truncation are both sanitized to '%s'", a)
+	}
+	if a, b := SanitizeName(long), SanitizeName(long); a != b {
+		t.Errorf("Sanitized names of the same name differ: '%s' and '%s'", a, b)
+	}
+}
+
+func nameHash(name string) string {
+	sum := sha256.Sum256([]byte(name))
+	return hex.EncodeToString(sum[:])[:nameHashLength]
+}
+
+func TestServiceLongName(t *testing.T) {
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	recorder := record.NewFakeRecorder(10)
+	mockK2C := mocks.NewMockKube2Consul(ctrl)
+	mockK2C.EXPECT().EventRecorder().Return(recorder).Times(2)
+	mockK2C.EXPECT().NodeNameByPodIP("1.2.3.4").Return("node-1", nil).Times(2)
+	mockK2C.EXPECT().NodeByName("node-1").Return(testNode("node-1", "192.168.0.1"), nil).Times(2)
+	mockK2C.EXPECT().UpdateConsul("default", strings.Repeat("a", 60), gomock.Any(), gomock.Any()).Return(nil).Times(2)
+
+	s := &Service{
+		Namespace: "default",
+		Name:      strings.Repeat("a", 60),
+		k8sService: &kapi.Service{
+			Spec: kapi.ServiceSpec{
+				Type: kapi.ServiceTypeNodePort,
+				Ports: []kapi.ServicePort{
+					kapi.ServicePort{
+						Name:     "http",
+						NodePort: int32(9192),
+						Port:     int32(80),
+					},
+					kapi.ServicePort{
+						Name:     "https",
+						NodePort: int32(9193),
+						Port:     int32(443),
+					},
+				},
+			},
+		},
+		k8sEndpoints: &kapi.Endpoints{
+			Subsets: []kapi.EndpointSubset{
+				kapi.EndpointSubset{
+					Addresses: []kapi.EndpointAddress{
+						kapi.EndpointAddress{IP: "1.2.3.4"},
+					},
+				},
+			},
+		},
+		kube2consul: mockK2C,
+	}
+
+	endpoints := s.ListPorts()
+	for i, suffix := range []string{"http", "https"} {
+		original := fmt.Sprintf("default-%s-%s", s.Name, suffix)
+		if exp, act := original, endpoints[i].OriginalName; exp != act {
+			t.Errorf("Original name '%s' is not the expected '%s'", act, exp)
+		}
+		if exp, act := SanitizeName(original), endpoints[i].DnsLabel; exp != act {
+			t.Errorf("Name '%s' is not the expected '%s'", act, exp)
+		}
+		if act := len(endpoints[i].DnsLabel); act > MaxNameLength {
+			t.Errorf("Name '%s' is longer than %d characters", endpoints[i].DnsLabel, MaxNameLength)
+		}
+	}
+
+	// events are only recorded once per rename
+	for i := 0; i < 2; i++ {
+		if err := s.Update(); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+	}
+	if exp, act := 2, len(recorder.Events); exp != act {
+		t.Errorf("Recorded %d events, expected %d", act, exp)
+	}
+	event := <-recorder.Events
+	if !strings.Contains(event, InvalidNameReason) || !strings.Contains(event, endpoints[0].DnsLabel) {
+		t.Errorf("Unexpected event '%s'", event)
+	}
 }
@@ -0,0 +1,740 @@
+// Package fakeconsul provides an in-process consul HTTP API for tests. It
+// implements the catalog, health, agent, KV and txn endpoints used by
+// kube2consul and records every request. Services are kept per consul
+// namespace, other enterprise features and datacenters are ignored. Every
+// change moves a single index, reads are indexed by the last change of their
+// result, so blocking queries only return once their result changed. Like in
+// consul, the service listing is indexed by the last change of any service
+// instead.
+package fakeconsul
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+const Datacenter = "dc1"
+
+// DefaultWait is the duration blocking queries without a wait time are held
+const DefaultWait = 5 * time.Minute
+
+// MaxTxnOps is the maximum number of operations of a transaction
+const MaxTxnOps = 64
+
+// queryResult is the last result of a read and the index it changed at
+type queryResult struct {
+	body  []byte
+	index uint64
+}
+
+// Request is a request received by the server
+type Request struct {
+	Method string
+	Path   string
+	Query  string
+	Body   []byte
+}
+
+type Server struct {
+	*httptest.Server
+
+	mutex   sync.Mutex
+	changed *sync.Cond
+	closed  bool
+	index   uint64
+	// servicesIndex is the index services last changed at
+	servicesIndex uint64
+	results       map[string]queryResult
+	failures      map[string]int
+	nodes         map[string]*consulapi.Node
+	services      map[string]map[string]*consulapi.AgentService
+	checks        map[string]map[string]*consulapi.HealthCheck
+	kv            map[string][]byte
+	requests      []Request
+}
+
+// New starts a server, which has to be closed after use
+func New() *Server {
+	s := &Server{
+		index:    1,
+		nodes:    make(map[string]*consulapi.Node),
+		services: make(map[string]map[string]*consulapi.AgentService),
+		checks:   make(map[string]map[string]*consulapi.HealthCheck),
+		kv:       make(map[string][]byte),
+		results:  make(map[string]queryResult),
+		failures: make(map[string]int),
+	}
+	s.changed = sync.NewCond(&s.mutex)
+	s.Server = httptest.NewServer(http.HandlerFunc(s.handle))
+	return s
+}
+
+// Close releases blocked queries and shuts the server down
+func (s *Server) Close() {
+	s.mutex.Lock()
+	s.closed = true
+	s.changed.Broadcast()
+	s.mutex.Unlock()
+	s.Server.Close()
+}
+
+// Address returns the host and port of the server, as passed to the consul
+// client
+func (s *Server) Address() string {
+	return strings.TrimPrefix(s.URL, "http://")
+}
+
+// Requests returns all requests received so far
+func (s *Server) Requests() []Request {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]Request{}, s.requests...)
+}
+
+// RequestCount returns the number of requests received with method and path
+func (s *Server) RequestCount(method string, path string) int {
+	count := 0
+	for _, req := range s.Requests() {
+		if req.Method == method && req.Path == path {
+			count++
+		}
+	}
+	return count
+}
+
+// Reset forgets the requests received so far
+func (s *Server) Reset() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.requests = nil
+}
+
+// Index returns the current index
+func (s *Server) Index() uint64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.index
+}
+
+// SetIndex sets the index, e.g. to a lower one as after a restore from a
+// snapshot, and releases blocked queries
+func (s *Server) SetIndex(index uint64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.index = index
+	s.servicesIndex = index
+	s.results = make(map[string]queryResult)
+	s.changed.Broadcast()
+}
+
+// Fail makes the next count requests to path fail with an internal error
+func (s *Server) Fail(path string, count int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.failures[path] = count
+}
+
+// Nodes returns the registered nodes by name
+func (s *Server) Nodes() map[string]consulapi.Node {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	nodes := make(map[string]consulapi.Node)
+	for name, node := range s.nodes {
+		nodes[name] = *node
+	}
+	return nodes
+}
+
+// Services returns the registered services keyed by node, namespace unless
+// it is the default one and service ID, e.g. node-1/default-web or
+// node-1/team-a/default-web
+func (s *Server) Services() map[string]consulapi.AgentService {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	services := make(map[string]consulapi.AgentService)
+	for node, byID := range s.services {
+		for id, svc := range byID {
+			services[fmt.Sprintf("%s/%s", node, id)] = *svc
+		}
+	}
+	return services
+}
+
+// Checks returns the registered checks keyed by node and check ID
+func (s *Server) Checks() map[string]consulapi.HealthCheck {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	checks := make(map[string]consulapi.HealthCheck)
+	for node, byID := range s.checks {
+		for id, check := range byID {
+			checks[fmt.Sprintf("%s/%s", node, id)] = *check
+		}
+	}
+	return checks
+}
+
+// KV returns the content of the KV store
+func (s *Server) KV() map[string][]byte {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	kv := make(map[string][]byte)
+	for key, value := range s.kv {
+		kv[key] = value
+	}
+	return kv
+}
+
+// RegisterNode adds a node, e.g. one run by a consul agent
+func (s *Server) RegisterNode(node consulapi.Node) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.change()
+	s.setNode(&node)
+}
+
+// RegisterService adds a service to a node
+func (s *Server) RegisterService(nodeName string, svc consulapi.AgentService) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.change()
+	s.setService(nodeName, &svc)
+}
+
+// RegisterCheck adds a check, e.g. serfHealth of an agent node
+func (s *Server) RegisterCheck(check consulapi.HealthCheck) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.change()
+	s.setCheck(&check)
+}
+
+func (s *Server) handle(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.requests = append(s.requests, Request{
+		Method: r.Method,
+		Path:   r.URL.Path,
+		Query:  r.URL.RawQuery,
+		Body:   body,
+	})
+
+	if s.failures[r.URL.Path] > 0 {
+		s.failures[r.URL.Path]--
+		http.Error(w, "injected failure", http.StatusInternalServerError)
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		s.query(w, r)
+		return
+	}
+	s.change()
+	w.Header().Set("X-Consul-Index", strconv.FormatUint(s.index, 10))
+	s.serve(w, r, body)
+}
+
+// query serves a read. Blocking queries are held while their result is the
+// one of the index passed, until their wait time elapsed or they have been
+// cancelled. Unlike consul, they return at once if the index passed is ahead.
+func (s *Server) query(w http.ResponseWriter, r *http.Request) {
+	values := r.URL.Query()
+	waitIndex, _ := strconv.ParseUint(values.Get("index"), 10, 64)
+	wait := DefaultWait
+	if d, err := time.ParseDuration(values.Get("wait")); err == nil && d > 0 {
+		wait = d
+	}
+	values.Del("index")
+	values.Del("wait")
+	key := r.URL.Path + "?" + values.Encode()
+
+	expired := waitIndex == 0
+	if !expired {
+		done := make(chan struct{})
+		defer close(done)
+		go func() {
+			select {
+			case <-done:
+				return
+			case <-r.Context().Done():
+			case <-time.After(wait):
+			}
+			s.mutex.Lock()
+			expired = true
+			s.changed.Broadcast()
+			s.mutex.Unlock()
+		}()
+	}
+
+	for {
+		rec := httptest.NewRecorder()
+		s.serve(rec, r, nil)
+		index := s.resultIndex(key, rec.Body.Bytes())
+		if r.URL.Path == "/v1/catalog/services" && s.servicesIndex > index {
+			index = s.servicesIndex
+		}
+		if index == waitIndex && !expired && !s.closed {
+			s.changed.Wait()
+			continue
+		}
+
+		for name, values := range rec.Header() {
+			w.Header()[name] = values
+		}
+		w.Header().Set("X-Consul-Index", strconv.FormatUint(index, 10))
+		w.WriteHeader(rec.Code)
+		w.Write(rec.Body.Bytes())
+		return
+	}
+}
+
+// resultIndex returns the index the result of a read last changed at
+func (s *Server) resultIndex(key string, body []byte) uint64 {
+	result, ok := s.results[key]
+	if !ok || !bytes.Equal(result.body, body) {
+		result = queryResult{body: body, index: s.index}
+		s.results[key] = result
+	}
+	return result.index
+}
+
+func (s *Server) serve(w http.ResponseWriter, r *http.Request, body []byte) {
+	w.Header().Set("X-Consul-KnownLeader", "true")
+	w.Header().Set("X-Consul-LastContact", "0")
+	w.Header().Set("Content-Type", "application/json")
+
+	path := r.URL.Path
+	ns := r.URL.Query().Get("ns")
+	switch {
+	case path == "/v1/catalog/register":
+		var reg consulapi.CatalogRegistration
+		if err := json.Unmarshal(body, &reg); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.register(&reg)
+		s.reply(w, true)
+	case path == "/v1/catalog/deregister":
+		var dereg consulapi.CatalogDeregistration
+		if err := json.Unmarshal(body, &dereg); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.deregister(&dereg)
+		s.reply(w, true)
+	case path == "/v1/catalog/services":
+		s.reply(w, s.catalogServices(ns))
+	case path == "/v1/catalog/nodes":
+		s.reply(w, s.catalogNodes(r.URL.Query()["node-meta"]))
+	case strings.HasPrefix(path, "/v1/catalog/service/"):
+		s.reply(w, s.catalogService(strings.TrimPrefix(path, "/v1/catalog/service/"), ns))
+	case strings.HasPrefix(path, "/v1/catalog/node/"):
+		s.reply(w, s.catalogNode(strings.TrimPrefix(path, "/v1/catalog/node/")))
+	case strings.HasPrefix(path, "/v1/health/service/"):
+		s.reply(w, s.healthService(strings.TrimPrefix(path, "/v1/health/service/"), ns))
+	case strings.HasPrefix(path, "/v1/health/state/"):
+		s.reply(w, s.healthState(strings.TrimPrefix(path, "/v1/health/state/"), ns))
+	case strings.HasPrefix(path, "/v1/health/node/"):
+		s.reply(w, s.healthNode(strings.TrimPrefix(path, "/v1/health/node/")))
+	case path == "/v1/agent/self":
+		s.reply(w, map[string]interface{}{
+			"Config": map[string]interface{}{"Datacenter": Datacenter, "NodeName": "fakeconsul"},
+			"Member": map[string]interface{}{"Name": "fakeconsul"},
+		})
+	case path == "/v1/agent/services":
+		s.reply(w, map[string]*consulapi.AgentService{})
+	case path == "/v1/agent/checks":
+		s.reply(w, map[string]*consulapi.AgentCheck{})
+	case strings.HasPrefix(path, "/v1/kv/"):
+		s.handleKV(w, r, strings.TrimPrefix(path, "/v1/kv/"), body)
+	case path == "/v1/txn":
+		var ops consulapi.TxnOps
+		if err := json.Unmarshal(body, &ops); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if len(ops) > MaxTxnOps {
+			http.Error(w, fmt.Sprintf("Transaction contains too many operations (%d > %d)", len(ops), MaxTxnOps), http.StatusRequestEntityTooLarge)
+			return
+		}
+		s.txn(ops)
+		s.reply(w, &consulapi.TxnResponse{})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// change moves the index and releases blocked queries
+func (s *Server) change() {
+	s.index++
+	s.changed.Broadcast()
+}
+
+func (s *Server) reply(w http.ResponseWriter, v interface{}) {
+	json.NewEncoder(w).Encode(v)
+}
+
+func (s *Server) setNode(node *consulapi.Node) {
+	if node.Datacenter == "" {
+		node.Datacenter = Datacenter
+	}
+	s.nodes[node.Node] = node
+}
+
+func (s *Server) setService(nodeName string, svc *consulapi.AgentService) {
+	if svc.ID == "" {
+		svc.ID = svc.Service
+	}
+	s.servicesIndex = s.index
+	if s.services[nodeName] == nil {
+		s.services[nodeName] = make(map[string]*consulapi.AgentService)
+	}
+	s.services[nodeName][serviceKey(svc.Namespace, svc.ID)] = svc
+}
+
+// serviceKey returns the key of a service on its node, which is prefixed with
+// the namespace unless it is the default one
+func serviceKey(namespace string, id string) string {
+	if namespace == "" || namespace == "default" {
+		return id
+	}
+	return namespace + "/" + id
+}
+
+func sameNamespace(a string, b string) bool {
+	return serviceKey(a, "") == serviceKey(b, "")
+}
+
+func (s *Server) setCheck(check *consulapi.HealthCheck) {
+	if s.checks[check.Node] == nil {
+		s.checks[check.Node] = make(map[string]*consulapi.HealthCheck)
+	}
+	s.checks[check.Node][check.CheckID] = check
+}
+
+func (s *Server) deleteService(nodeName string, namespace string, id string) {
+	s.servicesIndex = s.index
+	delete(s.services[nodeName], serviceKey(namespace, id))
+	for checkID, check := range s.checks[nodeName] {
+		if check.ServiceID == id && sameNamespace(check.Namespace, namespace) {
+			delete(s.checks[nodeName], checkID)
+		}
+	}
+}
+
+func (s *Server) register(reg *consulapi.CatalogRegistration) {
+	if _, ok := s.nodes[reg.Node]; !ok || !reg.SkipNodeUpdate {
+		s.setNode(&consulapi.Node{
+			Node:            reg.Node,
+			Address:         reg.Address,
+			Datacenter:      reg.Datacenter,
+			TaggedAddresses: reg.TaggedAddresses,
+			Meta:            reg.NodeMeta,
+		})
+	}
+	if reg.Service != nil {
+		s.setService(reg.Node, reg.Service)
+	}
+	if reg.Check != nil {
+		s.setCheck(&consulapi.HealthCheck{
+			Node:        reg.Node,
+			CheckID:     reg.Check.CheckID,
+			Name:        reg.Check.Name,
+			Status:      reg.Check.Status,
+			Notes:       reg.Check.Notes,
+			Output:      reg.Check.Output,
+			ServiceID:   reg.Check.ServiceID,
+			ServiceName: reg.Check.ServiceName,
+			Namespace:   reg.Check.Namespace,
+		})
+	}
+}
+
+func (s *Server) deregister(dereg *consulapi.CatalogDeregistration) {
+	switch {
+	case dereg.ServiceID != "":
+		s.deleteService(dereg.Node, dereg.Namespace, dereg.ServiceID)
+	case dereg.CheckID != "":
+		delete(s.checks[dereg.Node], dereg.CheckID)
+	default:
+		delete(s.nodes, dereg.Node)
+		if len(s.services[dereg.Node]) > 0 {
+			s.servicesIndex = s.index
+		}
+		delete(s.services, dereg.Node)
+		delete(s.checks, dereg.Node)
+	}
+}
+
+func (s *Server) catalogServices(ns string) map[string][]string {
+	services := make(map[string][]string)
+	for _, byID := range s.services {
+		for _, svc := range byID {
+			if !sameNamespace(svc.Namespace, ns) {
+				continue
+			}
+			tags := services[svc.Service]
+			for _, tag := range svc.Tags {
+				if !contains(tags, tag) {
+					tags = append(tags, tag)
+				}
+			}
+			if tags == nil {
+				tags = []string{}
+			}
+			sort.Strings(tags)
+			services[svc.Service] = tags
+		}
+	}
+	return services
+}
+
+// catalogNodes returns the nodes having all node meta data given as
+// key:value filters
+func (s *Server) catalogNodes(filters []string) []*consulapi.Node {
+	nodes := []*consulapi.Node{}
+	for _, name := range s.nodeNames() {
+		node := s.nodes[name]
+		matches := true
+		for _, filter := range filters {
+			parts := strings.SplitN(filter, ":", 2)
+			if len(parts) != 2 || node.Meta[parts[0]] != parts[1] {
+				matches = false
+			}
+		}
+		if matches {
+			nodes = append(nodes, node)
+		}
+	}
+	return nodes
+}
+
+func (s *Server) catalogService(name string, ns string) []*consulapi.CatalogService {
+	entries := []*consulapi.CatalogService{}
+	for _, nodeName := range s.nodeNames() {
+		node := s.nodes[nodeName]
+		for _, svc := range s.nodeServices(nodeName) {
+			if svc.Service != name || !sameNamespace(svc.Namespace, ns) {
+				continue
+			}
+			entries = append(entries, &consulapi.CatalogService{
+				Node:           node.Node,
+				Address:        node.Address,
+				Datacenter:     node.Datacenter,
+				NodeMeta:       node.Meta,
+				ServiceID:      svc.ID,
+				ServiceName:    svc.Service,
+				ServiceAddress: svc.Address,
+				ServiceTags:    svc.Tags,
+				ServiceMeta:    svc.Meta,
+				ServicePort:    svc.Port,
+			})
+		}
+	}
+	return entries
+}
+
+func (s *Server) catalogNode(name string) *consulapi.CatalogNode {
+	node, ok := s.nodes[name]
+	if !ok {
+		return nil
+	}
+	services := make(map[string]*consulapi.AgentService)
+	for id, svc := range s.services[name] {
+		services[id] = svc
+	}
+	return &consulapi.CatalogNode{Node: node, Services: services}
+}
+
+func (s *Server) healthService(name string, ns string) []*consulapi.ServiceEntry {
+	entries := []*consulapi.ServiceEntry{}
+	for _, nodeName := range s.nodeNames() {
+		for _, svc := range s.nodeServices(nodeName) {
+			if svc.Service != name || !sameNamespace(svc.Namespace, ns) {
+				continue
+			}
+			checks := consulapi.HealthChecks{}
+			for _, check := range s.nodeChecks(nodeName) {
+				if check.ServiceID == "" || check.ServiceID == svc.ID {
+					checks = append(checks, check)
+				}
+			}
+			entries = append(entries, &consulapi.ServiceEntry{
+				Node:    s.nodes[nodeName],
+				Service: svc,
+				Checks:  checks,
+			})
+		}
+	}
+	return entries
+}
+
+// healthState returns the checks in a state, or all for 'any'. Checks of
+// services are filtered by namespace and carry the tags of their service.
+func (s *Server) healthState(state string, ns string) consulapi.HealthChecks {
+	checks := consulapi.HealthChecks{}
+	for _, nodeName := range s.nodeNames() {
+		for _, check := range s.nodeChecks(nodeName) {
+			if state != "any" && check.Status != state {
+				continue
+			}
+			if check.ServiceID != "" {
+				if !sameNamespace(check.Namespace, ns) {
+					continue
+				}
+				located := *check
+				if svc, ok := s.services[nodeName][serviceKey(check.Namespace, check.ServiceID)]; ok {
+					located.ServiceName = svc.Service
+					located.ServiceTags = svc.Tags
+				}
+				check = &located
+			}
+			checks = append(checks, check)
+		}
+	}
+	return checks
+}
+
+func (s *Server) healthNode(name string) consulapi.HealthChecks {
+	checks := consulapi.HealthChecks{}
+	return append(checks, s.nodeChecks(name)...)
+}
+
+func (s *Server) handleKV(w http.ResponseWriter, r *http.Request, key string, body []byte) {
+	query := r.URL.Query()
+	switch r.Method {
+	case http.MethodGet:
+		if _, ok := query["keys"]; ok {
+			keys := []string{}
+			for k := range s.kv {
+				if strings.HasPrefix(k, key) {
+					keys = append(keys, k)
+				}
+			}
+			sort.Strings(keys)
+			s.reply(w, keys)
+			return
+		}
+		var pairs consulapi.KVPairs
+		for k, value := range s.kv {
+			if k == key || (query.Get("recurse") != "" && strings.HasPrefix(k, key)) {
+				pairs = append(pairs, &consulapi.KVPair{Key: k, Value: value})
+			}
+		}
+		if len(pairs) == 0 {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		s.reply(w, pairs)
+	case http.MethodPut:
+		s.kv[key] = body
+		s.reply(w, true)
+	case http.MethodDelete:
+		s.deleteKV(key, query.Get("recurse") != "")
+		s.reply(w, true)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Server) deleteKV(key string, recurse bool) {
+	for k := range s.kv {
+		if k == key || (recurse && strings.HasPrefix(k, key)) {
+			delete(s.kv, k)
+		}
+	}
+}
+
+func (s *Server) txn(ops consulapi.TxnOps) {
+	for _, op := range ops {
+		switch {
+		case op.KV != nil:
+			switch op.KV.Verb {
+			case consulapi.KVSet:
+				s.kv[op.KV.Key] = op.KV.Value
+			case consulapi.KVDelete:
+				s.deleteKV(op.KV.Key, false)
+			case consulapi.KVDeleteTree:
+				s.deleteKV(op.KV.Key, true)
+			}
+		case op.Node != nil:
+			node := op.Node.Node
+			s.setNode(&node)
+		case op.Service != nil:
+			if op.Service.Verb == consulapi.ServiceDelete {
+				s.deleteService(op.Service.Node, op.Service.Service.Namespace, op.Service.Service.ID)
+			} else {
+				svc := op.Service.Service
+				s.setService(op.Service.Node, &svc)
+			}
+		case op.Check != nil:
+			if op.Check.Verb == consulapi.CheckDelete {
+				delete(s.checks[op.Check.Check.Node], op.Check.Check.CheckID)
+			} else {
+				check := op.Check.Check
+				s.setCheck(&check)
+			}
+		}
+	}
+}
+
+func (s *Server) nodeNames() []string {
+	var names []string
+	for name := range s.nodes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (s *Server) nodeServices(nodeName string) []*consulapi.AgentService {
+	var ids []string
+	for id := range s.services[nodeName] {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	services := make([]*consulapi.AgentService, len(ids))
+	for i, id := range ids {
+		services[i] = s.services[nodeName][id]
+	}
+	return services
+}
+
+func (s *Server) nodeChecks(nodeName string) []*consulapi.HealthCheck {
+	var ids []string
+	for id := range s.checks[nodeName] {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	checks := make([]*consulapi.HealthCheck, len(ids))
+	for i, id := range ids {
+		checks[i] = s.checks[nodeName][id]
+	}
+	return checks
+}
+
+func contains(list []string, s string) bool {
+	for _, elem := range list {
+		if elem == s {
+			return true
+		}
+	}
+	return false
+}
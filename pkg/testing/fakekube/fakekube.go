@@ -0,0 +1,158 @@
+// Package fakekube provides a fake kubernetes clientset for tests. Unlike
+// the one of the client library, its watches receive the creates, updates
+// and deletes made through it, so informers see changes like against an
+// apiserver.
+package fakekube
+
+import (
+	"sync"
+
+	kapi "k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/api/unversioned"
+	"k8s.io/kubernetes/pkg/apimachinery/registered"
+	"k8s.io/kubernetes/pkg/client/clientset_generated/internalclientset/fake"
+	"k8s.io/kubernetes/pkg/client/testing/core"
+	kruntime "k8s.io/kubernetes/pkg/runtime"
+	kwatch "k8s.io/kubernetes/pkg/watch"
+)
+
+// watchBuffer is the number of events a watch holds before a change blocks
+const watchBuffer = 100
+
+// NewClientset returns a clientset serving objects, whose watches receive
+// the changes made through it
+func NewClientset(objects ...kruntime.Object) *fake.Clientset {
+	tracker := core.NewObjectTracker(kapi.Scheme, kapi.Codecs.UniversalDecoder())
+	for _, obj := range objects {
+		if err := tracker.Add(obj); err != nil {
+			panic(err)
+		}
+	}
+	react := core.ObjectReaction(tracker, registered.RESTMapper())
+	w := &watchers{}
+
+	clientset := &fake.Clientset{}
+	clientset.AddReactor("*", "*", func(action core.Action) (bool, kruntime.Object, error) {
+		// deletes return no object, so it's looked up before
+		var deleted kruntime.Object
+		if a, ok := action.(core.DeleteActionImpl); ok {
+			deleted, _ = tracker.Get(gvk(a), a.GetNamespace(), a.GetName())
+		}
+
+		handled, obj, err := react(action)
+		if err != nil {
+			return handled, obj, err
+		}
+		switch a := action.(type) {
+		case core.CreateActionImpl:
+			if a.GetSubresource() == "" {
+				w.send(action, kwatch.Added, obj)
+			} else {
+				w.send(action, kwatch.Modified, obj)
+			}
+		case core.UpdateActionImpl:
+			w.send(action, kwatch.Modified, obj)
+		case core.DeleteActionImpl:
+			if deleted != nil {
+				w.send(action, kwatch.Deleted, deleted)
+			}
+		}
+		return handled, obj, err
+	})
+	clientset.AddWatchReactor("*", func(action core.Action) (bool, kwatch.Interface, error) {
+		return true, w.add(action), nil
+	})
+	return clientset
+}
+
+// gvk returns the internal kind of the resource of an action
+func gvk(action core.Action) unversioned.GroupVersionKind {
+	gvk, err := registered.RESTMapper().KindFor(action.GetResource())
+	if err != nil {
+		panic(err)
+	}
+	gvk.Version = kruntime.APIVersionInternal
+	return gvk
+}
+
+// watchers are the open watches by resource
+type watchers struct {
+	lock    sync.Mutex
+	watches []*watch
+}
+
+func (w *watchers) add(action core.Action) *watch {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	watch := &watch{
+		resource:  action.GetResource().Resource,
+		namespace: action.GetNamespace(),
+		result:    make(chan kwatch.Event, watchBuffer),
+		stopped:   make(chan struct{}),
+	}
+	w.watches = append(w.watches, watch)
+	return watch
+}
+
+// send passes a copy of obj to the watches of the resource and namespace of
+// action and forgets stopped watches
+func (w *watchers) send(action core.Action, eventType kwatch.EventType, obj kruntime.Object) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	open := w.watches[:0]
+	for _, watch := range w.watches {
+		if watch.isStopped() {
+			continue
+		}
+		open = append(open, watch)
+		if watch.resource != action.GetResource().Resource {
+			continue
+		}
+		if watch.namespace != kapi.NamespaceAll && watch.namespace != action.GetNamespace() {
+			continue
+		}
+		copied, err := kapi.Scheme.Copy(obj)
+		if err != nil {
+			panic(err)
+		}
+		watch.send(kwatch.Event{Type: eventType, Object: copied})
+	}
+	w.watches = open
+}
+
+// watch is a watch of a resource, its result channel is never closed
+type watch struct {
+	resource  string
+	namespace string
+	result    chan kwatch.Event
+	stopped   chan struct{}
+	stopOnce  sync.Once
+}
+
+func (w *watch) Stop() {
+	w.stopOnce.Do(func() {
+		close(w.stopped)
+	})
+}
+
+func (w *watch) ResultChan() <-chan kwatch.Event {
+	return w.result
+}
+
+func (w *watch) isStopped() bool {
+	select {
+	case <-w.stopped:
+		return true
+	default:
+		return false
+	}
+}
+
+func (w *watch) send(event kwatch.Event) {
+	select {
+	case w.result <- event:
+	case <-w.stopped:
+	}
+}